@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestIDLocal is the fiber.Ctx local holding the ID of a request
+const requestIDLocal = "requestID"
+
+// requestLogger gives every request an ID, taken from the X-Request-Id
+// header when the caller sets one, echoes it in the response and logs the
+// request once it has been served
+func requestLogger(c *fiber.Ctx) error {
+	id := c.Get(fiber.HeaderXRequestID)
+	if id == "" || len(id) > 64 {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Locals(requestIDLocal, id)
+	c.Set(fiber.HeaderXRequestID, id)
+
+	begin := time.Now()
+	err := c.Next()
+
+	fields := utils.Fields{
+		"method":      c.Method(),
+		"path":        c.Path(),
+		"status":      c.Response().StatusCode(),
+		"duration_ms": time.Since(begin).Milliseconds(),
+		"ip":          c.IP(),
+		"principal":   requestPrincipal(c),
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	utils.LogEvent(logContext(c), "http", "request", fields)
+	return err
+}
+
+// logContext returns a context carrying the span, request ID and tenant of
+// a request, for logs, audit events and the calls made to serve it
+func logContext(c *fiber.Ctx) context.Context {
+	ctx := spanContext(c)
+	if id, ok := c.Locals(requestIDLocal).(string); ok {
+		ctx = utils.WithRequestID(ctx, id)
+	}
+	if tenant := requestTenant(c); tenant.ID != "" {
+		ctx = utils.WithTenant(ctx, tenant)
+	}
+	return ctx
+}
+
+// audit records an action taken by the caller of a request
+func audit(c *fiber.Ctx, event utils.AuditEvent) {
+	event.Principal = requestPrincipal(c)
+	utils.Audit(logContext(c), event)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// auditEvents returns the events in the audit log
+func auditEvents(t *testing.T) []utils.AuditEvent {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(utils.CurrentConfig().AuditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []utils.AuditEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event utils.AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("audit line %q: %s", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestRequestID(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "req-1")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := resp.Header.Get(fiber.HeaderXRequestID); id != "req-1" {
+		t.Errorf("request ID = %q, want the caller's", id)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/api/sessions", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := resp.Header.Get(fiber.HeaderXRequestID); len(id) != 16 {
+		t.Errorf("generated request ID = %q", id)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	status, body := callWithHeaders(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"}, map[string]string{fiber.HeaderXRequestID: "start-1"})
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	data := body["data"].(map[string]interface{})
+	if status, body := call(t, app, http.MethodGet, "/api/get/rtc/demo", nil); status != http.StatusOK {
+		t.Fatalf("token: status %d: %v", status, body)
+	}
+	status, body = call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": data["rid"], "sid": data["sid"]})
+	if status != http.StatusOK {
+		t.Fatalf("stop: status %d: %v", status, body)
+	}
+
+	events := auditEvents(t)
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+		if event.Principal != testPrincipal || event.Tenant != utils.DefaultTenantID {
+			t.Errorf("event = %+v, want it attributed to tester", event)
+		}
+	}
+	if strings.Join(actions, " ") != "recording.start token.rtc recording.stop" {
+		t.Errorf("actions = %v", actions)
+	}
+	if start := events[0]; start.RequestID != "start-1" || start.Channel != "demo" || start.SID != data["sid"] {
+		t.Errorf("start event = %+v", start)
+	}
+}
+
+func TestRequestPrincipal(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString(requestPrincipal(c)) })
+
+	for header, want := range map[string]string{
+		"":                       "0.0.0.0",
+		"alice":                  `0.0.0.0 (unverified X-User-Id "alice")`,
+		`a"b`:                    `0.0.0.0 (unverified X-User-Id "a\"b")`,
+		strings.Repeat("x", 100): `0.0.0.0 (unverified X-User-Id "` + strings.Repeat("x", maxUserIDLength) + `")`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set("X-User-Id", header)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != want {
+			t.Errorf("X-User-Id %q: principal = %s, want %s", header, body, want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var prometheusHandler = fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+
+// metrics serves the Prometheus metrics of the service
+func metrics(c *fiber.Ctx) error {
+	prometheusHandler(c.Context())
+	return nil
+}
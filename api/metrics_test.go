@@ -0,0 +1,67 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// scrape returns the metrics exposition of app
+func scrape(t *testing.T, app *fiber.App) string {
+	t.Helper()
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	data := startRecording(t, app, "demo")
+	if status, body := call(t, app, http.MethodGet, "/api/tokens/demo", nil); status != http.StatusOK {
+		t.Fatalf("tokens: status %d: %v", status, body)
+	}
+
+	metrics := scrape(t, app)
+	for _, want := range []string{
+		`recording_active_sessions{mode="mix",tenant="default"} 1`,
+		`recording_agora_requests_total{code="200",method="acquire"}`,
+		`recording_agora_request_duration_seconds_count{method="start"}`,
+		`recording_tokens_issued_total{role="publisher",type="rtc"}`,
+		`recording_tokens_issued_total{role="user",type="rtm"}`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics do not include %s", want)
+		}
+	}
+
+	status, body := call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": data["rid"], "sid": data["sid"]})
+	if status != http.StatusOK {
+		t.Fatalf("stop: status %d: %v", status, body)
+	}
+
+	metrics = scrape(t, app)
+	for _, want := range []string{
+		`recording_minutes_total{mode="mix",tenant="default"}`,
+		`recording_storage_request_duration_seconds_count{code="200",operation="PutObject"}`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics do not include %s", want)
+		}
+	}
+	if strings.Contains(metrics, `recording_active_sessions{`) {
+		t.Error("stopped session still counted as active")
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// token requests per client IP
+	tokenLimits = &utils.RateLimiter{}
+	// recording starts per tenant
+	startLimits = &utils.RateLimiter{}
+)
+
+// limitTokens rate limits the token routes per client IP to
+// TOKEN_RATE_PER_MINUTE. The unverified X-User-Id header is not used, so
+// changing it does not get a caller a fresh allowance.
+func limitTokens(c *fiber.Ctx) error {
+	ok, retryAfter := tokenLimits.Allow(c.IP(), utils.CurrentConfig().TokenRatePerMinute)
+	if !ok {
+		return tooManyRequests(c, "too many token requests", retryAfter)
+	}
+	return c.Next()
+}
+
+// limitStarts rate limits recording starts per tenant to
+// START_RATE_PER_MINUTE
+func limitStarts(c *fiber.Ctx) error {
+	ok, retryAfter := startLimits.Allow(requestTenant(c).ID, utils.CurrentConfig().StartRatePerMinute)
+	if !ok {
+		return tooManyRequests(c, "too many recording starts", retryAfter)
+	}
+	return c.Next()
+}
+
+// tooManyRequests answers 429, telling the client in whole seconds when to
+// retry both in the Retry-After header and the body
+func tooManyRequests(c *fiber.Ctx, reason string, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{
+		"msg":         http.StatusTooManyRequests,
+		"err":         reason,
+		"retry_after": seconds,
+	})
+}
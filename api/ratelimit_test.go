@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTokenRateLimit(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	utils.CurrentConfig().TokenRatePerMinute = 2
+
+	for i := 0; i < 2; i++ {
+		if status, body := call(t, app, http.MethodGet, "/api/get/rtc/demo", nil); status != http.StatusOK {
+			t.Fatalf("token %d: status %d: %v", i+1, status, body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/get/rtm/42", nil)
+	req.Header.Set("X-User-Id", "tester")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Errorf("token over the rate: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get(fiber.HeaderRetryAfter))
+	}
+
+	// callers are limited by IP, so claiming to be someone else does not help
+	status, body := callWithHeaders(t, app, http.MethodGet, "/api/get/rtc/demo", nil, map[string]string{"X-User-Id": "someone-else"})
+	if status != http.StatusTooManyRequests {
+		t.Errorf("token with another X-User-Id: status %d: %v", status, body)
+	}
+}
+
+func TestStartRateLimit(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	utils.CurrentConfig().StartRatePerMinute = 1
+
+	if status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"}); status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "other"})
+	if status != http.StatusTooManyRequests || body["retry_after"] == nil {
+		t.Errorf("start over the rate: status %d: %v", status, body)
+	}
+}
+
+func TestRecordingQuota(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+	utils.CurrentConfig().MaxConcurrentRecordings = 1
+
+	status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"})
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	data := body["data"].(map[string]interface{})
+
+	status, body = call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "other"})
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("start over the quota: status %d: %v", status, body)
+	}
+	if got := fake.Calls(utils.OpStart); got != 1 {
+		t.Errorf("start calls = %d, want the second start refused before calling Agora", got)
+	}
+
+	status, body = call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": data["rid"], "sid": data["sid"]})
+	if status != http.StatusOK {
+		t.Fatalf("stop: status %d: %v", status, body)
+	}
+	if status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "other"}); status != http.StatusOK {
+		t.Errorf("start once the recording stopped: status %d: %v", status, body)
+	}
+}
+
+func TestLimitsPerTenant(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	addAcmeTenant(t)
+	cfg := utils.CurrentConfig()
+	cfg.StartRatePerMinute = 2
+	acme := cfg.Tenants["acme"]
+	acme.Recording.MaxConcurrentRecordings = 1
+	cfg.Tenants["acme"] = acme
+
+	// requests for the two tenants alternate, and acme is named by path and
+	// by header in turn, so no request finds the bytes an earlier one left
+	for _, step := range []struct {
+		target  string
+		tenant  string
+		channel string
+		status  int
+		err     string
+	}{
+		{"/t/acme/api/start/call", "", "a1", http.StatusOK, ""},
+		{"/api/start/call", "", "d1", http.StatusOK, ""},
+		{"/api/start/call", "acme", "a2", http.StatusTooManyRequests, "recording quota exceeded"},
+		{"/api/start/call", "", "d2", http.StatusOK, ""},
+		{"/t/acme/api/start/call", "", "a3", http.StatusTooManyRequests, "too many recording starts"},
+		{"/api/start/call", "", "d3", http.StatusTooManyRequests, "too many recording starts"},
+	} {
+		headers := map[string]string{}
+		if step.tenant != "" {
+			headers["X-Tenant-Id"] = step.tenant
+		}
+		status, body := callWithHeaders(t, app, http.MethodPost, step.target, fiber.Map{"channel": step.channel}, headers)
+		if status != step.status {
+			t.Fatalf("start %s: status %d, want %d: %v", step.channel, status, step.status, body)
+		}
+		if step.err != "" {
+			if err, _ := body["err"].(string); !strings.HasPrefix(err, step.err) {
+				t.Errorf("start %s: err %q, want %q", step.channel, err, step.err)
+			}
+		}
+	}
+}
@@ -1,15 +1,72 @@
 package api
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
 	"github.com/AgoraIO-Community/Cloud-Recording-Golang/schemas"
 	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
 	"github.com/gofiber/fiber/v2"
+	fiberutils "github.com/gofiber/fiber/v2/utils"
 )
 
+// maxUserIDLength caps the X-User-Id kept in principals
+const maxUserIDLength = 64
+
+// requestPrincipal identifies who made a request. The service does not
+// authenticate callers, so this is the client IP; an X-User-Id header is
+// kept next to it, marked as unverified, e.g.
+// `10.0.0.1 (unverified X-User-Id "alice")`.
+func requestPrincipal(c *fiber.Ctx) string {
+	user := c.Get("X-User-Id")
+	if user == "" {
+		return c.IP()
+	}
+	if len(user) > maxUserIDLength {
+		user = user[:maxUserIDLength]
+	}
+	return fmt.Sprintf("%s (unverified X-User-Id %q)", c.IP(), user)
+}
+
+// detached keeps the values of a context, such as the span and request ID,
+// but not its cancellation
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// requestContext returns the context for the Agora and storage calls of a
+// request, made for the request's tenant and tagged with its ID. fasthttp
+// cancels the context of every request as soon as the server starts shutting
+// down, so it is detached from it: calls in flight, such as a stop, run on
+// until the handler returns or ServerContext is cancelled at the end of the
+// drain. fasthttp does not report a client disconnect either, so abandoned
+// requests are bounded by the operation timeouts.
+func requestContext(c *fiber.Ctx) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(detached{logContext(c)})
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-utils.ServerContext().Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		cancel()
+	}
+}
+
 func startCall(c *fiber.Ctx) error {
 	u := new(schemas.StartCall)
 
@@ -19,27 +76,31 @@ func startCall(c *fiber.Ctx) error {
 			"err": err.Error(),
 		})
 	}
-	uid := int(rand.Uint32())
-	rec := &utils.Recorder{
-		Channel: u.Channel,
-		UID:     uid,
+	tenant := requestTenant(c)
+	transcoding, ok := utils.TranscodingPreset(tenant, u.Preset)
+	if !ok {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": "invalid preset",
+			"err": "unknown transcoding preset " + u.Preset,
+		})
 	}
 
-	_, err := rec.Acquire()
+	ctx, cancel := requestContext(c)
+	defer cancel()
 
-	if err != nil {
-		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
-			"msg": http.StatusInternalServerError,
-			"err": err.Error(),
-		})
+	ctx = utils.WithLogFields(ctx, utils.Fields{"channel": u.Channel})
+	utils.AnnotateSpan(ctx, u.Channel, cloudrecording.ModeMix, "", "")
+	rec, session, err := utils.StartSession(ctx, u.Channel, transcoding, utils.MaxDuration(tenant, u.MaxDurationSeconds), requestPrincipal(c))
+	if quotaErr, ok := err.(*utils.QuotaError); ok {
+		return tooManyRequests(c, quotaErr.Error(), quotaErr.RetryAfter)
 	}
-	_, err = rec.Start()
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
 			"err": err.Error(),
 		})
 	}
+	utils.AnnotateSpan(ctx, "", "", rec.RID, rec.SID)
 
 	return c.Status(http.StatusOK).JSON(fiber.Map{
 		"code":    http.StatusOK,
@@ -50,6 +111,7 @@ func startCall(c *fiber.Ctx) error {
 			"token":   rec.Token,
 			"channel": rec.Channel,
 			"uid":     rec.UID,
+			"stop_at": session.StopAt,
 		},
 	})
 }
@@ -64,17 +126,54 @@ func stopCall(c *fiber.Ctx) error {
 		})
 	}
 
-	_, err := utils.Stop(u.Channel, u.Uid, u.Rid, u.Sid)
+	if u.Mode == "" {
+		u.Mode = cloudrecording.ModeMix
+	}
+	if !cloudrecording.ValidMode(u.Mode) {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": "invalid mode",
+			"err": "mode must be mix, individual or web",
+		})
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ctx = utils.WithLogFields(ctx, utils.Fields{"channel": u.Channel, "sid": u.Sid})
+	utils.AnnotateSpan(ctx, u.Channel, u.Mode, u.Rid, u.Sid)
+	tenant := requestTenant(c)
+	client := utils.AgoraClient(tenant)
+
+	// the file list is only available while the recording is running
+	status, _ := client.Query(ctx, u.Rid, u.Sid, u.Mode)
+
+	result, err := client.Stop(ctx, u.Rid, u.Sid, u.Mode, cloudrecording.StopRequest{
+		Cname: u.Channel,
+		UID:   strconv.Itoa(u.Uid),
+	})
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
 			"err": err.Error(),
 		})
 	}
+	utils.ScheduleConsolidation(tenant, u.Channel, u.Sid)
+
+	files := result.Files()
+	if len(files) == 0 {
+		files = status.Files()
+	}
+	_, err = utils.CompleteSession(ctx, u.Channel, u.Uid, u.Rid, u.Sid, requestPrincipal(c), files)
+	if err != nil {
+		utils.LogEvent(ctx, "manifest", "writing manifest failed", utils.Fields{"error": err.Error()})
+	}
 
 	return c.JSON(fiber.Map{
-		"code":    http.StatusOK,
-		"message": "successful",
+		"code":            http.StatusOK,
+		"message":         "successful",
+		"data":            result,
+		"upload_complete": result.Uploaded(),
+		"backed_up":       result.BackedUp(),
 	})
 }
 
@@ -88,7 +187,22 @@ func callStatus(c *fiber.Ctx) error {
 		})
 	}
 
-	data, err := utils.CallStatus(u.Rid, u.Sid)
+	if u.Mode == "" {
+		u.Mode = cloudrecording.ModeMix
+	}
+	if !cloudrecording.ValidMode(u.Mode) {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": "invalid mode",
+			"err": "mode must be mix, individual or web",
+		})
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ctx = utils.WithLogFields(ctx, utils.Fields{"sid": u.Sid})
+	utils.AnnotateSpan(ctx, "", u.Mode, u.Rid, u.Sid)
+	data, err := utils.AgoraClient(requestTenant(c)).Query(ctx, u.Rid, u.Sid, u.Mode)
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
@@ -106,13 +220,14 @@ func callStatus(c *fiber.Ctx) error {
 func createRTCToken(c *fiber.Ctx) error {
 	channel := c.Params("channel")
 	uid := int(rand.Uint32())
-	rtcToken, err := utils.GetRtcToken(channel, uid)
+	rtcToken, err := utils.GetRtcToken(requestTenant(c), channel, uid)
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
 			"err": err.Error(),
 		})
 	}
+	audit(c, utils.AuditEvent{Action: utils.AuditTokenRTC, Channel: channel, UID: fmt.Sprint(uid)})
 
 	return c.JSON(fiber.Map{
 		"code":      http.StatusOK,
@@ -123,13 +238,14 @@ func createRTCToken(c *fiber.Ctx) error {
 
 func createRTMToken(c *fiber.Ctx) error {
 	uid := c.Params("uid")
-	rtmToken, err := utils.GetRtmToken(fmt.Sprint(uid))
+	rtmToken, err := utils.GetRtmToken(requestTenant(c), fmt.Sprint(uid))
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
 			"err": err.Error(),
 		})
 	}
+	audit(c, utils.AuditEvent{Action: utils.AuditTokenRTM, UID: uid})
 	return c.JSON(fiber.Map{
 		"code":      http.StatusOK,
 		"rtm_token": rtmToken,
@@ -139,20 +255,22 @@ func createRTMToken(c *fiber.Ctx) error {
 func createTokens(c *fiber.Ctx) error {
 	channel := c.Params("channel")
 	uid := int(rand.Uint32())
-	rtcToken, err := utils.GetRtcToken(channel, uid)
+	rtcToken, err := utils.GetRtcToken(requestTenant(c), channel, uid)
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
 			"err": err.Error(),
 		})
 	}
-	rtmToken, err := utils.GetRtmToken(fmt.Sprint(uid))
+	rtmToken, err := utils.GetRtmToken(requestTenant(c), fmt.Sprint(uid))
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
 			"err": err.Error(),
 		})
 	}
+	audit(c, utils.AuditEvent{Action: utils.AuditTokenRTC, Channel: channel, UID: fmt.Sprint(uid)})
+	audit(c, utils.AuditEvent{Action: utils.AuditTokenRTM, UID: fmt.Sprint(uid)})
 	return c.JSON(fiber.Map{
 		"code":      http.StatusOK,
 		"rtc_token": rtcToken,
@@ -161,7 +279,18 @@ func createTokens(c *fiber.Ctx) error {
 }
 
 func listRecordings(c *fiber.Ctx) error {
-	recordings, err := utils.GetRecordingsList(c.Params("channel") + "/")
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	recordings, err := utils.GetRecordingsList(ctx, c.Params("channel")+"/")
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	manifests, err := utils.GetManifests(ctx, c.Params("channel")+"/")
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
@@ -172,11 +301,23 @@ func listRecordings(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"code":           http.StatusOK,
 		"recording_urls": recordings,
+		"sessions":       manifests,
 	})
 }
 
 func listRecordingsURLs(c *fiber.Ctx) error {
-	recordings, err := utils.GetRecordingsURLs(c.Params("channel") + "/")
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	recordings, err := utils.GetRecordingsURLs(ctx, c.Params("channel")+"/")
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	manifests, err := utils.GetManifests(ctx, c.Params("channel")+"/")
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
@@ -187,11 +328,15 @@ func listRecordingsURLs(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"code":       http.StatusOK,
 		"recordings": recordings,
+		"sessions":   manifests,
 	})
 }
 
 func getProtectedRecordingUrl(c *fiber.Ctx) error {
-	recordingUrl, err := utils.GetRecordings(c.Params("+"))
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	recordingUrl, err := utils.GetRecordings(ctx, c.Params("+"))
 	if err != nil {
 		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
 			"msg": http.StatusInternalServerError,
@@ -205,15 +350,234 @@ func getProtectedRecordingUrl(c *fiber.Ctx) error {
 	})
 }
 
-// MountRoutes mounts all routes declared here
+func deleteRecording(c *fiber.Ctx) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	keys, err := utils.DeleteSession(ctx, c.Params("channel"), c.Params("session"))
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg":     http.StatusInternalServerError,
+			"err":     err.Error(),
+			"deleted": keys,
+		})
+	}
+
+	if len(keys) == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"msg": http.StatusNotFound,
+			"err": "no recordings found for session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"code":    http.StatusOK,
+		"message": "successful",
+		"deleted": keys,
+	})
+}
+
+func retentionReport(c *fiber.Ctx) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	report, err := utils.RunRetention(ctx, true)
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"code":   http.StatusOK,
+		"report": report,
+	})
+}
+
+func getSessionPlaylist(c *fiber.Ctx) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	resolve := utils.PresignedSegments(ctx, utils.PlaylistExpiry())
+	if c.Query("proxy") == "true" {
+		resolve = utils.ProxiedSegments(c.BaseURL() + routePrefix(c) + "/proxy")
+	}
+
+	playlist, err := utils.GetSessionPlaylist(ctx, c.Params("channel"), c.Params("session"), resolve)
+	if err == utils.ErrPlaylistNotFound {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"msg": http.StatusNotFound,
+			"err": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	audit(c, utils.AuditEvent{Action: utils.AuditDownload, Channel: c.Params("channel"), Files: []string{c.Params("channel") + "/" + c.Params("session") + "/playlist.m3u8"}})
+	c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+	return c.Send(playlist)
+}
+
+func proxyRecording(c *fiber.Ctx) error {
+	// the body is streamed after the handler returns, so it is read under
+	// the server context rather than a request context
+	ctx := utils.WithTenant(utils.ServerContext(), requestTenant(c))
+	key, err := url.PathUnescape(c.Params("+"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"msg": http.StatusBadRequest,
+			"err": err.Error(),
+		})
+	}
+	stream, err := utils.OpenObject(ctx, key, c.Get(fiber.HeaderRange), c.Get(fiber.HeaderIfNoneMatch))
+	if statusErr, ok := err.(*utils.StatusError); ok {
+		if statusErr.ETag != "" {
+			c.Set(fiber.HeaderETag, statusErr.ETag)
+		}
+		if statusErr.ContentRange != "" {
+			c.Set(fiber.HeaderContentRange, statusErr.ContentRange)
+		}
+		if statusErr.Status == http.StatusNotModified {
+			return c.SendStatus(http.StatusNotModified)
+		}
+		return c.Status(statusErr.Status).JSON(fiber.Map{
+			"msg": statusErr.Status,
+			"err": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	audit(c, utils.AuditEvent{Action: utils.AuditDownload, Files: []string{key}})
+	c.Status(stream.Status)
+	c.Set(fiber.HeaderContentType, stream.ContentType)
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	if stream.ETag != "" {
+		c.Set(fiber.HeaderETag, stream.ETag)
+	}
+	if stream.ContentRange != "" {
+		c.Set(fiber.HeaderContentRange, stream.ContentRange)
+	}
+	if !stream.LastModified.IsZero() {
+		c.Set(fiber.HeaderLastModified, stream.LastModified.UTC().Format(http.TimeFormat))
+	}
+	c.Context().SetBodyStream(stream.Body, int(stream.ContentLength))
+	return nil
+}
+
+func statusStream(c *fiber.Ctx) error {
+	// the shared poller outlives the request, so it gets copies
+	sid := fiberutils.CopyString(c.Params("sid"))
+	rid := fiberutils.CopyString(c.Query("rid"))
+	mode := fiberutils.CopyString(c.Query("mode", cloudrecording.ModeMix))
+
+	tenant := requestTenant(c)
+	if session, ok, err := utils.Sessions.Get(sid); err == nil && ok && utils.TenantID(session.Tenant) == tenant.ID {
+		rid = session.RID
+		mode = session.Mode
+	}
+	if rid == "" {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"msg": http.StatusNotFound,
+			"err": "unknown sid, pass rid as a query parameter",
+		})
+	}
+
+	events, unsubscribe := utils.SubscribeStatus(tenant, rid, sid, mode)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		// comments keep proxies from timing out and reveal closed clients
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		// streams end when draining so the server can shut down
+		for {
+			select {
+			case <-utils.Draining():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+func listSessions(c *fiber.Ctx) error {
+	sessions, err := utils.Sessions.List()
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	tenant := requestTenant(c)
+	owned := []utils.Session{}
+	for _, session := range sessions {
+		if utils.TenantID(session.Tenant) == tenant.ID {
+			owned = append(owned, session)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"code":     http.StatusOK,
+		"sessions": owned,
+	})
+}
+
+// MountRoutes mounts all routes declared here, both under /api for the
+// tenant named by the X-Tenant-Id header and under /t/:tenant/api, and the
+// metrics of the service at /metrics. Every request is logged and traced.
 func MountRoutes(app *fiber.App) {
-	app.Post("/api/start/call", startCall)
-	app.Post("/api/stop/call", stopCall)
-	app.Get("/api/get/list/:channel", listRecordings)
-	app.Get("/api/get/file/+", listRecordings)
-	app.Get("/api/get/recordingUrls/:channel", listRecordingsURLs)
-	app.Get("/api/get/rtc/:channel", createRTCToken)
-	app.Get("/api/get/rtm/:uid", createRTMToken)
-	app.Get("/api/tokens/:channel", createTokens)
-	app.Post("/api/status/call", callStatus)
+	app.Use(requestLogger, traceRequests)
+	app.Get("/metrics", metrics)
+	mountRoutes(app.Group("/api", resolveTenant))
+	mountRoutes(app.Group("/t/:tenant/api", resolveTenant))
+}
+
+func mountRoutes(api fiber.Router) {
+	api.Post("/start/call", limitStarts, startCall)
+	api.Post("/stop/call", stopCall)
+	api.Get("/get/list/:channel", listRecordings)
+	api.Get("/get/file/+", listRecordings)
+	api.Get("/get/recordingUrls/:channel", listRecordingsURLs)
+	api.Get("/get/rtc/:channel", limitTokens, createRTCToken)
+	api.Get("/get/rtm/:uid", limitTokens, createRTMToken)
+	api.Get("/tokens/:channel", limitTokens, createTokens)
+	api.Post("/status/call", callStatus)
+	api.Get("/status/stream/:sid", statusStream)
+	api.Get("/sessions", listSessions)
+	api.Post("/schedules", createSchedule)
+	api.Get("/schedules", listSchedules)
+	api.Delete("/schedules/:id", deleteSchedule)
+	api.Get("/recordings/retention", retentionReport)
+	api.Delete("/recordings/:channel/:session", deleteRecording)
+	api.Get("/recordings/:channel/:session/playlist.m3u8", getSessionPlaylist)
+	api.Get("/proxy/+", proxyRecording)
+	api.Post("/webhooks/agora", agoraNotification)
 }
@@ -0,0 +1,385 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording/cloudrecordingtest"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/s3test"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	testAppID          = "970ca35de60c44645bbae8a215061b33"
+	testAppCertificate = "5cfd2fd1755d40ecb72977518be15d3b"
+
+	// the principal of test requests, which set X-User-Id tester and come
+	// from app.Test's address
+	testPrincipal = `0.0.0.0 (unverified X-User-Id "tester")`
+)
+
+// newTestApp mounts the routes against a fake Agora server and a fake
+// bucket with a fresh session store
+func newTestApp(t *testing.T) (*fiber.App, *cloudrecordingtest.Server, *s3test.Server) {
+	fake := cloudrecordingtest.NewServer(testAppID, "customer", "secret")
+	t.Cleanup(fake.Close)
+	bucket := s3test.NewServer("recordings")
+	t.Cleanup(bucket.Close)
+
+	cfg := utils.DefaultConfig()
+	cfg.AppID = testAppID
+	cfg.AppCertificate = testAppCertificate
+	cfg.CustomerID = "customer"
+	cfg.CustomerCertificate = "secret"
+	cfg.AgoraBaseURL = fake.URL
+	cfg.BucketName = "recordings"
+	cfg.S3Endpoint = bucket.URL
+	cfg.SessionStorePath = filepath.Join(t.TempDir(), "sessions.json")
+	cfg.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	cfg.AgoraRetry = cloudrecording.RetryPolicy{MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 5}
+	utils.SetConfig(cfg)
+	t.Cleanup(func() { utils.SetConfig(utils.DefaultConfig()) })
+
+	utils.Sessions = &utils.SessionStore{}
+	tokenLimits = &utils.RateLimiter{}
+	startLimits = &utils.RateLimiter{}
+
+	app := fiber.New()
+	MountRoutes(app)
+	return app, fake, bucket
+}
+
+// call sends a JSON request and decodes the JSON response
+func call(t *testing.T, app *fiber.App, method string, target string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	return callWithHeaders(t, app, method, target, body, nil)
+}
+
+// callWithHeaders is call with extra request headers
+func callWithHeaders(t *testing.T, app *fiber.App, method string, target string, body interface{}, headers map[string]string) (int, map[string]interface{}) {
+	t.Helper()
+
+	var payload string
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = string(b)
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Id", "tester")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := app.Test(req, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("%s %s: decoding response: %s", method, target, err)
+	}
+	return resp.StatusCode, out
+}
+
+// startRecording starts a recording of channel and returns its data
+func startRecording(t *testing.T, app *fiber.App, channel string) map[string]interface{} {
+	t.Helper()
+
+	status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": channel})
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	return body["data"].(map[string]interface{})
+}
+
+func TestStartStatusStop(t *testing.T) {
+	app, fake, bucket := newTestApp(t)
+
+	data := startRecording(t, app, "demo")
+	rid, sid := data["rid"].(string), data["sid"].(string)
+
+	recording, ok := fake.Recording(sid)
+	if !ok {
+		t.Fatal("recording not started on Agora")
+	}
+	if recording.Cname != "demo" || recording.Start.ClientRequest.RecordingConfig.TranscodingConfig.Width != utils.DefaultTranscodingConfig.Width {
+		t.Errorf("start request = %+v", recording.Start)
+	}
+	if prefix := recording.Start.ClientRequest.StorageConfig.FileNamePrefix; len(prefix) != 2 || prefix[0] != "demo" {
+		t.Errorf("fileNamePrefix = %v", prefix)
+	}
+
+	status, body := call(t, app, http.MethodPost, "/api/status/call", fiber.Map{"rid": rid, "sid": sid})
+	if status != http.StatusOK {
+		t.Fatalf("status: status %d: %v", status, body)
+	}
+	serverResponse := body["data"].(map[string]interface{})["serverResponse"].(map[string]interface{})
+	if serverResponse["state"] != "recording" {
+		t.Errorf("state = %v, want recording", serverResponse["state"])
+	}
+
+	status, body = call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": rid, "sid": sid})
+	if status != http.StatusOK {
+		t.Fatalf("stop: status %d: %v", status, body)
+	}
+	if body["upload_complete"] != true {
+		t.Errorf("upload_complete = %v", body["upload_complete"])
+	}
+
+	recording, _ = fake.Recording(sid)
+	if recording.Status != cloudrecordingtest.StatusStopped {
+		t.Errorf("Agora status = %d, want stopped", recording.Status)
+	}
+	session, ok, err := utils.Sessions.Get(sid)
+	if err != nil || !ok {
+		t.Fatalf("session not tracked: %v", err)
+	}
+	if session.Status != utils.SessionStopped || session.StartedBy != testPrincipal || session.StoppedBy != testPrincipal {
+		t.Errorf("session = %+v", session)
+	}
+
+	manifest, ok := bucket.Object(session.Prefix + "manifest.json")
+	if !ok {
+		t.Fatal("manifest not written")
+	}
+	var written utils.Manifest
+	if err := json.Unmarshal(manifest.Body, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.SID != sid || len(written.Files) != 1 || written.Files[0].Filename != sid+"_demo.m3u8" {
+		t.Errorf("manifest = %+v", written)
+	}
+}
+
+func TestStartRetriesTransientErrors(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+	fake.Fail(cloudrecording.OpStart, cloudrecording.Error{StatusCode: http.StatusServiceUnavailable}, 1)
+
+	startRecording(t, app, "demo")
+
+	if calls := fake.Calls(cloudrecording.OpStart); calls != 2 {
+		t.Errorf("start calls = %d, want 2", calls)
+	}
+	if calls := fake.Calls(cloudrecording.OpAcquire); calls != 1 {
+		t.Errorf("acquire calls = %d, want the resource to be reused", calls)
+	}
+}
+
+func TestStartReacquiresExpiredResource(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+	fake.Fail(cloudrecording.OpStart, cloudrecording.Error{StatusCode: http.StatusBadRequest, Code: cloudrecording.CodeResourceExpired}, 1)
+
+	startRecording(t, app, "demo")
+
+	if calls := fake.Calls(cloudrecording.OpAcquire); calls != 2 {
+		t.Errorf("acquire calls = %d, want 2", calls)
+	}
+}
+
+func TestStartPermanentError(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+	fake.Fail(cloudrecording.OpAcquire, cloudrecording.Error{StatusCode: http.StatusBadRequest, Code: 2, Reason: "invalid parameter"}, 1)
+
+	status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body["err"].(string), "invalid parameter") {
+		t.Errorf("start: status %d: %v", status, body)
+	}
+	if calls := fake.Calls(cloudrecording.OpAcquire); calls != 1 {
+		t.Errorf("acquire calls = %d, want no retries", calls)
+	}
+	if len(fake.Recordings()) != 0 {
+		t.Error("recording started despite the error")
+	}
+}
+
+func TestWrongCustomerCredentials(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	utils.CurrentConfig().CustomerCertificate = "wrong"
+
+	status, body := call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body["err"].(string), "http 401") {
+		t.Errorf("start: status %d: %v", status, body)
+	}
+}
+
+func TestStatusOfEndedRecording(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+
+	data := startRecording(t, app, "demo")
+	rid, sid := data["rid"].(string), data["sid"].(string)
+	fake.End(sid, 20)
+
+	_, body := call(t, app, http.MethodPost, "/api/status/call", fiber.Map{"rid": rid, "sid": sid})
+	serverResponse := body["data"].(map[string]interface{})["serverResponse"].(map[string]interface{})
+	if serverResponse["state"] != "abnormal_exit" {
+		t.Errorf("state = %v, want abnormal_exit", serverResponse["state"])
+	}
+
+	status, body := call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": rid, "sid": sid})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body["err"].(string), "http 404") {
+		t.Errorf("stop: status %d: %v", status, body)
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+
+	status, _ := call(t, app, http.MethodPost, "/api/status/call", fiber.Map{"rid": "r", "sid": "s", "mode": "bogus"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("status with invalid mode: status %d", status)
+	}
+	status, _ = call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "rid": "r", "sid": "s", "mode": "bogus"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("stop with invalid mode: status %d", status)
+	}
+
+	status, _ = call(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo", "preset": "missing"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("start with unknown preset: status %d", status)
+	}
+	if calls := fake.Calls(cloudrecording.OpAcquire); calls != 0 {
+		t.Errorf("acquire calls = %d, want none for invalid requests", calls)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	startRecording(t, app, "first")
+	startRecording(t, app, "second")
+
+	status, body := call(t, app, http.MethodGet, "/api/sessions", nil)
+	if status != http.StatusOK {
+		t.Fatalf("sessions: status %d: %v", status, body)
+	}
+	sessions := body["sessions"].([]interface{})
+	if len(sessions) != 2 {
+		t.Fatalf("sessions = %v", sessions)
+	}
+	for _, session := range sessions {
+		if session.(map[string]interface{})["status"] != utils.SessionRecording {
+			t.Errorf("session = %v", session)
+		}
+	}
+}
+
+func TestProxyRecording(t *testing.T) {
+	app, _, bucket := newTestApp(t)
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	playlist := bucket.SeedSession("demo", start, "sid", 1)
+	segment := strings.TrimSuffix(playlist, "sid_demo.m3u8") + "sid_demo_20210501100000000.ts"
+	bucket.Put("demo/1619863200/segment 1.ts", []byte("0123456789"), start)
+	bucket.Put("demo/1619863200/manifest.json", []byte("{}"), start)
+	bucket.Put("secrets.txt", []byte("x"), start)
+
+	get := func(target string, headers map[string]string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/api/proxy/"+segment, nil)
+	etag := resp.Header.Get(fiber.HeaderETag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(fiber.HeaderContentType) != "video/mp2t" || etag == "" {
+		t.Fatalf("segment: status %d, type %q, etag %q", resp.StatusCode, resp.Header.Get(fiber.HeaderContentType), etag)
+	}
+
+	resp = get("/api/proxy/demo/1619863200/segment%201.ts", map[string]string{fiber.HeaderRange: "bytes=2-4"})
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "234" || resp.Header.Get(fiber.HeaderContentRange) != "bytes 2-4/10" {
+		t.Errorf("range: status %d, body %q, Content-Range %q", resp.StatusCode, body, resp.Header.Get(fiber.HeaderContentRange))
+	}
+
+	resp = get("/api/proxy/"+segment, map[string]string{fiber.HeaderIfNoneMatch: etag})
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get(fiber.HeaderETag) != etag {
+		t.Errorf("not modified: status %d, etag %q", resp.StatusCode, resp.Header.Get(fiber.HeaderETag))
+	}
+
+	resp = get("/api/proxy/demo/1619863200/segment%201.ts", map[string]string{fiber.HeaderRange: "bytes=20-"})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get(fiber.HeaderContentRange) != "bytes */10" {
+		t.Errorf("unsatisfiable range: status %d, Content-Range %q", resp.StatusCode, resp.Header.Get(fiber.HeaderContentRange))
+	}
+
+	for _, target := range []string{
+		"/api/proxy/secrets.txt",
+		"/api/proxy/demo/1619863200/manifest.json",
+		"/api/proxy/demo/1619863200/..%2F..%2Fsecrets.txt",
+		"/api/proxy/demo/notes/a.ts",
+	} {
+		if resp := get(target, nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestStatusStream(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+
+	data := startRecording(t, app, "demo")
+	sid := data["sid"].(string)
+	fake.End(sid, 20)
+
+	// the stream of a session that already ended closes after its state
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/status/stream/"+sid, nil), 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get(fiber.HeaderContentType); got != "text/event-stream" {
+		t.Errorf("content type = %q", got)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := strings.Index(string(body), "event: state\n")
+	ended := strings.Index(string(body), "event: ended\n")
+	if state < 0 || ended < state || !strings.Contains(string(body), `"abnormal_exit"`) {
+		t.Errorf("stream = %q, want the state then ended", body)
+	}
+
+	status, _ := call(t, app, http.MethodGet, "/api/status/stream/unknown", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("unknown sid: status %d, want 404", status)
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "request"))
+	cancel()
+
+	// the request is still identified, but its calls are not cancelled
+	ctx := detached{parent}
+	if ctx.Value(key{}) != "request" {
+		t.Error("value lost")
+	}
+	if ctx.Err() != nil || ctx.Done() != nil {
+		t.Errorf("err = %v, want the cancellation dropped", ctx.Err())
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("deadline kept")
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/schemas"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+func createSchedule(c *fiber.Ctx) error {
+	u := new(schemas.CreateSchedule)
+
+	if err := c.BodyParser(u); err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": "invalid json",
+			"err": err.Error(),
+		})
+	}
+
+	recurrence, err := utils.ParseRecurrence(u.Recurrence)
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": "invalid recurrence",
+			"err": err.Error(),
+		})
+	}
+
+	schedule, err := utils.Schedules.Create(utils.Schedule{
+		Tenant:          requestTenant(c).ID,
+		Channel:         u.Channel,
+		StartAt:         u.StartTime.UTC(),
+		DurationSeconds: u.DurationSeconds,
+		Preset:          u.Preset,
+		Recurrence:      recurrence,
+		CreatedBy:       requestPrincipal(c),
+	})
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"code":     http.StatusCreated,
+		"message":  "successful",
+		"schedule": schedule,
+	})
+}
+
+func listSchedules(c *fiber.Ctx) error {
+	schedules, err := utils.Schedules.List()
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+
+	tenant := requestTenant(c)
+	owned := []utils.Schedule{}
+	for _, schedule := range schedules {
+		if utils.TenantID(schedule.Tenant) == tenant.ID {
+			owned = append(owned, schedule)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"code":      http.StatusOK,
+		"schedules": owned,
+	})
+}
+
+func deleteSchedule(c *fiber.Ctx) error {
+	schedule, found, err := utils.Schedules.Get(c.Params("id"))
+	// schedules of other tenants are reported as missing
+	found = found && utils.TenantID(schedule.Tenant) == requestTenant(c).ID
+	if found {
+		found, err = utils.Schedules.Delete(schedule.ID)
+	}
+	if err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": http.StatusInternalServerError,
+			"err": err.Error(),
+		})
+	}
+	if !found {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"msg": http.StatusNotFound,
+			"err": "schedule not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"code":    http.StatusOK,
+		"message": "successful",
+	})
+}
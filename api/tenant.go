@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+	fiberutils "github.com/gofiber/fiber/v2/utils"
+)
+
+// tenantLocal is the fiber.Ctx local holding the tenant of a request
+const tenantLocal = "tenant"
+
+// resolveTenant selects the tenant a request is served for: the one named
+// by the /t/:tenant path prefix, else by the X-Tenant-Id header, else the
+// default tenant. Requests for unknown tenants are rejected.
+func resolveTenant(c *fiber.Ctx) error {
+	id := c.Params("tenant")
+	if id == "" {
+		id = c.Get("X-Tenant-Id")
+	}
+	// the ID ends up in stored sessions and background jobs, so it must not
+	// share the request buffer fasthttp reuses
+	id = fiberutils.CopyString(id)
+
+	tenant, ok := utils.GetTenant(id)
+	if !ok {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"msg": http.StatusNotFound,
+			"err": "unknown tenant " + id,
+		})
+	}
+
+	c.Locals(tenantLocal, tenant)
+	return c.Next()
+}
+
+// requestTenant returns the tenant resolved for a request
+func requestTenant(c *fiber.Ctx) utils.Tenant {
+	tenant, _ := c.Locals(tenantLocal).(utils.Tenant)
+	return tenant
+}
+
+// routePrefix returns the prefix the API routes of a request are mounted
+// under, keeping the tenant path prefix when the request used one
+func routePrefix(c *fiber.Ctx) string {
+	if id := c.Params("tenant"); id != "" {
+		return "/t/" + id + "/api"
+	}
+	return "/api"
+}
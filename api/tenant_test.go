@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording/cloudrecordingtest"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/s3test"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const acmeAppID = "0a7c4a8e2b1d4e3f9c6b5a4d3e2f1a0b"
+
+// addAcmeTenant configures a second tenant with its own Agora project and
+// bucket
+func addAcmeTenant(t *testing.T) (*cloudrecordingtest.Server, *s3test.Server) {
+	fake := cloudrecordingtest.NewServer(acmeAppID, "acme-customer", "acme-secret")
+	t.Cleanup(fake.Close)
+	bucket := s3test.NewServer("acme-recordings")
+	t.Cleanup(bucket.Close)
+
+	utils.CurrentConfig().Tenants = map[string]utils.Tenant{
+		"acme": {
+			AppID:               acmeAppID,
+			AppCertificate:      testAppCertificate,
+			CustomerID:          "acme-customer",
+			CustomerCertificate: "acme-secret",
+			AgoraBaseURL:        fake.URL,
+			Storage: utils.TenantStorage{
+				Bucket:       "acme-recordings",
+				Endpoint:     bucket.URL,
+				AccessKey:    "acme-key",
+				AccessSecret: "acme-secret",
+			},
+			Recording: utils.TenantRecording{MaxRecordingSeconds: 60},
+		},
+	}
+	return fake, bucket
+}
+
+func TestTenantSelection(t *testing.T) {
+	app, fake, _ := newTestApp(t)
+	acme, _ := addAcmeTenant(t)
+
+	startRecording(t, app, "demo")
+
+	status, body := call(t, app, http.MethodPost, "/t/acme/api/start/call", fiber.Map{"channel": "demo"})
+	if status != http.StatusOK {
+		t.Fatalf("start by path: status %d: %v", status, body)
+	}
+	data := body["data"].(map[string]interface{})
+	recording, ok := acme.Recording(data["sid"].(string))
+	if !ok {
+		t.Fatal("tenant recording not started on its own project")
+	}
+	if bucket := recording.Start.ClientRequest.StorageConfig.Bucket; bucket != "acme-recordings" {
+		t.Errorf("storage bucket = %q, want the tenant bucket", bucket)
+	}
+	if data["stop_at"] == nil {
+		t.Error("tenant max recording length not applied")
+	}
+
+	status, body = callWithHeaders(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"}, map[string]string{"X-Tenant-Id": "acme"})
+	if status != http.StatusOK {
+		t.Fatalf("start by header: status %d: %v", status, body)
+	}
+
+	if got := len(fake.Recordings()); got != 1 {
+		t.Errorf("default project recordings = %d, want 1", got)
+	}
+	if got := len(acme.Recordings()); got != 2 {
+		t.Errorf("tenant project recordings = %d, want 2", got)
+	}
+
+	for _, target := range []string{"/t/nope/api/sessions", "/api/sessions"} {
+		status, _ := callWithHeaders(t, app, http.MethodGet, target, nil, map[string]string{"X-Tenant-Id": "nope"})
+		if status != http.StatusNotFound {
+			t.Errorf("%s for unknown tenant: status %d, want 404", target, status)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	app, _, bucket := newTestApp(t)
+	_, acmeBucket := addAcmeTenant(t)
+
+	startRecording(t, app, "demo")
+	status, body := call(t, app, http.MethodPost, "/t/acme/api/start/call", fiber.Map{"channel": "demo"})
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	data := body["data"].(map[string]interface{})
+
+	for target, want := range map[string]string{"/api/sessions": utils.DefaultTenantID, "/t/acme/api/sessions": "acme"} {
+		_, body := call(t, app, http.MethodGet, target, nil)
+		sessions := body["sessions"].([]interface{})
+		if len(sessions) != 1 || utils.TenantID(sessions[0].(map[string]interface{})["tenant"].(string)) != want {
+			t.Errorf("%s = %v, want only %s sessions", target, sessions, want)
+		}
+	}
+
+	status, body = call(t, app, http.MethodPost, "/t/acme/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": data["rid"], "sid": data["sid"]})
+	if status != http.StatusOK {
+		t.Fatalf("stop: status %d: %v", status, body)
+	}
+
+	session, _, _ := utils.Sessions.Get(data["sid"].(string))
+	object, ok := acmeBucket.Object(session.Prefix + "manifest.json")
+	if !ok {
+		t.Fatal("manifest not written to the tenant bucket")
+	}
+	var manifest utils.Manifest
+	if err := json.Unmarshal(object.Body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Tenant != "acme" {
+		t.Errorf("manifest tenant = %q", manifest.Tenant)
+	}
+	if len(bucket.Keys()) != 0 {
+		t.Errorf("default bucket keys = %v, want none", bucket.Keys())
+	}
+
+	_, body = call(t, app, http.MethodGet, "/t/acme/api/get/list/demo", nil)
+	if sessions := body["sessions"].([]interface{}); len(sessions) != 1 {
+		t.Errorf("tenant listing sessions = %v", sessions)
+	}
+	_, body = call(t, app, http.MethodGet, "/api/get/list/demo", nil)
+	if sessions := body["sessions"].([]interface{}); len(sessions) != 0 {
+		t.Errorf("default listing sessions = %v, want none", sessions)
+	}
+}
+
+func TestTenantOutlivesRequest(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	addAcmeTenant(t)
+
+	status, body := call(t, app, http.MethodPost, "/t/acme/api/start/call", fiber.Map{"channel": "demo"})
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	sid := body["data"].(map[string]interface{})["sid"].(string)
+
+	// the next request reuses the buffers of the first
+	call(t, app, http.MethodGet, "/api/sessions", nil)
+
+	if session, _, _ := utils.Sessions.Get(sid); session.Tenant != "acme" {
+		t.Errorf("session tenant = %q, want acme", session.Tenant)
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+	fiberutils "github.com/gofiber/fiber/v2/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// contextLocal is the fiber.Ctx local holding the context of the span of a
+// request
+const contextLocal = "context"
+
+// traceRequests serves every request under a span, continuing the trace of
+// the caller when it sends a traceparent header
+func traceRequests(c *fiber.Ctx) error {
+	header := http.Header{}
+	c.Request().Header.VisitAll(func(key []byte, value []byte) {
+		header.Add(string(key), string(value))
+	})
+	ctx := otel.GetTextMapPropagator().Extract(c.Context(), propagation.HeaderCarrier(header))
+
+	// spans are exported after the request buffers are reused
+	method, path := fiberutils.CopyString(c.Method()), fiberutils.CopyString(c.Path())
+	ctx, span := otel.Tracer(utils.TracerName).Start(ctx, method+" "+path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(method),
+			semconv.HTTPTargetKey.String(path),
+		),
+	)
+	defer span.End()
+	c.Locals(contextLocal, ctx)
+
+	err := c.Next()
+
+	// the route is only known once the request has been routed
+	span.SetName(method + " " + c.Route().Path)
+	status := c.Response().StatusCode()
+	span.SetAttributes(semconv.HTTPRouteKey.String(c.Route().Path), semconv.HTTPStatusCodeKey.Int(status))
+	if err != nil {
+		span.RecordError(err)
+	}
+	if err != nil || status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	return err
+}
+
+// spanContext returns the context of the span of a request
+func spanContext(c *fiber.Ctx) context.Context {
+	if ctx, ok := c.Locals(contextLocal).(context.Context); ok {
+		return ctx
+	}
+	return c.Context()
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+	app, _, _ := newTestApp(t)
+
+	// the caller's trace is continued
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	status, body := callWithHeaders(t, app, http.MethodPost, "/api/start/call", fiber.Map{"channel": "demo"}, map[string]string{"traceparent": traceparent})
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d: %v", status, body)
+	}
+	data := body["data"].(map[string]interface{})
+	status, body = call(t, app, http.MethodPost, "/api/stop/call", fiber.Map{"channel": "demo", "uid": data["uid"], "rid": data["rid"], "sid": data["sid"]})
+	if status != http.StatusOK {
+		t.Fatalf("stop: status %d: %v", status, body)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	start, ok := spans["POST /api/start/call"]
+	if !ok {
+		t.Fatalf("no span for the start request in %v", exporter.GetSpans())
+	}
+	if id := start.SpanContext.TraceID().String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("start request trace = %s, want the caller's", id)
+	}
+	for _, name := range []string{"Recorder.Start", "cloudrecording.start"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.SpanContext.TraceID() != start.SpanContext.TraceID() {
+			t.Errorf("%s is not part of the trace of the start request", name)
+		}
+	}
+	// read after later requests have reused the buffers of the start
+	requestAttrs := map[string]string{}
+	for _, attr := range start.Attributes {
+		requestAttrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if requestAttrs["http.method"] != http.MethodPost || requestAttrs["http.target"] != "/api/start/call" {
+		t.Errorf("start request attributes = %v", requestAttrs)
+	}
+
+	attrs := map[string]string{}
+	for _, attr := range spans["cloudrecording.start"].Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["recording.channel"] != "demo" || attrs["recording.rid"] != data["rid"] {
+		t.Errorf("cloudrecording.start attributes = %v", attrs)
+	}
+
+	stop, ok := spans["POST /api/stop/call"]
+	if !ok {
+		t.Fatal("no span for the stop request")
+	}
+	put, ok := spans["s3.PutObject"]
+	if !ok {
+		t.Fatal("no span for the manifest upload")
+	}
+	if put.SpanContext.TraceID() != stop.SpanContext.TraceID() {
+		t.Error("s3.PutObject is not part of the trace of the stop request")
+	}
+}
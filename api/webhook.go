@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/schemas"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+func agoraNotification(c *fiber.Ctx) error {
+	tenant := requestTenant(c)
+	if !utils.VerifyNotification(tenant, c.Body(), c.Get("Agora-Signature-V2")) {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"msg": http.StatusUnauthorized,
+			"err": "invalid signature",
+		})
+	}
+
+	u := new(schemas.Notification)
+	if err := c.BodyParser(u); err != nil {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"msg": "invalid json",
+			"err": err.Error(),
+		})
+	}
+
+	if u.ProductID == utils.ProductCloudRecording {
+		event := new(schemas.RecordingEvent)
+		if err := json.Unmarshal(u.Payload, event); err != nil {
+			return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+				"msg": "invalid json",
+				"err": err.Error(),
+			})
+		}
+
+		switch u.EventType {
+		case utils.EventSessionExit:
+			sent := event.Sendts
+			if sent == 0 {
+				sent = u.NotifyMs
+			}
+			if err := utils.Sessions.RecordExit(event.Sid, time.Unix(0, sent*int64(time.Millisecond))); err != nil {
+				return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+					"msg": http.StatusInternalServerError,
+					"err": err.Error(),
+				})
+			}
+		case utils.EventRecordingUploaded:
+			utils.ScheduleConsolidation(tenant, event.Cname, event.Sid)
+		}
+	}
+
+	if u.ProductID == utils.ProductRTC {
+		event := new(schemas.ChannelEvent)
+		if err := json.Unmarshal(u.Payload, event); err != nil {
+			return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+				"msg": "invalid json",
+				"err": err.Error(),
+			})
+		}
+		utils.HandleChannelEvent(tenant, u.EventType, event.ChannelName, event.Uid, event.ClientSeq)
+	}
+
+	// Agora retries notifications until it receives a 200
+	return c.JSON(fiber.Map{
+		"code": http.StatusOK,
+	})
+}
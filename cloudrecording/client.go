@@ -0,0 +1,249 @@
+// Package cloudrecording is a client for the Agora Cloud Recording REST API.
+// It has no configuration of its own; callers fill in a Client explicitly.
+package cloudrecording
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultBaseURL is the Agora REST API host
+const DefaultBaseURL = "https://api.agora.io"
+
+// Operations, used as keys of Client.Timeouts
+const (
+	OpAcquire      = "acquire"
+	OpStart        = "start"
+	OpQuery        = "query"
+	OpUpdate       = "update"
+	OpUpdateLayout = "updateLayout"
+	OpStop         = "stop"
+)
+
+// Client calls the cloud recording endpoints of one Agora project
+type Client struct {
+	AppID               string
+	CustomerID          string
+	CustomerCertificate string
+
+	// BaseURL defaults to DefaultBaseURL
+	BaseURL string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Logger receives one line per failed attempt; nil disables logging
+	Logger *log.Logger
+	// Observe, when set, is called after every attempt with its outcome
+	Observe func(ctx context.Context, op string, err error, elapsed time.Duration)
+	// TracerProvider traces every call; nil uses the global provider
+	TracerProvider trace.TracerProvider
+	// Retry is applied to every call. The zero value makes a single attempt.
+	Retry RetryPolicy
+	// Timeouts bounds each operation, retries included, keyed by Op*
+	Timeouts map[string]time.Duration
+}
+
+// NewClient returns a client with the default base URL and retry policy
+func NewClient(appID string, customerID string, customerCertificate string) *Client {
+	return &Client{
+		AppID:               appID,
+		CustomerID:          customerID,
+		CustomerCertificate: customerCertificate,
+		BaseURL:             DefaultBaseURL,
+		Retry:               DefaultRetryPolicy,
+	}
+}
+
+// Acquire reserves a resource ID for a recording
+func (c *Client) Acquire(ctx context.Context, req AcquireRequest) (AcquireResponse, error) {
+	var resp AcquireResponse
+	err := c.call(ctx, OpAcquire, SpanAttributes(req.Cname, "", "", ""), http.MethodPost, "acquire", req, &resp)
+	return resp, err
+}
+
+// Start starts a recording in mode with an acquired resource ID. When a retry
+// is refused with CodeAlreadyRunning, an earlier attempt started the
+// recording: the recording named by the error is returned, and without one
+// the error is.
+func (c *Client) Start(ctx context.Context, resourceID string, mode string, req StartRequest) (StartResponse, error) {
+	var resp StartResponse
+	err := c.call(ctx, OpStart, SpanAttributes(req.Cname, mode, resourceID, ""), http.MethodPost, "resourceid/"+resourceID+"/mode/"+mode+"/start", req, &resp)
+	return resp, err
+}
+
+// Query returns the state and uploaded files of a recording
+func (c *Client) Query(ctx context.Context, resourceID string, sid string, mode string) (QueryResponse, error) {
+	var resp QueryResponse
+	if err := c.call(ctx, OpQuery, SpanAttributes("", mode, resourceID, sid), http.MethodGet, sessionPath(resourceID, sid, mode)+"/query", nil, &resp); err != nil {
+		return QueryResponse{}, err
+	}
+
+	resp.ServerResponse.State = RecordingState(resp.ServerResponse.Status)
+	for _, extension := range resp.ServerResponse.ExtensionServiceState {
+		if extension.Payload.Onhold {
+			resp.ServerResponse.Paused = true
+		}
+	}
+	return resp, nil
+}
+
+// Update changes the subscriptions of a recording, pauses or resumes a web
+// recording, or changes its RTMP outputs
+func (c *Client) Update(ctx context.Context, resourceID string, sid string, mode string, req UpdateRequest) (UpdateResponse, error) {
+	var resp UpdateResponse
+	err := c.call(ctx, OpUpdate, SpanAttributes(req.Cname, mode, resourceID, sid), http.MethodPost, sessionPath(resourceID, sid, mode)+"/update", req, &resp)
+	return resp, err
+}
+
+// UpdateLayout changes the video layout of a mix mode recording
+func (c *Client) UpdateLayout(ctx context.Context, resourceID string, sid string, mode string, req UpdateLayoutRequest) (UpdateResponse, error) {
+	var resp UpdateResponse
+	err := c.call(ctx, OpUpdateLayout, SpanAttributes(req.Cname, mode, resourceID, sid), http.MethodPost, sessionPath(resourceID, sid, mode)+"/updateLayout", req, &resp)
+	return resp, err
+}
+
+// Stop stops a recording and returns the files it uploaded. A retry that no
+// longer finds the recording counts as stopped, with no files listed.
+func (c *Client) Stop(ctx context.Context, resourceID string, sid string, mode string, req StopRequest) (StopResponse, error) {
+	var resp StopResponse
+	err := c.call(ctx, OpStop, SpanAttributes(req.Cname, mode, resourceID, sid), http.MethodPost, sessionPath(resourceID, sid, mode)+"/stop", req, &resp)
+	return resp, err
+}
+
+func sessionPath(resourceID string, sid string, mode string) string {
+	return "resourceid/" + resourceID + "/sid/" + sid + "/mode/" + mode
+}
+
+// url returns the address of a cloud recording endpoint
+func (c *Client) url(endpoint string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	return strings.TrimSuffix(base, "/") + "/v1/apps/" + c.AppID + "/cloud_recording/" + endpoint
+}
+
+// call sends body as JSON and decodes the response into out. Transient
+// failures are retried under c.Retry until the timeout of op runs out;
+// non-200 responses are returned as *Error. The call, retries included, is
+// traced as one span with attrs.
+func (c *Client) call(ctx context.Context, op string, attrs []attribute.KeyValue, method string, endpoint string, body interface{}, out interface{}) (err error) {
+	tracerProvider := c.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	ctx, span := tracerProvider.Tracer(tracerName).Start(ctx, "cloudrecording."+op,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	if timeout := c.Timeouts[op]; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	url := c.url(endpoint)
+
+	attempt := 0
+	return withRetry(ctx, c.Retry, func() error {
+		attempt++
+		begin := time.Now()
+		err := c.do(ctx, httpClient, method, url, payload, out)
+		if err != nil && attempt > 1 {
+			err = settle(op, err, out)
+		}
+		if err != nil {
+			span.AddEvent("attempt failed", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+		}
+		if c.Observe != nil {
+			c.Observe(ctx, op, err, time.Since(begin))
+		}
+		if err != nil && c.Logger != nil {
+			c.Logger.Printf("cloudrecording: %s %s: attempt %d: %s", method, op, attempt, err)
+		}
+		return err
+	})
+}
+
+// settle resolves the error of a retry that only shows an earlier attempt
+// went through without its response arriving: a stop of a recording that
+// is gone, or a start refused as already running that names the recording
+// it started
+func settle(op string, err error, out interface{}) error {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch {
+	case op == OpStop && apiErr.StatusCode == http.StatusNotFound:
+		return nil
+	case op == OpStart && apiErr.Code == CodeAlreadyRunning && apiErr.SID != "":
+		if resp, ok := out.(*StartResponse); ok {
+			resp.ResourceID = apiErr.ResourceID
+			resp.SID = apiErr.SID
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *Client) do(ctx context.Context, httpClient *http.Client, method string, url string, payload []byte, out interface{}) error {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.CustomerID, c.CustomerCertificate)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &Error{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+		json.Unmarshal(data, apiErr)
+		return apiErr
+	}
+	return json.Unmarshal(data, out)
+}
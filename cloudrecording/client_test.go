@@ -0,0 +1,296 @@
+package cloudrecording_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording/cloudrecordingtest"
+)
+
+func newFake(t *testing.T) *cloudrecordingtest.Server {
+	fake := cloudrecordingtest.NewServer("test-app", "customer", "secret")
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func start(t *testing.T, client *cloudrecording.Client, mode string, clientRequest cloudrecording.StartClientRequest) (string, string) {
+	ctx := context.Background()
+
+	acquired, err := client.Acquire(ctx, cloudrecording.AcquireRequest{Cname: "demo", UID: "42"})
+	if err != nil {
+		t.Fatal("acquire:", err)
+	}
+	started, err := client.Start(ctx, acquired.ResourceID, mode, cloudrecording.StartRequest{Cname: "demo", UID: "42", ClientRequest: clientRequest})
+	if err != nil {
+		t.Fatal("start:", err)
+	}
+	return acquired.ResourceID, started.SID
+}
+
+func mixRequest() cloudrecording.StartClientRequest {
+	return cloudrecording.StartClientRequest{
+		RecordingConfig: &cloudrecording.RecordingConfig{ChannelType: 1, StreamTypes: 2},
+	}
+}
+
+func TestMixLifecycle(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	ctx := context.Background()
+
+	rid, sid := start(t, client, cloudrecording.ModeMix, mixRequest())
+
+	status, err := client.Query(ctx, rid, sid, cloudrecording.ModeMix)
+	if err != nil {
+		t.Fatal("query:", err)
+	}
+	if status.ServerResponse.State != "recording" {
+		t.Errorf("state = %q, want recording", status.ServerResponse.State)
+	}
+	if files := status.Files(); len(files) != 1 || files[0].Filename != sid+"_demo.m3u8" {
+		t.Errorf("files = %+v", files)
+	}
+
+	_, err = client.UpdateLayout(ctx, rid, sid, cloudrecording.ModeMix, cloudrecording.UpdateLayoutRequest{
+		Cname:         "demo",
+		UID:           "42",
+		ClientRequest: cloudrecording.UpdateLayoutClientRequest{MixedVideoLayout: 2},
+	})
+	if err != nil {
+		t.Fatal("updateLayout:", err)
+	}
+
+	stopped, err := client.Stop(ctx, rid, sid, cloudrecording.ModeMix, cloudrecording.StopRequest{Cname: "demo", UID: "42"})
+	if err != nil {
+		t.Fatal("stop:", err)
+	}
+	if !stopped.Uploaded() || len(stopped.Files()) != 1 {
+		t.Errorf("stop response = %+v", stopped)
+	}
+
+	if _, err := client.Query(ctx, rid, sid, cloudrecording.ModeMix); !cloudrecording.NotFound(err) {
+		t.Errorf("query after stop: err = %v, want not found", err)
+	}
+
+	recording, _ := fake.Recording(sid)
+	if len(recording.Layouts) != 1 || recording.Status != cloudrecordingtest.StatusStopped {
+		t.Errorf("recording = %+v", recording)
+	}
+}
+
+func TestWebPause(t *testing.T) {
+	client := newFake(t).Client()
+	ctx := context.Background()
+
+	rid, sid := start(t, client, cloudrecording.ModeWeb, cloudrecording.StartClientRequest{
+		ExtensionServiceConfig: &cloudrecording.ExtensionServiceConfig{
+			ExtensionServices: []cloudrecording.ExtensionService{{
+				ServiceName:  "web_recorder_service",
+				ServiceParam: map[string]interface{}{"url": "https://example.com"},
+			}},
+		},
+	})
+
+	_, err := client.Update(ctx, rid, sid, cloudrecording.ModeWeb, cloudrecording.UpdateRequest{
+		Cname:         "demo",
+		UID:           "42",
+		ClientRequest: cloudrecording.UpdateClientRequest{WebRecordingConfig: &cloudrecording.WebRecordingUpdate{Onhold: true}},
+	})
+	if err != nil {
+		t.Fatal("update:", err)
+	}
+
+	status, err := client.Query(ctx, rid, sid, cloudrecording.ModeWeb)
+	if err != nil {
+		t.Fatal("query:", err)
+	}
+	if !status.ServerResponse.Paused {
+		t.Error("web recording not reported paused")
+	}
+
+	_, err = client.UpdateLayout(ctx, rid, sid, cloudrecording.ModeWeb, cloudrecording.UpdateLayoutRequest{Cname: "demo", UID: "42"})
+	var apiErr *cloudrecording.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("updateLayout in web mode: err = %v, want 400", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	var observed []error
+	client.Observe = func(ctx context.Context, op string, err error, elapsed time.Duration) {
+		observed = append(observed, err)
+	}
+
+	fake.Fail(cloudrecording.OpAcquire, cloudrecording.Error{StatusCode: http.StatusServiceUnavailable}, 2)
+	if _, err := client.Acquire(context.Background(), cloudrecording.AcquireRequest{Cname: "demo", UID: "42"}); err != nil {
+		t.Fatal("acquire:", err)
+	}
+	if calls := fake.Calls(cloudrecording.OpAcquire); calls != 3 {
+		t.Errorf("acquire calls = %d, want 3", calls)
+	}
+	if len(observed) != 3 || observed[0] == nil || observed[2] != nil {
+		t.Errorf("observed attempts = %v, want two failures and a success", observed)
+	}
+
+	fake.Fail(cloudrecording.OpAcquire, cloudrecording.Error{StatusCode: http.StatusBadRequest, Code: 2}, 1)
+	if _, err := client.Acquire(context.Background(), cloudrecording.AcquireRequest{Cname: "demo", UID: "42"}); err == nil {
+		t.Fatal("acquire succeeded despite a permanent error")
+	}
+	if calls := fake.Calls(cloudrecording.OpAcquire); calls != 4 {
+		t.Errorf("acquire calls = %d, want 4", calls)
+	}
+}
+
+func TestResourceExpired(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	ctx := context.Background()
+
+	acquired, err := client.Acquire(ctx, cloudrecording.AcquireRequest{Cname: "demo", UID: "42"})
+	if err != nil {
+		t.Fatal("acquire:", err)
+	}
+	fake.ExpireResources()
+
+	_, err = client.Start(ctx, acquired.ResourceID, cloudrecording.ModeMix, cloudrecording.StartRequest{Cname: "demo", UID: "42", ClientRequest: mixRequest()})
+	if !cloudrecording.ResourceExpired(err) {
+		t.Errorf("start with expired resource: err = %v, want code 433", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	client.CustomerCertificate = "wrong"
+
+	_, err := client.Acquire(context.Background(), cloudrecording.AcquireRequest{Cname: "demo", UID: "42"})
+	var apiErr *cloudrecording.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("err = %v, want 401", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	client.Retry = cloudrecording.RetryPolicy{MaxAttempts: 2, InitialBackoffMs: 1, MaxBackoffMs: 1}
+
+	fake.Fail(cloudrecording.OpAcquire, cloudrecording.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}, 1)
+	begin := time.Now()
+	if _, err := client.Acquire(context.Background(), cloudrecording.AcquireRequest{Cname: "demo", UID: "42"}); err != nil {
+		t.Fatal("acquire:", err)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second {
+		t.Errorf("retried after %s, before the second Retry-After asked for", elapsed)
+	}
+}
+
+func TestLostResponses(t *testing.T) {
+	fake := newFake(t)
+	client := fake.Client()
+	ctx := context.Background()
+
+	// the first start goes through, so its retry is refused as already
+	// running and returns the recording it started
+	acquired, err := client.Acquire(ctx, cloudrecording.AcquireRequest{Cname: "demo", UID: "42"})
+	if err != nil {
+		t.Fatal("acquire:", err)
+	}
+	fake.LoseResponses(cloudrecording.OpStart, 1)
+	started, err := client.Start(ctx, acquired.ResourceID, cloudrecording.ModeMix, cloudrecording.StartRequest{Cname: "demo", UID: "42", ClientRequest: mixRequest()})
+	if err != nil {
+		t.Fatal("start:", err)
+	}
+	if recording, ok := fake.Recording(started.SID); !ok || started.ResourceID != acquired.ResourceID {
+		t.Errorf("start = %+v, want the recording started by the lost attempt (%+v)", started, recording)
+	}
+	if calls := fake.Calls(cloudrecording.OpStart); calls != 2 {
+		t.Errorf("start calls = %d, want 2", calls)
+	}
+
+	// a start refused on its first attempt is not a lost response
+	if _, err := client.Start(ctx, acquired.ResourceID, cloudrecording.ModeMix, cloudrecording.StartRequest{Cname: "demo", UID: "42", ClientRequest: mixRequest()}); err == nil {
+		t.Error("second start with the same resource succeeded")
+	}
+
+	// the first stop goes through, so its retry finds nothing to stop
+	fake.LoseResponses(cloudrecording.OpStop, 1)
+	if _, err := client.Stop(ctx, acquired.ResourceID, started.SID, cloudrecording.ModeMix, cloudrecording.StopRequest{Cname: "demo", UID: "42"}); err != nil {
+		t.Fatal("stop:", err)
+	}
+	if recording, _ := fake.Recording(started.SID); recording.Status != cloudrecordingtest.StatusStopped {
+		t.Errorf("recording status = %d, want stopped", recording.Status)
+	}
+	if _, err := client.Stop(ctx, acquired.ResourceID, started.SID, cloudrecording.ModeMix, cloudrecording.StopRequest{Cname: "demo", UID: "42"}); !cloudrecording.NotFound(err) {
+		t.Errorf("stopping again: err = %v, want not found", err)
+	}
+}
+
+func TestIndividualMode(t *testing.T) {
+	client := newFake(t).Client()
+	ctx := context.Background()
+
+	rid, sid := start(t, client, cloudrecording.ModeIndividual, mixRequest())
+	_, err := client.Update(ctx, rid, sid, cloudrecording.ModeIndividual, cloudrecording.UpdateRequest{
+		Cname: "demo",
+		UID:   "42",
+		ClientRequest: cloudrecording.UpdateClientRequest{StreamSubscribe: &cloudrecording.StreamSubscribe{
+			AudioUidList: &cloudrecording.AudioUidList{SubscribeAudioUids: []string{"7"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal("update:", err)
+	}
+	if _, err := client.Stop(ctx, rid, sid, cloudrecording.ModeIndividual, cloudrecording.StopRequest{Cname: "demo", UID: "42"}); err != nil {
+		t.Fatal("stop:", err)
+	}
+	// the mode is part of the session's path
+	if _, err := client.Query(ctx, rid, sid, cloudrecording.ModeMix); !cloudrecording.NotFound(err) {
+		t.Errorf("query in another mode: err = %v, want not found", err)
+	}
+}
+
+func TestClientTimeoutsAndLogger(t *testing.T) {
+	paths := make(chan string, 10)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case paths <- r.URL.Path:
+		default:
+		}
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	var logged bytes.Buffer
+	client := cloudrecording.NewClient("test-app", "customer", "secret")
+	client.BaseURL = slow.URL + "/"
+	client.Logger = log.New(&logged, "", 0)
+	client.Retry = cloudrecording.RetryPolicy{MaxAttempts: 5, InitialBackoffMs: 1, MaxBackoffMs: 1}
+	client.Timeouts = map[string]time.Duration{cloudrecording.OpQuery: 50 * time.Millisecond}
+
+	// the timeout bounds the call, retries included
+	begin := time.Now()
+	_, err := client.Query(context.Background(), "rid", "sid", cloudrecording.ModeMix)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline exceeded", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 150*time.Millisecond {
+		t.Errorf("query took %s with a 50ms timeout", elapsed)
+	}
+	if got, want := <-paths, "/v1/apps/test-app/cloud_recording/resourceid/rid/sid/sid/mode/mix/query"; got != want {
+		t.Errorf("path = %s, want %s", got, want)
+	}
+	if !strings.Contains(logged.String(), "cloudrecording: GET query: attempt 1:") {
+		t.Errorf("log = %q, want the failed attempt", logged.String())
+	}
+}
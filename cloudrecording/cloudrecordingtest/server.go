@@ -0,0 +1,456 @@
+// Package cloudrecordingtest provides an in-process fake of the Agora Cloud
+// Recording REST API for tests.
+package cloudrecordingtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// Query status codes the fake moves recordings through
+const (
+	StatusRecording = 5
+	StatusStopped   = 7
+)
+
+// Error codes returned by the fake, as Agora returns them
+const (
+	codeInvalidParameter = 2
+	codeAlreadyRecording = 53
+	codeNotFound         = 404
+)
+
+// Recording is a recording started on the fake server
+type Recording struct {
+	ResourceID string
+	SID        string
+	Cname      string
+	UID        string
+	Mode       string
+	Status     int
+	Onhold     bool
+	StartedAt  time.Time
+
+	Start     cloudrecording.StartRequest
+	Updates   []cloudrecording.UpdateRequest
+	Layouts   []cloudrecording.UpdateLayoutRequest
+	StoppedBy cloudrecording.StopRequest
+
+	stopped bool
+}
+
+// Files returns the files the fake reports for the recording: the mix
+// playlist in mix mode, a single MP4 in web mode
+func (r Recording) Files() cloudrecording.FileList {
+	if r.Mode == cloudrecording.ModeWeb {
+		return cloudrecording.FileList{{Filename: r.SID + "_" + r.Cname + "_0.mp4", Isplayable: true, Slicestarttime: r.StartedAt.UnixNano() / int64(time.Millisecond)}}
+	}
+	return cloudrecording.FileList{{Filename: r.SID + "_" + r.Cname + ".m3u8", Tracktype: "audio_and_video", UID: "0", Mixedalluser: true, Isplayable: true, Slicestarttime: r.StartedAt.UnixNano() / int64(time.Millisecond)}}
+}
+
+type resource struct {
+	cname      string
+	uid        string
+	acquiredAt time.Time
+	used       bool
+}
+
+// Server is a fake cloud recording API for one Agora project. Requests must
+// carry the customer credentials as basic auth.
+type Server struct {
+	*httptest.Server
+
+	AppID               string
+	CustomerID          string
+	CustomerCertificate string
+	// ResourceTTL is how long an acquired resource can start a recording
+	ResourceTTL time.Duration
+
+	mu         sync.Mutex
+	resources  map[string]*resource
+	recordings map[string]*Recording
+	faults     map[string][]cloudrecording.Error
+	lost       map[string]int
+	calls      map[string]int
+}
+
+// NewServer starts a fake server. Close it when done.
+func NewServer(appID string, customerID string, customerCertificate string) *Server {
+	s := &Server{
+		AppID:               appID,
+		CustomerID:          customerID,
+		CustomerCertificate: customerCertificate,
+		ResourceTTL:         5 * time.Minute,
+		resources:           map[string]*resource{},
+		recordings:          map[string]*Recording{},
+		faults:              map[string][]cloudrecording.Error{},
+		lost:                map[string]int{},
+		calls:               map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Client returns a cloud recording client pointed at the fake
+func (s *Server) Client() *cloudrecording.Client {
+	client := cloudrecording.NewClient(s.AppID, s.CustomerID, s.CustomerCertificate)
+	client.BaseURL = s.URL
+	client.HTTPClient = s.Server.Client()
+	client.Retry = cloudrecording.RetryPolicy{MaxAttempts: 3}
+	return client
+}
+
+// Fail makes the next times calls of op (cloudrecording.OpAcquire and so on)
+// fail with err instead of being handled
+func (s *Server) Fail(op string, err cloudrecording.Error, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < times; i++ {
+		s.faults[op] = append(s.faults[op], err)
+	}
+}
+
+// LoseResponses makes the next times calls of op be handled but answered
+// with a 504, as when a gateway times out after passing the request on
+func (s *Server) LoseResponses(op string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lost[op] += times
+}
+
+// Calls returns how many requests were made for op, failed ones included
+func (s *Server) Calls(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op]
+}
+
+// Recording returns a copy of the recording with the given SID
+func (s *Server) Recording(sid string) (Recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recording, ok := s.recordings[sid]
+	if !ok {
+		return Recording{}, false
+	}
+	return *recording, true
+}
+
+// Recordings returns copies of every recording, running or not
+func (s *Server) Recordings() []Recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var recordings []Recording
+	for _, recording := range s.recordings {
+		recordings = append(recordings, *recording)
+	}
+	return recordings
+}
+
+// End ends a recording on Agora's side, as when the bot times out on an
+// empty channel. Query keeps reporting the given status; every other call
+// fails as if the recording never existed.
+func (s *Server) End(sid string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if recording, ok := s.recordings[sid]; ok {
+		recording.Status = status
+	}
+}
+
+// ExpireResources makes every acquired resource too old to start a recording
+func (s *Server) ExpireResources() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, res := range s.resources {
+		res.acquiredAt = time.Time{}
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	prefix := "/v1/apps/" + s.AppID + "/cloud_recording/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Invalid appid"})
+		return
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok || user != s.CustomerID || password != s.CustomerCertificate {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Invalid authentication credentials"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	op := parts[len(parts)-1]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[op]++
+	if faults := s.faults[op]; len(faults) > 0 {
+		s.faults[op] = faults[1:]
+		if faults[0].RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(faults[0].RetryAfter/time.Second)))
+		}
+		writeError(w, faults[0].StatusCode, faults[0].Code, faults[0].Reason)
+		return
+	}
+	if s.lost[op] > 0 {
+		s.lost[op]--
+		client := w
+		w = httptest.NewRecorder()
+		defer writeJSON(client, http.StatusGatewayTimeout, map[string]string{"message": "upstream request timeout"})
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && op == cloudrecording.OpAcquire && r.Method == http.MethodPost:
+		s.acquire(w, body)
+	case len(parts) == 5 && parts[0] == "resourceid" && parts[2] == "mode" && op == cloudrecording.OpStart && r.Method == http.MethodPost:
+		s.start(w, parts[1], parts[3], body)
+	case len(parts) == 7 && parts[0] == "resourceid" && parts[2] == "sid" && parts[4] == "mode":
+		recording, ok := s.recordings[parts[3]]
+		if !ok || recording.ResourceID != parts[1] || recording.Mode != parts[5] {
+			writeError(w, http.StatusNotFound, codeNotFound, "failed to find worker")
+			return
+		}
+		switch {
+		case op == cloudrecording.OpQuery && r.Method == http.MethodGet:
+			s.query(w, recording)
+		case op == cloudrecording.OpUpdate && r.Method == http.MethodPost:
+			s.update(w, recording, body)
+		case op == cloudrecording.OpUpdateLayout && r.Method == http.MethodPost:
+			s.updateLayout(w, recording, body)
+		case op == cloudrecording.OpStop && r.Method == http.MethodPost:
+			s.stop(w, recording, body)
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "no Route matched with those values"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "no Route matched with those values"})
+	}
+}
+
+func (s *Server) acquire(w http.ResponseWriter, body []byte) {
+	var req cloudrecording.AcquireRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Cname == "" || req.UID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter")
+		return
+	}
+
+	rid := randomID()
+	s.resources[rid] = &resource{cname: req.Cname, uid: req.UID, acquiredAt: time.Now()}
+	writeJSON(w, http.StatusOK, cloudrecording.AcquireResponse{ResourceID: rid})
+}
+
+func (s *Server) start(w http.ResponseWriter, rid string, mode string, body []byte) {
+	var req cloudrecording.StartRequest
+	if err := json.Unmarshal(body, &req); err != nil || !cloudrecording.ValidMode(mode) {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter")
+		return
+	}
+
+	res, ok := s.resources[rid]
+	if !ok || time.Since(res.acquiredAt) > s.ResourceTTL {
+		writeError(w, http.StatusBadRequest, cloudrecording.CodeResourceExpired, "resource expired")
+		return
+	}
+	if res.cname != req.Cname || res.uid != req.UID {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "cname and uid must match acquire")
+		return
+	}
+	if res.used {
+		// the error names the recording the resource started
+		body := map[string]interface{}{"code": codeAlreadyRecording, "reason": "the recording is already running", "resourceId": rid}
+		for _, recording := range s.recordings {
+			if recording.ResourceID == rid {
+				body["sid"] = recording.SID
+			}
+		}
+		writeJSON(w, http.StatusBadRequest, body)
+		return
+	}
+	if mode == cloudrecording.ModeWeb && req.ClientRequest.ExtensionServiceConfig == nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "web mode requires extensionServiceConfig")
+		return
+	}
+	if mode != cloudrecording.ModeWeb && req.ClientRequest.RecordingConfig == nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "recordingConfig is required")
+		return
+	}
+
+	res.used = true
+	recording := &Recording{
+		ResourceID: rid,
+		SID:        randomID(),
+		Cname:      req.Cname,
+		UID:        req.UID,
+		Mode:       mode,
+		Status:     StatusRecording,
+		StartedAt:  time.Now(),
+		Start:      req,
+	}
+	s.recordings[recording.SID] = recording
+	writeJSON(w, http.StatusOK, cloudrecording.StartResponse{ResourceID: rid, SID: recording.SID})
+}
+
+// running answers for recordings that have already ended, failing the call
+// as if the recording never existed
+func (s *Server) running(w http.ResponseWriter, recording *Recording) bool {
+	if cloudrecording.Ended(recording.Status) {
+		writeError(w, http.StatusNotFound, codeNotFound, "failed to find worker")
+		return false
+	}
+	return true
+}
+
+func (s *Server) query(w http.ResponseWriter, recording *Recording) {
+	// Agora forgets recordings once they are stopped
+	if recording.stopped {
+		writeError(w, http.StatusNotFound, codeNotFound, "failed to find worker")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"resourceId": recording.ResourceID,
+		"sid":        recording.SID,
+	}
+	if recording.Mode == cloudrecording.ModeWeb {
+		resp["serverResponse"] = map[string]interface{}{
+			"status":                recording.Status,
+			"extensionServiceState": s.extensionState(recording),
+		}
+	} else {
+		resp["serverResponse"] = map[string]interface{}{
+			"status":         recording.Status,
+			"fileListMode":   "string",
+			"fileList":       recording.Files()[0].Filename,
+			"sliceStartTime": recording.StartedAt.UnixNano() / int64(time.Millisecond),
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) extensionState(recording *Recording) []map[string]interface{} {
+	state := "inProgress"
+	if cloudrecording.Ended(recording.Status) {
+		state = "exit"
+	}
+	return []map[string]interface{}{{
+		"serviceName": "web_recorder_service",
+		"payload": map[string]interface{}{
+			"fileList": recording.Files(),
+			"onhold":   recording.Onhold,
+			"state":    state,
+		},
+	}}
+}
+
+func (s *Server) update(w http.ResponseWriter, recording *Recording, body []byte) {
+	var req cloudrecording.UpdateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter")
+		return
+	}
+	if !s.running(w, recording) {
+		return
+	}
+
+	web := req.ClientRequest.WebRecordingConfig != nil || req.ClientRequest.RtmpPublishConfig != nil
+	if web != (recording.Mode == cloudrecording.ModeWeb) {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "update does not apply to "+recording.Mode+" mode")
+		return
+	}
+	if config := req.ClientRequest.WebRecordingConfig; config != nil {
+		recording.Onhold = config.Onhold
+	}
+
+	recording.Updates = append(recording.Updates, req)
+	writeJSON(w, http.StatusOK, cloudrecording.UpdateResponse{ResourceID: recording.ResourceID, SID: recording.SID})
+}
+
+func (s *Server) updateLayout(w http.ResponseWriter, recording *Recording, body []byte) {
+	var req cloudrecording.UpdateLayoutRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter")
+		return
+	}
+	if !s.running(w, recording) {
+		return
+	}
+	if recording.Mode != cloudrecording.ModeMix {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "updateLayout is only supported in mix mode")
+		return
+	}
+
+	recording.Layouts = append(recording.Layouts, req)
+	writeJSON(w, http.StatusOK, cloudrecording.UpdateResponse{ResourceID: recording.ResourceID, SID: recording.SID})
+}
+
+func (s *Server) stop(w http.ResponseWriter, recording *Recording, body []byte) {
+	var req cloudrecording.StopRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter")
+		return
+	}
+	if !s.running(w, recording) {
+		return
+	}
+
+	recording.Status = StatusStopped
+	recording.StoppedBy = req
+	recording.stopped = true
+
+	serverResponse := map[string]interface{}{
+		"uploadingStatus": cloudrecording.UploadUploaded,
+	}
+	if recording.Mode == cloudrecording.ModeWeb {
+		serverResponse["extensionServiceState"] = s.extensionState(recording)
+	} else {
+		serverResponse["fileListMode"] = "json"
+		serverResponse["fileList"] = recording.Files()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"resourceId":     recording.ResourceID,
+		"sid":            recording.SID,
+		"serverResponse": serverResponse,
+	})
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, reason string) {
+	writeJSON(w, status, map[string]interface{}{"code": code, "reason": reason})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
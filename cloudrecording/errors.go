@@ -0,0 +1,89 @@
+package cloudrecording
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Agora error codes that are worth retrying or need a new resource
+const (
+	// CodeNetworkJitter asks the caller to retry the request
+	CodeNetworkJitter = 65
+	// CodeAlreadyRunning is returned when a resource ID already started a
+	// recording
+	CodeAlreadyRunning = 53
+	// CodeResourceExpired is returned when a resource ID is no longer valid
+	CodeResourceExpired = 433
+)
+
+// Error is a non-success response from the cloud recording REST API
+type Error struct {
+	StatusCode int    `json:"status_code"`
+	Code       int    `json:"code"`
+	Reason     string `json:"reason"`
+	// ResourceID and SID are set when the response names a recording
+	ResourceID string `json:"resourceId,omitempty"`
+	SID        string `json:"sid,omitempty"`
+	// RetryAfter is the wait asked for by a Retry-After header
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("agora: http %d, code %d: %s", e.StatusCode, e.Code, e.Reason)
+}
+
+// Retryable reports whether err is a transient failure: a network timeout
+// or temporary network error, a 408, 429 or 5xx response, or Agora's network
+// jitter code
+func Retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == CodeNetworkJitter ||
+			apiErr.StatusCode == http.StatusRequestTimeout ||
+			apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && (netErr.Timeout() || netErr.Temporary())
+}
+
+// retryAfter returns the wait the server asked for before retrying err
+func retryAfter(err error) time.Duration {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as a date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// ResourceExpired reports whether err means the resource ID must be
+// acquired again
+func ResourceExpired(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == CodeResourceExpired
+}
+
+// NotFound reports whether Agora no longer knows the recording
+func NotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
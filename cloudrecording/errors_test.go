@@ -0,0 +1,52 @@
+package cloudrecording
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{&Error{StatusCode: http.StatusTooManyRequests}, true},
+		{&Error{StatusCode: http.StatusBadRequest, Code: CodeNetworkJitter}, true},
+		{&Error{StatusCode: http.StatusBadRequest, Code: CodeAlreadyRunning}, false},
+		{fmt.Errorf("start: %w", &Error{StatusCode: http.StatusBadGateway}), true},
+		{&url.Error{Op: "Post", URL: "https://api.agora.io", Err: context.DeadlineExceeded}, true},
+		{&url.Error{Op: "Post", URL: "https://api.agora.io", Err: errors.New("stopped after 10 redirects")}, false},
+		{context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"Sat, 01 May 2021 10:00:30 GMT", 30 * time.Second},
+		{"Sat, 01 May 2021 09:00:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package cloudrecording
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures retries of Agora calls. Backoff doubles from
+// InitialBackoffMs up to MaxBackoffMs, with full jitter.
+type RetryPolicy struct {
+	MaxAttempts      int `mapstructure:"max_attempts" json:"max_attempts"`
+	InitialBackoffMs int `mapstructure:"initial_backoff_ms" json:"initial_backoff_ms"`
+	MaxBackoffMs     int `mapstructure:"max_backoff_ms" json:"max_backoff_ms"`
+}
+
+// DefaultRetryPolicy is the policy of NewClient
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      3,
+	InitialBackoffMs: 200,
+	MaxBackoffMs:     5000,
+}
+
+// backoff returns the delay before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	max := time.Duration(p.InitialBackoffMs) * time.Millisecond
+	for i := 1; i < retry && max < time.Duration(p.MaxBackoffMs)*time.Millisecond; i++ {
+		max *= 2
+	}
+	if ceiling := time.Duration(p.MaxBackoffMs) * time.Millisecond; max > ceiling {
+		max = ceiling
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// withRetry runs fn until it succeeds, fails with a permanent error, the
+// policy runs out of attempts or ctx is done. A Retry-After longer than the
+// backoff is waited out instead.
+func withRetry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	attempts := policy.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil || !Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt < attempts {
+			delay := policy.backoff(attempt)
+			if after := retryAfter(err); after > delay {
+				delay = after
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package cloudrecording
+
+import "strconv"
+
+// RecordingStates names the numeric status codes returned by query
+var RecordingStates = map[int]string{
+	0:  "not_started",
+	1:  "initialized",
+	2:  "recorder_starting",
+	3:  "recorder_ready",
+	4:  "recorder_recording",
+	5:  "recording",
+	6:  "stopping",
+	7:  "stopped",
+	8:  "exiting",
+	20: "abnormal_exit",
+}
+
+// RecordingState returns the name of a query status code
+func RecordingState(status int) string {
+	if state, ok := RecordingStates[status]; ok {
+		return state
+	}
+	return "unknown_" + strconv.Itoa(status)
+}
+
+// Ended reports whether a query status code means the recording is over
+func Ended(status int) bool {
+	return status == 7 || status == 8 || status == 20
+}
+
+// ExtensionServiceState is the state of a web mode extension service such
+// as web_recorder_service or rtmp_publish_service
+type ExtensionServiceState struct {
+	ServiceName string `json:"serviceName"`
+	Payload     struct {
+		FileList FileList `json:"fileList,omitempty"`
+		// Onhold is set while a web recording is paused
+		Onhold  bool   `json:"onhold"`
+		State   string `json:"state"`
+		Outputs []struct {
+			RtmpURL string `json:"rtmpUrl"`
+			Status  string `json:"status"`
+		} `json:"outputs,omitempty"`
+	} `json:"payload"`
+}
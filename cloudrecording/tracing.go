@@ -0,0 +1,31 @@
+package cloudrecording
+
+import "go.opentelemetry.io/otel/attribute"
+
+// tracerName names the tracer of the spans of this package
+const tracerName = "github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+
+// Span attributes identifying a recording
+const (
+	AttrChannel = attribute.Key("recording.channel")
+	AttrMode    = attribute.Key("recording.mode")
+	AttrRID     = attribute.Key("recording.rid")
+	AttrSID     = attribute.Key("recording.sid")
+)
+
+// SpanAttributes returns the attributes of a recording, leaving out those
+// that are not known yet
+func SpanAttributes(channel string, mode string, rid string, sid string) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, attr := range []attribute.KeyValue{
+		AttrChannel.String(channel),
+		AttrMode.String(mode),
+		AttrRID.String(rid),
+		AttrSID.String(sid),
+	} {
+		if attr.Value.AsString() != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
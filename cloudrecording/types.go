@@ -0,0 +1,337 @@
+package cloudrecording
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Recording modes
+const (
+	ModeMix        = "mix"
+	ModeIndividual = "individual"
+	ModeWeb        = "web"
+)
+
+// ValidMode reports whether mode is a cloud recording mode
+func ValidMode(mode string) bool {
+	return mode == ModeMix || mode == ModeIndividual || mode == ModeWeb
+}
+
+// AcquireRequest is the body of the acquire endpoint. UID is the recording
+// bot's user ID as a string, as Agora expects it.
+type AcquireRequest struct {
+	Cname         string               `json:"cname"`
+	UID           string               `json:"uid"`
+	ClientRequest AcquireClientRequest `json:"clientRequest"`
+}
+
+// AcquireClientRequest holds the options of acquire
+type AcquireClientRequest struct {
+	ResourceExpiredHour int `json:"resourceExpiredHour,omitempty"`
+	// Scene is 0 for real-time audio and video, 1 for web recording and 2
+	// for delayed transcoding in individual mode
+	Scene int `json:"scene,omitempty"`
+}
+
+// AcquireResponse is the response of acquire
+type AcquireResponse struct {
+	ResourceID string `json:"resourceId"`
+}
+
+// StartRequest is the body of the start endpoint for all modes
+type StartRequest struct {
+	Cname         string             `json:"cname"`
+	UID           string             `json:"uid"`
+	ClientRequest StartClientRequest `json:"clientRequest"`
+}
+
+// StartClientRequest configures a recording. Mix and individual mode use
+// RecordingConfig; web mode uses ExtensionServiceConfig.
+type StartClientRequest struct {
+	Token                  string                  `json:"token,omitempty"`
+	RecordingConfig        *RecordingConfig        `json:"recordingConfig,omitempty"`
+	RecordingFileConfig    *RecordingFileConfig    `json:"recordingFileConfig,omitempty"`
+	SnapshotConfig         *SnapshotConfig         `json:"snapshotConfig,omitempty"`
+	StorageConfig          StorageConfig           `json:"storageConfig"`
+	ExtensionServiceConfig *ExtensionServiceConfig `json:"extensionServiceConfig,omitempty"`
+}
+
+// RecordingConfig selects the streams of a mix or individual recording
+type RecordingConfig struct {
+	ChannelType          int                `json:"channelType"`
+	StreamTypes          int                `json:"streamTypes"`
+	StreamMode           string             `json:"streamMode,omitempty"`
+	DecryptionMode       int                `json:"decryptionMode,omitempty"`
+	Secret               string             `json:"secret,omitempty"`
+	AudioProfile         int                `json:"audioProfile,omitempty"`
+	VideoStreamType      int                `json:"videoStreamType,omitempty"`
+	MaxIdleTime          int                `json:"maxIdleTime,omitempty"`
+	TranscodingConfig    *TranscodingConfig `json:"transcodingConfig,omitempty"`
+	SubscribeAudioUids   []string           `json:"subscribeAudioUids,omitempty"`
+	UnSubscribeAudioUids []string           `json:"unSubscribeAudioUids,omitempty"`
+	SubscribeVideoUids   []string           `json:"subscribeVideoUids,omitempty"`
+	UnSubscribeVideoUids []string           `json:"unSubscribeVideoUids,omitempty"`
+	SubscribeUidGroup    int                `json:"subscribeUidGroup,omitempty"`
+}
+
+// TranscodingConfig is the layout and encoding of a mix mode recording
+type TranscodingConfig struct {
+	Height           int            `json:"height"`
+	Width            int            `json:"width"`
+	Bitrate          int            `json:"bitrate"`
+	FPS              int            `json:"fps"`
+	MixedVideoLayout int            `json:"mixedVideoLayout"`
+	BackgroundColor  string         `json:"backgroundColor"`
+	MaxResolutionUid string         `json:"maxResolutionUid,omitempty"`
+	LayoutConfig     []LayoutConfig `json:"layoutConfig,omitempty"`
+}
+
+// LayoutConfig places one user in a custom mix layout. Coordinates and
+// sizes are fractions of the canvas.
+type LayoutConfig struct {
+	UID        string  `json:"uid,omitempty"`
+	XAxis      float64 `json:"x_axis"`
+	YAxis      float64 `json:"y_axis"`
+	Width      float64 `json:"width"`
+	Height     float64 `json:"height"`
+	Alpha      float64 `json:"alpha,omitempty"`
+	RenderMode int     `json:"render_mode,omitempty"`
+}
+
+// RecordingFileConfig selects the file types of a recording
+type RecordingFileConfig struct {
+	AvFileType []string `json:"avFileType"`
+}
+
+// SnapshotConfig enables screenshots in individual mode
+type SnapshotConfig struct {
+	CaptureInterval int      `json:"captureInterval,omitempty"`
+	FileType        []string `json:"fileType"`
+}
+
+// StorageConfig is the third-party storage recordings are uploaded to
+type StorageConfig struct {
+	Vendor         int      `json:"vendor"`
+	Region         int      `json:"region"`
+	Bucket         string   `json:"bucket"`
+	AccessKey      string   `json:"accessKey"`
+	SecretKey      string   `json:"secretKey"`
+	FileNamePrefix []string `json:"fileNamePrefix,omitempty"`
+}
+
+// ExtensionServiceConfig configures web recording and RTMP publishing
+type ExtensionServiceConfig struct {
+	ErrorHandlePolicy string             `json:"errorHandlePolicy,omitempty"`
+	ExtensionServices []ExtensionService `json:"extensionServices"`
+}
+
+// ExtensionService is one extension such as web_recorder_service or
+// rtmp_publish_service with its service-specific parameters
+type ExtensionService struct {
+	ServiceName       string                 `json:"serviceName"`
+	ErrorHandlePolicy string                 `json:"errorHandlePolicy,omitempty"`
+	ServiceParam      map[string]interface{} `json:"serviceParam"`
+}
+
+// StartResponse is the response of start
+type StartResponse struct {
+	ResourceID string `json:"resourceId"`
+	SID        string `json:"sid"`
+}
+
+// UpdateRequest is the body of the update endpoint
+type UpdateRequest struct {
+	Cname         string              `json:"cname"`
+	UID           string              `json:"uid"`
+	ClientRequest UpdateClientRequest `json:"clientRequest"`
+}
+
+// UpdateClientRequest holds the settings to change; nil ones are kept
+type UpdateClientRequest struct {
+	StreamSubscribe    *StreamSubscribe    `json:"streamSubscribe,omitempty"`
+	WebRecordingConfig *WebRecordingUpdate `json:"webRecordingConfig,omitempty"`
+	RtmpPublishConfig  *RtmpPublishConfig  `json:"rtmpPublishConfig,omitempty"`
+}
+
+// StreamSubscribe changes the users a mix or individual recording subscribes to
+type StreamSubscribe struct {
+	AudioUidList *AudioUidList `json:"audioUidList,omitempty"`
+	VideoUidList *VideoUidList `json:"videoUidList,omitempty"`
+}
+
+// AudioUidList lists the audio streams to subscribe to or leave out
+type AudioUidList struct {
+	SubscribeAudioUids   []string `json:"subscribeAudioUids,omitempty"`
+	UnSubscribeAudioUids []string `json:"unSubscribeAudioUids,omitempty"`
+}
+
+// VideoUidList lists the video streams to subscribe to or leave out
+type VideoUidList struct {
+	SubscribeVideoUids   []string `json:"subscribeVideoUids,omitempty"`
+	UnSubscribeVideoUids []string `json:"unSubscribeVideoUids,omitempty"`
+}
+
+// WebRecordingUpdate pauses or resumes a web recording
+type WebRecordingUpdate struct {
+	Onhold bool `json:"onhold"`
+}
+
+// RtmpPublishConfig replaces the RTMP outputs of a web recording
+type RtmpPublishConfig struct {
+	Outputs []RtmpOutput `json:"outputs"`
+}
+
+// RtmpOutput is an RTMP address a web recording is pushed to
+type RtmpOutput struct {
+	RtmpURL string `json:"rtmpUrl"`
+}
+
+// UpdateLayoutRequest is the body of the updateLayout endpoint
+type UpdateLayoutRequest struct {
+	Cname         string                    `json:"cname"`
+	UID           string                    `json:"uid"`
+	ClientRequest UpdateLayoutClientRequest `json:"clientRequest"`
+}
+
+// UpdateLayoutClientRequest is the new layout of a mix mode recording
+type UpdateLayoutClientRequest struct {
+	MaxResolutionUid           string         `json:"maxResolutionUid,omitempty"`
+	MixedVideoLayout           int            `json:"mixedVideoLayout"`
+	BackgroundColor            string         `json:"backgroundColor,omitempty"`
+	BackgroundImage            string         `json:"backgroundImage,omitempty"`
+	DefaultUserBackgroundImage string         `json:"defaultUserBackgroundImage,omitempty"`
+	LayoutConfig               []LayoutConfig `json:"layoutConfig,omitempty"`
+}
+
+// UpdateResponse is the response of update and updateLayout
+type UpdateResponse struct {
+	ResourceID string `json:"resourceId"`
+	SID        string `json:"sid"`
+}
+
+// StopRequest is the body of the stop endpoint
+type StopRequest struct {
+	Cname         string            `json:"cname"`
+	UID           string            `json:"uid"`
+	ClientRequest StopClientRequest `json:"clientRequest"`
+}
+
+// StopClientRequest holds the options of stop
+type StopClientRequest struct {
+	// AsyncStop returns without waiting for the upload state
+	AsyncStop bool `json:"async_stop,omitempty"`
+}
+
+// RecordingFile is an uploaded file reported by Agora
+type RecordingFile struct {
+	Filename       string `json:"filename"`
+	Tracktype      string `json:"trackType"`
+	UID            string `json:"uid"`
+	Mixedalluser   bool   `json:"mixedAllUser"`
+	Isplayable     bool   `json:"isPlayable"`
+	Slicestarttime int64  `json:"sliceStartTime"`
+}
+
+// FileList is Agora's fileList field. In "string" mode Agora sends the
+// playlist name only, which is decoded as a single file. null and "", sent
+// before any file is uploaded, decode as an empty list.
+type FileList []RecordingFile
+
+// UnmarshalJSON accepts both the string and the array form
+func (f *FileList) UnmarshalJSON(b []byte) error {
+	if string(bytes.TrimSpace(b)) == "null" {
+		*f = FileList{}
+		return nil
+	}
+
+	var filename string
+	if err := json.Unmarshal(b, &filename); err == nil {
+		*f = FileList{}
+		if filename != "" {
+			*f = FileList{{Filename: filename}}
+		}
+		return nil
+	}
+
+	var files []RecordingFile
+	if err := json.Unmarshal(b, &files); err != nil {
+		return err
+	}
+	*f = files
+	return nil
+}
+
+// Agora uploadingStatus values returned by stop
+const (
+	// UploadUploaded means every file is in the configured storage
+	UploadUploaded = "uploaded"
+	// UploadBackuped means some files went to Agora's backup cloud and will
+	// be moved to the configured storage later
+	UploadBackuped = "backuped"
+	// UploadUnknown means the upload state could not be determined
+	UploadUnknown = "unknown"
+)
+
+// StopResponse is the response of stop for all modes
+type StopResponse struct {
+	ResourceID     string `json:"resourceId"`
+	SID            string `json:"sid"`
+	ServerResponse struct {
+		FileListMode    string   `json:"fileListMode,omitempty"`
+		FileList        FileList `json:"fileList,omitempty"`
+		UploadingStatus string   `json:"uploadingStatus,omitempty"`
+
+		// web mode
+		ExtensionServiceState []ExtensionServiceState `json:"extensionServiceState,omitempty"`
+	} `json:"serverResponse"`
+}
+
+// Files returns the uploaded files of every mode
+func (r StopResponse) Files() []RecordingFile {
+	files := []RecordingFile(r.ServerResponse.FileList)
+	for _, extension := range r.ServerResponse.ExtensionServiceState {
+		files = append(files, extension.Payload.FileList...)
+	}
+	return files
+}
+
+// Uploaded reports whether every file reached the configured storage
+func (r StopResponse) Uploaded() bool {
+	return r.ServerResponse.UploadingStatus == UploadUploaded
+}
+
+// BackedUp reports whether files are held in Agora's backup cloud
+func (r StopResponse) BackedUp() bool {
+	return r.ServerResponse.UploadingStatus == UploadBackuped
+}
+
+// QueryResponse is the response of query for all modes
+type QueryResponse struct {
+	ResourceID     string `json:"resourceId"`
+	SID            string `json:"sid"`
+	ServerResponse struct {
+		FileListMode   string   `json:"fileListMode,omitempty"`
+		FileList       FileList `json:"fileList,omitempty"`
+		Status         int      `json:"status"`
+		SliceStartTime int64    `json:"sliceStartTime"`
+
+		// individual mode with snapshots or extensions
+		SubServiceStatus map[string]string `json:"subServiceStatus,omitempty"`
+		// web mode
+		ExtensionServiceState []ExtensionServiceState `json:"extensionServiceState,omitempty"`
+
+		// filled in by Query from Status and ExtensionServiceState
+		State  string `json:"state"`
+		Paused bool   `json:"paused"`
+	} `json:"serverResponse"`
+}
+
+// Files returns the uploaded files of every mode, including the files of
+// the web recording extension
+func (r QueryResponse) Files() []RecordingFile {
+	files := []RecordingFile(r.ServerResponse.FileList)
+	for _, extension := range r.ServerResponse.ExtensionServiceState {
+		files = append(files, extension.Payload.FileList...)
+	}
+	return files
+}
@@ -0,0 +1,84 @@
+package cloudrecording
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFileListUnmarshal(t *testing.T) {
+	for input, want := range map[string][]string{
+		`{"fileList": null}`:          {},
+		`{"fileList": ""}`:            {},
+		`{"fileList": []}`:            {},
+		`{"fileList": "sid_ch.m3u8"}`: {"sid_ch.m3u8"},
+		`{"fileList": [{"filename": "a.m3u8"}, {"filename": "b.m3u8"}]}`: {"a.m3u8", "b.m3u8"},
+	} {
+		var response struct {
+			FileList FileList `json:"fileList"`
+		}
+		if err := json.Unmarshal([]byte(input), &response); err != nil {
+			t.Fatalf("%s: %s", input, err)
+		}
+		if len(response.FileList) != len(want) {
+			t.Errorf("%s: files = %+v", input, response.FileList)
+			continue
+		}
+		for i, file := range response.FileList {
+			if file.Filename != want[i] {
+				t.Errorf("%s: file %d = %s", input, i, file.Filename)
+			}
+		}
+	}
+
+	var files FileList
+	if err := json.Unmarshal([]byte(`{"filename": 1}`), &files); err == nil {
+		t.Error("object accepted as file list")
+	}
+}
+
+func TestQueryResponses(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		state  string
+		paused bool
+		files  int
+	}{
+		{"mix string", `{"fileListMode": "string", "fileList": "sid_demo.m3u8", "status": 5, "sliceStartTime": 1620000000000}`, "recording", false, 1},
+		{"mix json", `{"fileListMode": "json", "fileList": [{"filename": "a.m3u8", "trackType": "audio_and_video", "isPlayable": true}, {"filename": "b.m3u8"}], "status": 5}`, "recording", false, 2},
+		{"individual", `{"fileListMode": "string", "fileList": "", "status": 4, "subServiceStatus": {"recordingService": "serviceReady"}}`, "recorder_recording", false, 0},
+		{"web paused", `{"status": 5, "extensionServiceState": [{"serviceName": "web_recorder_service", "payload": {"fileList": [{"filename": "a.mp4"}], "onhold": true, "state": "inProgress"}}]}`, "recording", true, 1},
+		{"abnormal exit", `{"status": 20}`, "abnormal_exit", false, 0},
+		{"new status", `{"status": 99}`, "unknown_99", false, 0},
+	}
+
+	for _, tc := range cases {
+		body := `{"resourceId": "rid", "sid": "sid", "serverResponse": ` + tc.body + `}`
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+
+		client := NewClient("app", "customer", "secret")
+		client.BaseURL = srv.URL
+		status, err := client.Query(context.Background(), "rid", "sid", ModeMix)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		response := status.ServerResponse
+		if response.State != tc.state || response.Paused != tc.paused || len(status.Files()) != tc.files {
+			t.Errorf("%s: state %s, paused %v, %d files", tc.name, response.State, response.Paused, len(status.Files()))
+		}
+		if tc.name == "individual" && response.SubServiceStatus["recordingService"] != "serviceReady" {
+			t.Errorf("subServiceStatus = %v", response.SubServiceStatus)
+		}
+		if Ended(response.Status) != (tc.state == "abnormal_exit") {
+			t.Errorf("%s: ended = %v", tc.name, Ended(response.Status))
+		}
+	}
+}
@@ -9,11 +9,17 @@ require (
 	github.com/aws/aws-sdk-go-v2 v1.5.0
 	github.com/aws/aws-sdk-go-v2/config v1.2.0
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.7.0
+	github.com/aws/smithy-go v1.4.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gofiber/fiber/v2 v2.9.0
 	github.com/klauspost/compress v1.12.2 // indirect
+	github.com/prometheus/client_golang v1.11.0
 	github.com/spf13/viper v1.7.1
-	github.com/valyala/fasthttp v1.24.0 // indirect
+	github.com/valyala/fasthttp v1.24.0
 	github.com/valyala/tcplisten v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20210511113859-b0526f3d8744 // indirect
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	golang.org/x/text v0.3.6 // indirect
 )
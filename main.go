@@ -1,14 +1,18 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/AgoraIO-Community/Cloud-Recording-Golang/api"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/utils"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/spf13/viper"
 )
 
 func healthCheck(c *fiber.Ctx) error {
@@ -16,21 +20,73 @@ func healthCheck(c *fiber.Ctx) error {
 }
 
 func main() {
-	// Set global configuration
-	viper.SetConfigName("config.json")
-	viper.SetConfigType("json")
-	viper.AddConfigPath(".")
-
-	if err := viper.ReadInConfig(); err != nil {
-		log.Panicln(fmt.Errorf("fatal error config file: %s", err))
+	utils.SetupLogging()
+	cfg, err := utils.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	utils.SetConfig(cfg)
+	stopTracing, err := utils.StartTracing()
+	if err != nil {
+		log.Fatalln("tracing:", err)
 	}
-	viper.AutomaticEnv()
 
-	app := fiber.New()
+	// the banner would break the JSON log
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
 	app.Use(cors.New())
 	app.Get("/", healthCheck)
 	api.MountRoutes(app)
+	utils.StartRetentionJob()
+	utils.StartReconciler()
+	if err := utils.ResumeAutoStops(); err != nil {
+		log.Println("auto-stop:", err)
+	}
+	if err := utils.ResumeConsolidations(); err != nil {
+		log.Println("consolidate:", err)
+	}
+	if err := utils.Schedules.Resume(); err != nil {
+		log.Println("schedule:", err)
+	}
+	if err := utils.WatchConfig(utils.ServerContext()); err != nil {
+		log.Println("config: not watching for changes:", err)
+	}
+
+	// on shutdown stop accepting requests, let those in flight and the
+	// background jobs finish, then cancel whatever is left
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan struct{})
+	go func() {
+		<-signals
+		log.Println("shutdown: draining")
+		ctx, cancel := context.WithTimeout(context.Background(), utils.ShutdownTimeout())
+		defer cancel()
+
+		utils.StartDraining()
+		stopped := make(chan error, 1)
+		go func() { stopped <- app.Shutdown() }()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				log.Println("shutdown:", err)
+			}
+		case <-ctx.Done():
+			log.Println("shutdown: abandoning requests in flight")
+		}
 
-	app.Listen(":" + viper.GetString("PORT"))
+		utils.Drain(ctx)
+		if err := stopTracing(ctx); err != nil {
+			log.Println("tracing:", err)
+		}
+		close(drained)
+	}()
+
+	log.Printf("server: listening on :%d", cfg.Port)
+	if err := app.Listen(":" + strconv.Itoa(cfg.Port)); err != nil {
+		log.Println(err)
+		return
+	}
+	<-drained
+	log.Println("shutdown: done")
 
 }
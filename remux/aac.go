@@ -0,0 +1,93 @@
+package remux
+
+import "errors"
+
+// samplesPerFrame is the number of PCM samples in one AAC frame
+const samplesPerFrame = 1024
+
+var sampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// AudioEntry is the decoder configuration of a run of AAC frames
+type AudioEntry struct {
+	// ObjectType is the MPEG-4 audio object type, e.g. 2 for AAC LC
+	ObjectType int
+	SampleRate int
+	Channels   int
+
+	freqIndex int
+}
+
+// frameDuration returns how long one frame plays on the 90kHz clock
+func (e AudioEntry) frameDuration() int64 {
+	return samplesPerFrame * 90000 / int64(e.SampleRate)
+}
+
+// AudioSample is one raw AAC frame stored at Offset in the media data
+type AudioSample struct {
+	Offset int64
+	Size   uint32
+	PTS    int64
+	// Entry indexes the configuration in AudioTrack.Entries
+	Entry int
+}
+
+// AudioTrack holds the AAC stream of a recording. Timestamps use the 90kHz
+// TS clock. A new entry starts whenever the ADTS headers change the
+// configuration.
+type AudioTrack struct {
+	Entries []AudioEntry
+	Samples []AudioSample
+}
+
+// addADTS splits a PES payload into ADTS frames. Only the first frame
+// carries the PES timestamp; the rest follow at 1024 samples per frame.
+func (d *Demuxer) addADTS(payload []byte, pts int64) error {
+	t := &d.Audio
+	for frame := 0; len(payload) > 0; frame++ {
+		if len(payload) < 7 || payload[0] != 0xff || payload[1]&0xf0 != 0xf0 {
+			return errors.New("remux: invalid ADTS header")
+		}
+
+		protectionAbsent := payload[1] & 0x01
+		objectType := int(payload[2]>>6) + 1
+		freqIndex := int(payload[2] >> 2 & 0x0f)
+		channels := int(payload[2]&0x01)<<2 | int(payload[3]>>6)
+		length := int(payload[3]&0x03)<<11 | int(payload[4])<<3 | int(payload[5]>>5)
+
+		header := 7
+		if protectionAbsent == 0 {
+			header = 9
+		}
+		if freqIndex >= len(sampleRates) || length < header || length > len(payload) {
+			return errors.New("remux: invalid ADTS frame")
+		}
+
+		entry := AudioEntry{ObjectType: objectType, SampleRate: sampleRates[freqIndex], Channels: channels, freqIndex: freqIndex}
+		if n := len(t.Entries); n == 0 || t.Entries[n-1] != entry {
+			t.Entries = append(t.Entries, entry)
+		}
+
+		offset, err := d.writeSample(payload[header:length])
+		if err != nil {
+			return err
+		}
+		t.Samples = append(t.Samples, AudioSample{
+			Offset: offset,
+			Size:   uint32(length - header),
+			PTS:    pts + int64(frame)*samplesPerFrame*90000/int64(entry.SampleRate),
+			Entry:  len(t.Entries) - 1,
+		})
+		payload = payload[length:]
+	}
+	return nil
+}
+
+// audioSpecificConfig returns the decoder configuration for the esds box
+func (e AudioEntry) audioSpecificConfig() []byte {
+	return []byte{
+		byte(e.ObjectType<<3 | e.freqIndex>>1),
+		byte(e.freqIndex&0x01<<7 | e.Channels<<3),
+	}
+}
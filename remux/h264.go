@@ -0,0 +1,337 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	nalIDR = 5
+	nalSPS = 7
+	nalPPS = 8
+	nalAUD = 9
+
+	// assumed for a lone frame, 30 fps on the 90kHz clock
+	defaultFrameDuration = 3000
+)
+
+// VideoEntry holds the parameter sets a run of samples is coded with. A new
+// entry starts whenever the stream changes them, e.g. on a resolution
+// change.
+type VideoEntry struct {
+	SPS    []byte
+	PPS    []byte
+	Width  int
+	Height int
+}
+
+// VideoSample is one H.264 access unit with length prefixed NAL units,
+// stored at Offset in the media data
+type VideoSample struct {
+	Offset int64
+	Size   uint32
+	PTS    int64
+	DTS    int64
+	Key    bool
+	// Entry indexes the parameter sets in VideoTrack.Entries
+	Entry int
+}
+
+// VideoTrack holds the H.264 stream of a recording. Timestamps use the
+// 90kHz TS clock.
+type VideoTrack struct {
+	Entries []VideoEntry
+	Samples []VideoSample
+
+	// the latest parameter sets in the stream
+	sps []byte
+	pps []byte
+}
+
+// addAccessUnit converts an Annex B access unit into an MP4 sample.
+// Parameter sets stay in the sample as well, so decoders that ignore a
+// change of sample entry still follow the stream.
+func (d *Demuxer) addAccessUnit(payload []byte, pts int64, dts int64) error {
+	t := &d.Video
+	var data []byte
+	key := false
+
+	for _, nal := range splitAnnexB(payload) {
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			t.sps = append([]byte(nil), nal...)
+		case nalPPS:
+			t.pps = append([]byte(nil), nal...)
+		case nalAUD:
+			continue
+		case nalIDR:
+			key = true
+		}
+
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(nal)))
+		data = append(data, length...)
+		data = append(data, nal...)
+	}
+
+	// samples before the first keyframe cannot be decoded
+	if len(data) == 0 || (len(t.Samples) == 0 && !key) {
+		return nil
+	}
+
+	entry := len(t.Entries) - 1
+	if t.sps != nil && t.pps != nil && (entry < 0 || !bytes.Equal(t.sps, t.Entries[entry].SPS) || !bytes.Equal(t.pps, t.Entries[entry].PPS)) {
+		width, height, err := parseSPS(t.sps)
+		if err != nil {
+			return err
+		}
+		t.Entries = append(t.Entries, VideoEntry{SPS: t.sps, PPS: t.pps, Width: width, Height: height})
+		entry++
+	}
+	// nor can samples before the parameter sets
+	if entry < 0 {
+		return nil
+	}
+
+	offset, err := d.writeSample(data)
+	if err != nil {
+		return err
+	}
+	t.Samples = append(t.Samples, VideoSample{
+		Offset: offset,
+		Size:   uint32(len(data)),
+		PTS:    pts,
+		DTS:    dts,
+		Key:    key,
+		Entry:  entry,
+	})
+	return nil
+}
+
+// splitAnnexB splits a byte stream on 3 and 4 byte start codes
+func splitAnnexB(b []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && b[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nals = append(nals, b[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(b) {
+		nals = append(nals, b[start:])
+	}
+	return nals
+}
+
+// bitReader reads exp-Golomb coded fields from an RBSP
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.b)*8 {
+		return 0, errors.New("remux: truncated SPS")
+	}
+	v := uint(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return v, nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("remux: invalid exp-Golomb code")
+		}
+	}
+	v, err := r.bits(zeros)
+	return (1<<uint(zeros) - 1) + v, err
+}
+
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int(v+1) / 2, err
+	}
+	return -int(v / 2), err
+}
+
+// unescapeRBSP removes emulation prevention bytes
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// parseSPS returns the display size encoded in a sequence parameter set
+func parseSPS(nal []byte) (int, int, error) {
+	if len(nal) < 4 {
+		return 0, 0, errors.New("remux: truncated SPS")
+	}
+	r := &bitReader{b: unescapeRBSP(nal[1:])}
+
+	profile, _ := r.bits(8)
+	// skip constraint flags, level and seq_parameter_set_id
+	r.bits(16)
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		scaling, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scaling == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, err := r.se()
+						if err != nil {
+							return 0, 0, err
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		cycle, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs, _ := r.ue()
+	heightMapUnits, _ := r.ue()
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	width := int(widthMbs+1) * 16
+	height := int(2-frameMbsOnly) * int(heightMapUnits+1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		cropX, cropY := 1, 2-int(frameMbsOnly)
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		width -= cropX * int(left+right)
+		height -= cropY * int(top+bottom)
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,557 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	movieTimescale = 1000
+	videoTimescale = 90000
+)
+
+// box is an MP4 box under construction
+type box struct {
+	bytes.Buffer
+}
+
+func (b *box) u8(v uint8)   { b.WriteByte(v) }
+func (b *box) u16(v uint16) { binary.Write(b, binary.BigEndian, v) }
+func (b *box) u32(v uint32) { binary.Write(b, binary.BigEndian, v) }
+func (b *box) u64(v uint64) { binary.Write(b, binary.BigEndian, v) }
+func (b *box) zeros(n int)  { b.Write(make([]byte, n)) }
+
+// fullHeader writes the version and flags of a full box
+func (b *box) fullHeader(version uint8, flags uint32) {
+	b.u32(uint32(version)<<24 | flags&0xffffff)
+}
+
+// wrap prefixes children with a box header
+func wrap(kind string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], kind)
+	for _, child := range children {
+		out = append(out, child...)
+	}
+	return out
+}
+
+// mp4Track is a track laid out for muxing
+type mp4Track struct {
+	id            uint32
+	timescale     uint32
+	handler       string
+	sampleEntries [][]byte
+	sizes         []uint32
+	durations     []uint32
+	offsets       []int32
+	keyframes     []uint32
+	// chunks are runs of samples that follow each other in the media data
+	// and share a sample entry
+	chunks []mp4Chunk
+	// start is the track's first presentation time in movie timescale
+	start int64
+	// mediaStart is the first presentation time in track timescale
+	mediaStart int64
+	duration   uint64
+	width      int
+	height     int
+}
+
+type mp4Chunk struct {
+	offset  int64
+	size    int64
+	samples uint32
+	entry   int
+}
+
+// addSample appends a sample at offset in the media data to the track,
+// starting a new chunk unless it directly follows the previous sample
+func (t *mp4Track) addSample(offset int64, size uint32, duration int64, entry int) {
+	if duration < 0 {
+		duration = 0
+	}
+	t.sizes = append(t.sizes, size)
+	t.durations = append(t.durations, uint32(duration))
+	t.duration += uint64(duration)
+
+	if n := len(t.chunks); n > 0 {
+		last := &t.chunks[n-1]
+		if last.entry == entry && last.offset+last.size == offset {
+			last.size += int64(size)
+			last.samples++
+			return
+		}
+	}
+	t.chunks = append(t.chunks, mp4Chunk{offset: offset, size: int64(size), samples: 1, entry: entry})
+}
+
+// WriteMP4 muxes the demuxed tracks into a progressive MP4 with the movie
+// header in front of the media data. media must read back what the demuxer
+// wrote to its sink.
+func WriteMP4(w io.Writer, d *Demuxer, media io.Reader) error {
+	var tracks []*mp4Track
+	if len(d.Video.Samples) > 0 {
+		tracks = append(tracks, videoTrack(&d.Video))
+	}
+	if len(d.Audio.Samples) > 0 {
+		tracks = append(tracks, audioTrack(&d.Audio))
+	}
+	if len(tracks) == 0 {
+		return ErrNoStreams
+	}
+
+	// align tracks on the earliest presentation time
+	first := tracks[0].start
+	for _, t := range tracks {
+		if t.start < first {
+			first = t.start
+		}
+	}
+	for i, t := range tracks {
+		t.id = uint32(i + 1)
+		t.start -= first
+	}
+
+	ftyp := &box{}
+	ftyp.Write([]byte("isom"))
+	ftyp.u32(512)
+	ftyp.Write([]byte("isomiso2avc1mp41"))
+	ftypBox := wrap("ftyp", ftyp.Bytes())
+
+	// the moov size only depends on whether chunk offsets need 64 bits, so
+	// lay it out to learn where the media data starts and again if the
+	// offsets turn out not to fit
+	large := false
+	moov := moovBox(tracks, 0, large)
+	dataStart := int64(len(ftypBox)+len(moov)) + 16
+	if dataStart+d.MediaSize() > 0xffffffff {
+		large = true
+		moov = moovBox(tracks, 0, large)
+		dataStart = int64(len(ftypBox)+len(moov)) + 16
+	}
+	moov = moovBox(tracks, dataStart, large)
+
+	if _, err := w.Write(ftypBox); err != nil {
+		return err
+	}
+	if _, err := w.Write(moov); err != nil {
+		return err
+	}
+
+	// 64 bit mdat header so the layout above holds for any size
+	mdat := &box{}
+	mdat.u32(1)
+	mdat.Write([]byte("mdat"))
+	mdat.u64(uint64(16 + d.MediaSize()))
+	if _, err := w.Write(mdat.Bytes()); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, media)
+	if err != nil {
+		return err
+	}
+	if n != d.MediaSize() {
+		return errors.New("remux: media data does not match the samples")
+	}
+	return nil
+}
+
+func videoTrack(v *VideoTrack) *mp4Track {
+	t := &mp4Track{
+		timescale:  videoTimescale,
+		handler:    "vide",
+		start:      v.Samples[0].PTS * movieTimescale / videoTimescale,
+		mediaStart: v.Samples[0].PTS - v.Samples[0].DTS,
+	}
+
+	for i, s := range v.Samples {
+		duration := int64(defaultFrameDuration)
+		if i+1 < len(v.Samples) {
+			duration = v.Samples[i+1].DTS - s.DTS
+		} else if i > 0 {
+			duration = s.DTS - v.Samples[i-1].DTS
+		}
+		t.addSample(s.Offset, s.Size, duration, s.Entry)
+		t.offsets = append(t.offsets, int32(s.PTS-s.DTS))
+		if s.Key {
+			t.keyframes = append(t.keyframes, uint32(i+1))
+		}
+	}
+
+	for _, e := range v.Entries {
+		if e.Width > t.width {
+			t.width = e.Width
+		}
+		if e.Height > t.height {
+			t.height = e.Height
+		}
+		t.sampleEntries = append(t.sampleEntries, avc1Entry(e))
+	}
+	return t
+}
+
+func avc1Entry(e VideoEntry) []byte {
+	avcC := &box{}
+	avcC.u8(1)
+	avcC.Write(e.SPS[1:4])
+	avcC.u8(0xff) // 4 byte NAL lengths
+	avcC.u8(0xe1) // one SPS
+	avcC.u16(uint16(len(e.SPS)))
+	avcC.Write(e.SPS)
+	avcC.u8(1)
+	avcC.u16(uint16(len(e.PPS)))
+	avcC.Write(e.PPS)
+
+	entry := &box{}
+	entry.zeros(6)
+	entry.u16(1) // data reference index
+	entry.zeros(16)
+	entry.u16(uint16(e.Width))
+	entry.u16(uint16(e.Height))
+	entry.u32(0x00480000)
+	entry.u32(0x00480000)
+	entry.u32(0)
+	entry.u16(1) // frame count
+	entry.zeros(32)
+	entry.u16(0x0018)
+	entry.u16(0xffff)
+	entry.Write(wrap("avcC", avcC.Bytes()))
+	return wrap("avc1", entry.Bytes())
+}
+
+// audioTrack lays out the audio samples at their timestamps, so gaps in the
+// audio stretch the sample before them instead of pulling the rest of the
+// track ahead of the video
+func audioTrack(a *AudioTrack) *mp4Track {
+	rate := int64(a.Entries[0].SampleRate)
+	first := a.Samples[0].PTS
+	t := &mp4Track{
+		timescale: uint32(rate),
+		handler:   "soun",
+		start:     first * movieTimescale / videoTimescale,
+	}
+
+	// position of a sample in the track timescale
+	position := func(s AudioSample) int64 {
+		return (s.PTS - first) * rate / videoTimescale
+	}
+	for i, s := range a.Samples {
+		duration := samplesPerFrame * rate / int64(a.Entries[s.Entry].SampleRate)
+		if i+1 < len(a.Samples) {
+			duration = position(a.Samples[i+1]) - position(s)
+		}
+		t.addSample(s.Offset, s.Size, duration, s.Entry)
+	}
+
+	for _, e := range a.Entries {
+		t.sampleEntries = append(t.sampleEntries, mp4aEntry(e))
+	}
+	return t
+}
+
+func mp4aEntry(e AudioEntry) []byte {
+	decoder := &box{}
+	decoder.u8(0x40) // MPEG-4 audio
+	decoder.u8(0x15) // audio stream
+	decoder.zeros(3) // buffer size
+	decoder.u32(0)   // max bitrate
+	decoder.u32(0)   // average bitrate
+	decoder.Write(descriptor(0x05, e.audioSpecificConfig()))
+
+	es := &box{}
+	es.u16(uint16(1)) // ES ID
+	es.u8(0)
+	es.Write(descriptor(0x04, decoder.Bytes()))
+	es.Write(descriptor(0x06, []byte{0x02}))
+
+	esds := &box{}
+	esds.fullHeader(0, 0)
+	esds.Write(descriptor(0x03, es.Bytes()))
+
+	entry := &box{}
+	entry.zeros(6)
+	entry.u16(1) // data reference index
+	entry.zeros(8)
+	entry.u16(uint16(e.Channels))
+	entry.u16(16) // sample size
+	entry.zeros(4)
+	entry.u32(uint32(e.SampleRate) << 16)
+	entry.Write(wrap("esds", esds.Bytes()))
+	return wrap("mp4a", entry.Bytes())
+}
+
+// descriptor encodes an MPEG-4 elementary stream descriptor
+func descriptor(tag byte, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{tag, byte(n>>21&0x7f | 0x80), byte(n>>14&0x7f | 0x80), byte(n>>7&0x7f | 0x80), byte(n & 0x7f)}, payload...)
+}
+
+// movieDuration converts a track's media duration into movie timescale
+func (t *mp4Track) movieDuration() uint64 {
+	return t.duration * movieTimescale / uint64(t.timescale)
+}
+
+// version returns the full box version needed to store values: version 1
+// boxes carry times and durations in 64 bits
+func version(values ...uint64) uint8 {
+	for _, v := range values {
+		if v > 0xffffffff {
+			return 1
+		}
+	}
+	return 0
+}
+
+// uvar writes v in 64 bits for version 1 boxes and in 32 bits otherwise
+func (b *box) uvar(version uint8, v uint64) {
+	if version == 1 {
+		b.u64(v)
+	} else {
+		b.u32(uint32(v))
+	}
+}
+
+// moovBox lays out the movie header with chunk offsets relative to
+// dataStart, the position of the media data in the file
+func moovBox(tracks []*mp4Track, dataStart int64, large bool) []byte {
+	var duration uint64
+	for _, t := range tracks {
+		if d := uint64(t.start) + t.movieDuration(); d > duration {
+			duration = d
+		}
+	}
+
+	v := version(duration)
+	mvhd := &box{}
+	mvhd.fullHeader(v, 0)
+	mvhd.uvar(v, 0) // creation time
+	mvhd.uvar(v, 0) // modification time
+	mvhd.u32(movieTimescale)
+	mvhd.uvar(v, duration)
+	mvhd.u32(0x00010000) // rate
+	mvhd.u16(0x0100)     // volume
+	mvhd.zeros(10)
+	writeMatrix(mvhd)
+	mvhd.zeros(24)
+	mvhd.u32(uint32(len(tracks) + 1))
+
+	children := [][]byte{wrap("mvhd", mvhd.Bytes())}
+	for _, t := range tracks {
+		children = append(children, trakBox(t, dataStart, large))
+	}
+	return wrap("moov", children...)
+}
+
+func writeMatrix(b *box) {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b.u32(v)
+	}
+}
+
+func trakBox(t *mp4Track, dataStart int64, large bool) []byte {
+	duration := uint64(t.start) + t.movieDuration()
+	v := version(duration)
+	tkhd := &box{}
+	tkhd.fullHeader(v, 3) // enabled, in movie
+	tkhd.uvar(v, 0)
+	tkhd.uvar(v, 0)
+	tkhd.u32(t.id)
+	tkhd.u32(0)
+	tkhd.uvar(v, duration)
+	tkhd.zeros(8)
+	tkhd.u16(0) // layer
+	tkhd.u16(0) // alternate group
+	if t.handler == "soun" {
+		tkhd.u16(0x0100)
+	} else {
+		tkhd.u16(0)
+	}
+	tkhd.u16(0)
+	writeMatrix(tkhd)
+	tkhd.u32(uint32(t.width) << 16)
+	tkhd.u32(uint32(t.height) << 16)
+
+	v = version(uint64(t.start), t.movieDuration(), uint64(t.mediaStart))
+	elst := &box{}
+	elst.fullHeader(v, 0)
+	if t.start > 0 {
+		elst.u32(2)
+		elst.uvar(v, uint64(t.start))
+		if v == 1 {
+			elst.u64(0xffffffffffffffff) // empty edit
+		} else {
+			elst.u32(0xffffffff)
+		}
+		elst.u32(0x00010000)
+	} else {
+		elst.u32(1)
+	}
+	elst.uvar(v, t.movieDuration())
+	elst.uvar(v, uint64(t.mediaStart))
+	elst.u32(0x00010000)
+
+	v = version(t.duration)
+	mdhd := &box{}
+	mdhd.fullHeader(v, 0)
+	mdhd.uvar(v, 0)
+	mdhd.uvar(v, 0)
+	mdhd.u32(t.timescale)
+	mdhd.uvar(v, t.duration)
+	mdhd.u16(0x55c4) // und
+	mdhd.u16(0)
+
+	hdlr := &box{}
+	hdlr.fullHeader(0, 0)
+	hdlr.u32(0)
+	hdlr.Write([]byte(t.handler))
+	hdlr.zeros(12)
+	if t.handler == "vide" {
+		hdlr.Write([]byte("VideoHandler\x00"))
+	} else {
+		hdlr.Write([]byte("SoundHandler\x00"))
+	}
+
+	var header []byte
+	if t.handler == "vide" {
+		vmhd := &box{}
+		vmhd.fullHeader(0, 1)
+		vmhd.zeros(8)
+		header = wrap("vmhd", vmhd.Bytes())
+	} else {
+		smhd := &box{}
+		smhd.fullHeader(0, 0)
+		smhd.zeros(4)
+		header = wrap("smhd", smhd.Bytes())
+	}
+
+	url := &box{}
+	url.fullHeader(0, 1) // media in the same file
+	dref := &box{}
+	dref.fullHeader(0, 0)
+	dref.u32(1)
+	dref.Write(wrap("url ", url.Bytes()))
+	dinf := wrap("dinf", wrap("dref", dref.Bytes()))
+
+	minf := wrap("minf", header, dinf, stblBox(t, dataStart, large))
+	mdia := wrap("mdia", wrap("mdhd", mdhd.Bytes()), wrap("hdlr", hdlr.Bytes()), minf)
+
+	return wrap("trak", wrap("tkhd", tkhd.Bytes()), wrap("edts", wrap("elst", elst.Bytes())), mdia)
+}
+
+func stblBox(t *mp4Track, dataStart int64, large bool) []byte {
+	stsd := &box{}
+	stsd.fullHeader(0, 0)
+	stsd.u32(uint32(len(t.sampleEntries)))
+	for _, entry := range t.sampleEntries {
+		stsd.Write(entry)
+	}
+
+	// run length encode the sample durations
+	stts := &box{}
+	stts.fullHeader(0, 0)
+	var entries [][2]uint32
+	for _, d := range t.durations {
+		if n := len(entries); n > 0 && entries[n-1][1] == d {
+			entries[n-1][0]++
+			continue
+		}
+		entries = append(entries, [2]uint32{1, d})
+	}
+	stts.u32(uint32(len(entries)))
+	for _, e := range entries {
+		stts.u32(e[0])
+		stts.u32(e[1])
+	}
+
+	// one stsc entry for each run of chunks with the same layout
+	stsc := &box{}
+	stsc.fullHeader(0, 0)
+	var runs [][3]uint32
+	for i, c := range t.chunks {
+		if n := len(runs); n > 0 && runs[n-1][1] == c.samples && runs[n-1][2] == uint32(c.entry+1) {
+			continue
+		}
+		runs = append(runs, [3]uint32{uint32(i + 1), c.samples, uint32(c.entry + 1)})
+	}
+	stsc.u32(uint32(len(runs)))
+	for _, r := range runs {
+		stsc.u32(r[0])
+		stsc.u32(r[1])
+		stsc.u32(r[2])
+	}
+
+	stsz := &box{}
+	stsz.fullHeader(0, 0)
+	stsz.u32(0)
+	stsz.u32(uint32(len(t.sizes)))
+	for _, s := range t.sizes {
+		stsz.u32(s)
+	}
+
+	co := &box{}
+	co.fullHeader(0, 0)
+	co.u32(uint32(len(t.chunks)))
+	for _, c := range t.chunks {
+		if large {
+			co.u64(uint64(dataStart + c.offset))
+		} else {
+			co.u32(uint32(dataStart + c.offset))
+		}
+	}
+	stco := wrap("stco", co.Bytes())
+	if large {
+		stco = wrap("co64", co.Bytes())
+	}
+
+	children := [][]byte{
+		wrap("stsd", stsd.Bytes()),
+		wrap("stts", stts.Bytes()),
+	}
+
+	if t.handler == "vide" {
+		stss := &box{}
+		stss.fullHeader(0, 0)
+		stss.u32(uint32(len(t.keyframes)))
+		for _, k := range t.keyframes {
+			stss.u32(k)
+		}
+		children = append(children, wrap("stss", stss.Bytes()))
+
+		reordered := false
+		for _, o := range t.offsets {
+			if o != 0 {
+				reordered = true
+				break
+			}
+		}
+		if reordered {
+			ctts := &box{}
+			ctts.fullHeader(0, 0)
+			var runs [][2]int32
+			for _, o := range t.offsets {
+				if n := len(runs); n > 0 && runs[n-1][1] == o {
+					runs[n-1][0]++
+					continue
+				}
+				runs = append(runs, [2]int32{1, o})
+			}
+			ctts.u32(uint32(len(runs)))
+			for _, r := range runs {
+				ctts.u32(uint32(r[0]))
+				ctts.u32(uint32(r[1]))
+			}
+			children = append(children, wrap("ctts", ctts.Bytes()))
+		}
+	}
+
+	children = append(children, wrap("stsc", stsc.Bytes()), wrap("stsz", stsz.Bytes()), stco)
+	return wrap("stbl", children...)
+}
@@ -0,0 +1,325 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the fixtures are written by testdata/gen, see there for their content
+func demuxFixtures(t *testing.T, media *bytes.Buffer) *Demuxer {
+	t.Helper()
+
+	d := NewDemuxer(media)
+	for _, name := range []string{"seg0.ts", "seg1.ts", "seg2.ts"} {
+		if name == "seg2.ts" {
+			if err := d.Discontinuity(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := os.Open(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.Write(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDemux(t *testing.T) {
+	var media bytes.Buffer
+	d := demuxFixtures(t, &media)
+
+	if d.MediaSize() != int64(media.Len()) {
+		t.Fatalf("media size %d, wrote %d", d.MediaSize(), media.Len())
+	}
+
+	video := d.Video
+	if len(video.Samples) != 90 {
+		t.Fatalf("video samples = %d", len(video.Samples))
+	}
+	if len(video.Entries) != 2 || video.Entries[0].Width != 64 || video.Entries[0].Height != 48 || video.Entries[1].Width != 96 || video.Entries[1].Height != 40 {
+		t.Fatalf("video entries = %+v", video.Entries)
+	}
+
+	// one timeline across the 33 bit wrap and the discontinuity
+	for i, s := range video.Samples {
+		if s.Key != (i%30 == 0) {
+			t.Errorf("sample %d key = %v", i, s.Key)
+		}
+		if want := i / 60; s.Entry != want {
+			t.Errorf("sample %d entry = %d, want %d", i, s.Entry, want)
+		}
+		if s.PTS-s.DTS != 3000 {
+			t.Errorf("sample %d composition offset = %d", i, s.PTS-s.DTS)
+		}
+		if i > 0 {
+			step := s.DTS - video.Samples[i-1].DTS
+			if i == 60 {
+				// the next part starts after the longer stream, here the
+				// last audio PES of four frames
+				if step < 3000 || step > 3000+4*1920 {
+					t.Errorf("discontinuity step = %d", step)
+				}
+			} else if step != 3000 {
+				t.Errorf("sample %d step = %d", i, step)
+			}
+		}
+
+		// samples keep their parameter sets in band and drop delimiters
+		data := media.Bytes()[s.Offset : s.Offset+int64(s.Size)]
+		nal := data[4] & 0x1f
+		if s.Key && nal != nalSPS || !s.Key && nal != 1 {
+			t.Errorf("sample %d starts with NAL type %d", i, nal)
+		}
+	}
+
+	audio := d.Audio
+	if len(audio.Entries) != 2 || audio.Entries[0].SampleRate != 48000 || audio.Entries[0].Channels != 1 || audio.Entries[1].SampleRate != 44100 || audio.Entries[1].Channels != 2 {
+		t.Fatalf("audio entries = %+v", audio.Entries)
+	}
+	gaps := 0
+	for i, s := range audio.Samples {
+		if s.Entry == 0 && !bytes.Equal(media.Bytes()[s.Offset:s.Offset+int64(s.Size)], []byte{0, 0, 0, 7}) {
+			t.Fatalf("audio sample %d data differs", i)
+		}
+		if i == 0 || s.Entry != audio.Samples[i-1].Entry {
+			continue
+		}
+		// frames follow each other up to rounding of the 90kHz clock
+		step := s.PTS - audio.Samples[i-1].PTS
+		exact := float64(samplesPerFrame*90000) / float64(audio.Entries[s.Entry].SampleRate)
+		switch {
+		case step == 5*1920 && s.Entry == 0:
+			gaps++
+		case float64(step) < exact-2 || float64(step) > exact+2:
+			t.Errorf("audio sample %d step = %d", i, step)
+		}
+	}
+	if gaps != 1 {
+		t.Errorf("audio gaps = %d", gaps)
+	}
+
+	// both streams move by the same shift at the discontinuity, so the
+	// audio still starts with the video presentation
+	first := 0
+	for audio.Samples[first].Entry == 0 {
+		first++
+	}
+	if got, want := audio.Samples[first].PTS, video.Samples[60].PTS; got != want {
+		t.Errorf("audio after discontinuity at %d, video at %d", got, want)
+	}
+}
+
+func TestWriteMP4(t *testing.T) {
+	var media bytes.Buffer
+	d := demuxFixtures(t, &media)
+	mediaData := append([]byte(nil), media.Bytes()...)
+
+	var out bytes.Buffer
+	if err := WriteMP4(&out, d, &media); err != nil {
+		t.Fatal(err)
+	}
+	file := out.Bytes()
+
+	top := parseBoxes(t, file)
+	if len(top) != 3 || top[0].kind != "ftyp" || top[1].kind != "moov" || top[2].kind != "mdat" {
+		t.Fatalf("top level boxes = %v", top)
+	}
+	if !bytes.Equal(top[2].payload, mediaData) {
+		t.Fatal("mdat does not hold the media data")
+	}
+
+	traks := find(t, top[1].payload, "trak")
+	if len(traks) != 2 {
+		t.Fatalf("%d tracks", len(traks))
+	}
+
+	videoStbl := stbl(t, traks[0])
+	entries := find(t, child(t, videoStbl, "stsd")[8:], "avc1")
+	if len(entries) != 2 || binary.BigEndian.Uint16(entries[1][24:]) != 96 || binary.BigEndian.Uint16(entries[1][26:]) != 40 {
+		t.Fatalf("avc1 entries = %d", len(entries))
+	}
+	if keys := table(child(t, videoStbl, "stss"), 1); len(keys) != 3 || keys[0][0] != 1 || keys[1][0] != 31 || keys[2][0] != 61 {
+		t.Errorf("stss = %v", keys)
+	}
+	stts := table(child(t, videoStbl, "stts"), 2)
+	var total uint32
+	for _, e := range stts {
+		total += e[0]
+		if e[1] > 3000+4*1920 {
+			t.Errorf("video sample duration %d", e[1])
+		}
+	}
+	if total != 90 {
+		t.Errorf("stts covers %d samples", total)
+	}
+	checkSamples(t, file, videoStbl, d.Video.Samples[0].Size, mediaData[d.Video.Samples[0].Offset:])
+
+	// the second sample entry is used from the chunk after the discontinuity
+	stsc := table(child(t, videoStbl, "stsc"), 3)
+	if last := stsc[len(stsc)-1]; last[2] != 2 {
+		t.Errorf("stsc = %v", stsc)
+	}
+
+	audioStbl := stbl(t, traks[1])
+	if entries := find(t, child(t, audioStbl, "stsd")[8:], "mp4a"); len(entries) != 2 {
+		t.Fatalf("mp4a entries = %d", len(entries))
+	}
+	gap := false
+	for _, e := range table(child(t, audioStbl, "stts"), 2) {
+		if e[1] == 5*1024 {
+			gap = true
+		}
+	}
+	if !gap {
+		t.Error("audio gap is not kept")
+	}
+	checkSamples(t, file, audioStbl, 4, []byte{0, 0, 0, 7})
+
+	// video and audio play for about as long
+	videoLength := mediaDuration(t, traks[0])
+	audioLength := mediaDuration(t, traks[1])
+	if diff := videoLength - audioLength; diff > 0.1 || diff < -0.1 {
+		t.Errorf("video lasts %.3fs, audio %.3fs", videoLength, audioLength)
+	}
+}
+
+func TestWriteMP4Large(t *testing.T) {
+	// a recording longer than 2^32 ticks of the 90kHz clock, about 13h
+	d := NewDemuxer(ioutil.Discard)
+	d.Video.Entries = []VideoEntry{{SPS: []byte{0x67, 66, 0, 30}, PPS: []byte{0x68}, Width: 64, Height: 48}}
+	const hours7 = 7 * 3600 * 90000
+	d.Video.Samples = []VideoSample{
+		{Offset: 0, Size: 1, Key: true},
+		{Offset: 1, Size: 1, PTS: hours7, DTS: hours7},
+		{Offset: 2, Size: 1, PTS: 2 * hours7, DTS: 2 * hours7},
+	}
+	d.offset = 3
+
+	var out bytes.Buffer
+	if err := WriteMP4(&out, d, bytes.NewReader([]byte{1, 2, 3})); err != nil {
+		t.Fatal(err)
+	}
+	moov := parseBoxes(t, out.Bytes())[1].payload
+	mdhd := child(t, child(t, find(t, moov, "trak")[0], "mdia"), "mdhd")
+	if mdhd[0] != 1 {
+		t.Fatalf("mdhd version %d", mdhd[0])
+	}
+	if duration := binary.BigEndian.Uint64(mdhd[24:]); duration != 3*hours7 {
+		t.Errorf("mdhd duration = %d", duration)
+	}
+
+	// offsets past 4GiB need co64
+	tracks := []*mp4Track{videoTrack(&d.Video)}
+	if boxes := find(t, child(t, child(t, child(t, parseBoxes(t, moovBox(tracks, 1<<32, true))[0].payload, "trak"), "mdia"), "minf"), "stbl"); len(find(t, boxes[0], "co64")) != 1 {
+		t.Error("no co64 box for large offsets")
+	}
+}
+
+type mp4Box struct {
+	kind    string
+	payload []byte
+}
+
+func parseBoxes(t *testing.T, b []byte) []mp4Box {
+	t.Helper()
+
+	var boxes []mp4Box
+	for pos := 0; pos < len(b); {
+		if len(b)-pos < 8 {
+			t.Fatalf("truncated box at %d", pos)
+		}
+		size := uint64(binary.BigEndian.Uint32(b[pos:]))
+		header := 8
+		if size == 1 {
+			size = binary.BigEndian.Uint64(b[pos+8:])
+			header = 16
+		}
+		if size < uint64(header) || pos+int(size) > len(b) {
+			t.Fatalf("invalid box size %d at %d", size, pos)
+		}
+		boxes = append(boxes, mp4Box{kind: string(b[pos+4 : pos+8]), payload: b[pos+header : pos+int(size)]})
+		pos += int(size)
+	}
+	return boxes
+}
+
+// find returns the payloads of the boxes of a kind among those in b
+func find(t *testing.T, b []byte, kind string) [][]byte {
+	t.Helper()
+
+	var found [][]byte
+	for _, box := range parseBoxes(t, b) {
+		if box.kind == kind {
+			found = append(found, box.payload)
+		}
+	}
+	return found
+}
+
+func child(t *testing.T, b []byte, kind string) []byte {
+	t.Helper()
+
+	found := find(t, b, kind)
+	if len(found) != 1 {
+		t.Fatalf("%d %s boxes", len(found), kind)
+	}
+	return found[0]
+}
+
+func stbl(t *testing.T, trak []byte) []byte {
+	return child(t, child(t, child(t, trak, "mdia"), "minf"), "stbl")
+}
+
+// table reads the entries of a full box holding an entry count and rows of
+// 32 bit columns
+func table(b []byte, columns int) [][]uint32 {
+	count := int(binary.BigEndian.Uint32(b[4:]))
+	rows := make([][]uint32, count)
+	for i := range rows {
+		for c := 0; c < columns; c++ {
+			rows[i] = append(rows[i], binary.BigEndian.Uint32(b[8+(i*columns+c)*4:]))
+		}
+	}
+	return rows
+}
+
+// checkSamples checks that the first sample of a track has the given size
+// and starts with want, and that every chunk lies inside the file
+func checkSamples(t *testing.T, file []byte, stbl []byte, size uint32, want []byte) {
+	t.Helper()
+
+	stsz := child(t, stbl, "stsz")
+	if got := binary.BigEndian.Uint32(stsz[12:]); got != size {
+		t.Errorf("first sample size = %d, want %d", got, size)
+	}
+	offsets := table(child(t, stbl, "stco"), 1)
+	for _, o := range offsets {
+		if int(o[0]) >= len(file) {
+			t.Fatalf("chunk offset %d past the file end", o[0])
+		}
+	}
+	if n := len(want); n > int(size) {
+		want = want[:size]
+	}
+	if got := file[offsets[0][0] : int(offsets[0][0])+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("first sample = % x, want % x", got, want)
+	}
+}
+
+// mediaDuration returns the length of a track in seconds
+func mediaDuration(t *testing.T, trak []byte) float64 {
+	mdhd := child(t, child(t, trak, "mdia"), "mdhd")
+	return float64(binary.BigEndian.Uint32(mdhd[16:])) / float64(binary.BigEndian.Uint32(mdhd[12:]))
+}
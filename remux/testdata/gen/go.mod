@@ -0,0 +1,5 @@
+module github.com/AgoraIO-Community/Cloud-Recording-Golang/remux/testdata/gen
+
+go 1.15
+
+require github.com/asticode/go-astits v1.13.0
@@ -0,0 +1,372 @@
+// Command gen writes the MPEG-TS fixtures of the remux tests with an
+// independent muxer, go-astits. It lives in its own module so the service
+// does not depend on it. Run it from this directory:
+//
+//	go run . ..
+//
+// The fixtures are three one second segments of a recording:
+//
+//	seg0.ts  64x48 video at 30 fps and 48 kHz mono AAC, starting half a
+//	         second before the 33 bit timestamps wrap
+//	seg1.ts  continues seg0, with four audio frames missing
+//	seg2.ts  follows a discontinuity: timestamps restart at 10s, the video
+//	         is 96x40 and the audio 44.1 kHz stereo
+//
+// Video is I_PCM keyframes followed by skipped P frames, and audio is
+// silent frames, so the segments are valid but tiny.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/asticode/go-astits"
+)
+
+const (
+	videoPID = 256
+	audioPID = 257
+
+	frameDuration = 3000 // 30 fps on the 90kHz clock
+	framesPerPES  = 4
+	wrap          = int64(1) << 33
+)
+
+type segment struct {
+	name       string
+	width      int
+	height     int
+	cropBottom int
+	sampleRate int
+	freqIndex  int
+	channels   int
+	// start is the first video DTS; video PTS run 3000 later
+	start int64
+	// origin is the PTS of the first audio frame of the recording, or of
+	// the part after a discontinuity
+	origin int64
+	// skip is the audio PES left out of the segment, -1 for none
+	skip int
+}
+
+func main() {
+	dir := "."
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+
+	segments := []segment{
+		{name: "seg0.ts", width: 64, height: 48, sampleRate: 48000, freqIndex: 3, channels: 1, start: wrap - 45000, origin: wrap - 42000, skip: -1},
+		{name: "seg1.ts", width: 64, height: 48, sampleRate: 48000, freqIndex: 3, channels: 1, start: wrap + 45000, origin: wrap - 42000, skip: 2},
+		{name: "seg2.ts", width: 96, height: 48, cropBottom: 4, sampleRate: 44100, freqIndex: 4, channels: 2, start: 900000, origin: 903000, skip: -1},
+	}
+	for _, s := range segments {
+		if err := write(filepath.Join(dir, s.name), s); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func write(name string, s segment) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mx := astits.NewMuxer(context.Background(), f)
+	if err := mx.AddElementaryStream(astits.PMTElementaryStream{ElementaryPID: videoPID, StreamType: astits.StreamTypeH264Video}); err != nil {
+		return err
+	}
+	if err := mx.AddElementaryStream(astits.PMTElementaryStream{ElementaryPID: audioPID, StreamType: astits.StreamTypeAACAudio}); err != nil {
+		return err
+	}
+	mx.SetPCRPID(videoPID)
+
+	// audio PES packets of four frames follow each other from the origin;
+	// a segment holds those starting within its second
+	var audio []int64
+	for pes := int64(0); ; pes++ {
+		pts := s.origin + pes*framesPerPES*1024*90000/int64(s.sampleRate)
+		if pts >= s.start+frameDuration+90000 {
+			break
+		}
+		if pts >= s.start+frameDuration {
+			audio = append(audio, pts)
+		}
+	}
+	if s.skip >= 0 {
+		audio = append(audio[:s.skip], audio[s.skip+1:]...)
+	}
+
+	for frame := 0; frame < 30; frame++ {
+		dts := s.start + int64(frame)*frameDuration
+		if err := writeVideo(mx, s, frame, dts); err != nil {
+			return err
+		}
+
+		// interleave the audio up to the next video presentation time
+		for len(audio) > 0 && (audio[0] <= dts+2*frameDuration || frame == 29) {
+			if err := writeAudio(mx, s, audio[0]); err != nil {
+				return err
+			}
+			audio = audio[1:]
+		}
+	}
+	return nil
+}
+
+func writeVideo(mx *astits.Muxer, s segment, frame int, dts int64) error {
+	au := []byte{0, 0, 0, 1, 0x09, 0xf0} // access unit delimiter
+	if frame == 0 {
+		au = appendNAL(au, sps(s))
+		au = appendNAL(au, pps())
+		au = appendNAL(au, idrSlice(s))
+	} else {
+		au = appendNAL(au, pSlice(s, frame))
+	}
+
+	_, err := mx.WriteData(&astits.MuxerData{
+		PID:             videoPID,
+		AdaptationField: &astits.PacketAdaptationField{RandomAccessIndicator: frame == 0},
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				StreamID: 0xe0,
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:             2,
+					DataAlignmentIndicator: true,
+					PTSDTSIndicator:        astits.PTSDTSIndicatorBothPresent,
+					PTS:                    &astits.ClockReference{Base: (dts + frameDuration) % wrap},
+					DTS:                    &astits.ClockReference{Base: dts % wrap},
+				},
+			},
+			Data: au,
+		},
+	})
+	return err
+}
+
+func writeAudio(mx *astits.Muxer, s segment, pts int64) error {
+	var data []byte
+	for i := 0; i < framesPerPES; i++ {
+		data = append(data, adtsFrame(s)...)
+	}
+
+	_, err := mx.WriteData(&astits.MuxerData{
+		PID: audioPID,
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				StreamID: 0xc0,
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:             2,
+					DataAlignmentIndicator: true,
+					PTSDTSIndicator:        astits.PTSDTSIndicatorOnlyPTS,
+					PTS:                    &astits.ClockReference{Base: pts % wrap},
+				},
+			},
+			Data: data,
+		},
+	})
+	return err
+}
+
+// adtsFrame returns a silent AAC LC frame: one channel element with no
+// spectral data followed by END
+func adtsFrame(s segment) []byte {
+	var raw []byte
+	if s.channels == 1 {
+		// SCE, tag 0, global gain 0, max_sfb 0, no tools, END
+		raw = []byte{0x00, 0x00, 0x00, 0x07}
+	} else {
+		// CPE, tag 0, common_window 0 and two empty channel streams, END
+		w := &bitWriter{}
+		w.write(1, 3) // ID_CPE
+		w.write(0, 4)
+		w.write(0, 1) // common_window
+		for ch := 0; ch < 2; ch++ {
+			w.write(0, 8) // global_gain
+			w.write(0, 1) // ics_reserved_bit
+			w.write(0, 2) // window_sequence
+			w.write(0, 1) // window_shape
+			w.write(0, 6) // max_sfb
+			w.write(0, 1) // predictor_data_present
+			w.write(0, 3) // pulse, tns and gain control absent
+		}
+		w.write(7, 3) // ID_END
+		raw = w.bytes()
+	}
+
+	length := 7 + len(raw)
+	header := []byte{
+		0xff,
+		0xf1, // MPEG-4, no CRC
+		byte(1<<6 | s.freqIndex<<2 | s.channels>>2),
+		byte(s.channels&0x03<<6 | length>>11),
+		byte(length >> 3),
+		byte(length&0x07<<5 | 0x1f),
+		0xfc,
+	}
+	return append(header, raw...)
+}
+
+func appendNAL(au []byte, rbsp []byte) []byte {
+	au = append(au, 0, 0, 0, 1)
+	zeros := 0
+	for i, b := range rbsp {
+		// emulation prevention, the NAL header byte is never escaped
+		if i > 0 && zeros >= 2 && b <= 3 {
+			au = append(au, 3)
+			zeros = 0
+		}
+		au = append(au, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return au
+}
+
+func sps(s segment) []byte {
+	w := &bitWriter{}
+	w.write(0x67, 8)
+	w.write(66, 8) // baseline
+	w.write(0, 8)  // constraint flags
+	w.write(30, 8) // level 3
+	w.ue(0)        // seq_parameter_set_id
+	w.ue(0)        // log2_max_frame_num_minus4
+	w.ue(2)        // pic_order_cnt_type
+	w.ue(1)        // max_num_ref_frames
+	w.write(0, 1)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(s.width/16 - 1)
+	w.ue(s.height/16 - 1)
+	w.write(1, 1) // frame_mbs_only_flag
+	w.write(1, 1) // direct_8x8_inference_flag
+	if s.cropBottom > 0 {
+		w.write(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(s.cropBottom)
+	} else {
+		w.write(0, 1)
+	}
+	w.write(0, 1) // vui_parameters_present_flag
+	w.trailing()
+	return w.bytes()
+}
+
+func pps() []byte {
+	w := &bitWriter{}
+	w.write(0x68, 8)
+	w.ue(0)       // pic_parameter_set_id
+	w.ue(0)       // seq_parameter_set_id
+	w.write(0, 1) // entropy_coding_mode_flag
+	w.write(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)       // num_slice_groups_minus1
+	w.ue(0)       // num_ref_idx_l0_default_active_minus1
+	w.ue(0)       // num_ref_idx_l1_default_active_minus1
+	w.write(0, 1) // weighted_pred_flag
+	w.write(0, 2) // weighted_bipred_idc
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.write(1, 1) // deblocking_filter_control_present_flag
+	w.write(0, 1) // constrained_intra_pred_flag
+	w.write(0, 1) // redundant_pic_cnt_present_flag
+	w.trailing()
+	return w.bytes()
+}
+
+func idrSlice(s segment) []byte {
+	w := &bitWriter{}
+	w.write(0x65, 8)
+	w.ue(0)       // first_mb_in_slice
+	w.ue(7)       // slice_type I
+	w.ue(0)       // pic_parameter_set_id
+	w.write(0, 4) // frame_num
+	w.ue(0)       // idr_pic_id
+	w.write(0, 1) // no_output_of_prior_pics_flag
+	w.write(0, 1) // long_term_reference_flag
+	w.se(0)       // slice_qp_delta
+	w.ue(1)       // disable_deblocking_filter_idc
+
+	for mb := 0; mb < s.width/16*s.height/16; mb++ {
+		w.ue(25) // I_PCM
+		w.align()
+		for i := 0; i < 384; i++ {
+			w.write(0x80, 8)
+		}
+	}
+	w.trailing()
+	return w.bytes()
+}
+
+func pSlice(s segment, frame int) []byte {
+	w := &bitWriter{}
+	w.write(0x41, 8)
+	w.ue(0) // first_mb_in_slice
+	w.ue(5) // slice_type P
+	w.ue(0) // pic_parameter_set_id
+	w.write(uint(frame%16), 4)
+	w.write(0, 1)                      // num_ref_idx_active_override_flag
+	w.write(0, 1)                      // ref_pic_list_modification_flag_l0
+	w.write(0, 1)                      // adaptive_ref_pic_marking_mode_flag
+	w.se(0)                            // slice_qp_delta
+	w.ue(1)                            // disable_deblocking_filter_idc
+	w.ue(s.width / 16 * s.height / 16) // mb_skip_run
+	w.trailing()
+	return w.bytes()
+}
+
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (w *bitWriter) write(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.buf[len(w.buf)-1] |= 1 << uint(7-w.bits%8)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v int) {
+	n := 0
+	for (v+1)>>uint(n) > 1 {
+		n++
+	}
+	w.write(0, n)
+	w.write(uint(v+1), n+1)
+}
+
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(2*v - 1)
+	} else {
+		w.ue(-2 * v)
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.bits%8 != 0 {
+		w.write(0, 1)
+	}
+}
+
+func (w *bitWriter) trailing() {
+	w.write(1, 1)
+	w.align()
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
@@ -0,0 +1,311 @@
+// Package remux converts the MPEG-TS segments of an HLS recording into a
+// single MP4 file without transcoding. Only the H.264 video and ADTS AAC
+// audio streams produced by Agora cloud recording are supported. Media data
+// goes through a sink such as a temporary file, so only the sample tables
+// are held in memory.
+package remux
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	packetSize = 188
+	syncByte   = 0x47
+
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+
+	// timestamps are 33 bit counters on a 90kHz clock
+	timestampWrap = int64(1) << 33
+)
+
+// ErrNoStreams is returned when the input contains no supported stream
+var ErrNoStreams = errors.New("remux: no H.264 or AAC stream found")
+
+// pesStream collects the packets of one elementary stream
+type pesStream struct {
+	streamType byte
+	buf        []byte
+	lastTS     int64
+	hasTS      bool
+}
+
+// Demuxer reads consecutive MPEG-TS segments. The data of their samples is
+// written to the media sink in the order it arrives and the tracks record
+// where each sample is, so WriteMP4 can use the sink as the media data of
+// the MP4.
+type Demuxer struct {
+	pmtPIDs map[uint16]bool
+	streams map[uint16]*pesStream
+	// pids lists the streams in the order they were found, so flushes
+	// write the same file every time
+	pids []uint16
+
+	media  io.Writer
+	offset int64
+
+	// shift moves the timestamps of the current part of the recording onto
+	// one timeline. After a discontinuity rebase is set until the next
+	// timestamp arrives.
+	shift  int64
+	rebase bool
+
+	Video VideoTrack
+	Audio AudioTrack
+}
+
+// NewDemuxer returns an empty demuxer writing sample data to media
+func NewDemuxer(media io.Writer) *Demuxer {
+	return &Demuxer{
+		pmtPIDs: map[uint16]bool{},
+		streams: map[uint16]*pesStream{},
+		media:   media,
+	}
+}
+
+// MediaSize returns the number of bytes written to the media sink
+func (d *Demuxer) MediaSize() int64 {
+	return d.offset
+}
+
+// writeSample appends the data of a sample to the media sink and returns
+// its offset
+func (d *Demuxer) writeSample(data []byte) (int64, error) {
+	offset := d.offset
+	n, err := d.media.Write(data)
+	d.offset += int64(n)
+	return offset, err
+}
+
+// Write feeds one TS segment to the demuxer. Segments must be written in
+// playback order.
+func (d *Demuxer) Write(r io.Reader) error {
+	packet := make([]byte, packetSize)
+	for {
+		if _, err := io.ReadFull(r, packet); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if packet[0] != syncByte {
+			return errors.New("remux: lost TS sync")
+		}
+		if err := d.packet(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// Discontinuity tells the demuxer that the next segment does not continue
+// the timestamps of the previous one, as #EXT-X-DISCONTINUITY does. Its
+// samples are placed right after those already read.
+func (d *Demuxer) Discontinuity() error {
+	for _, pid := range d.pids {
+		stream := d.streams[pid]
+		if err := d.pes(stream); err != nil {
+			return err
+		}
+		stream.hasTS = false
+	}
+	d.rebase = true
+	return nil
+}
+
+// end returns the time right after the last sample read so far
+func (d *Demuxer) end() int64 {
+	var end int64
+	if n := len(d.Video.Samples); n > 0 {
+		last := d.Video.Samples[n-1]
+		step := int64(defaultFrameDuration)
+		if n > 1 && last.DTS > d.Video.Samples[n-2].DTS {
+			step = last.DTS - d.Video.Samples[n-2].DTS
+		}
+		end = last.DTS + step
+	}
+	if n := len(d.Audio.Samples); n > 0 {
+		last := d.Audio.Samples[n-1]
+		if e := last.PTS + d.Audio.Entries[last.Entry].frameDuration(); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// Flush completes the pending PES packets. It must be called once after the
+// last segment.
+func (d *Demuxer) Flush() error {
+	for _, pid := range d.pids {
+		if err := d.pes(d.streams[pid]); err != nil {
+			return err
+		}
+	}
+	if len(d.Video.Samples) == 0 && len(d.Audio.Samples) == 0 {
+		return ErrNoStreams
+	}
+	return nil
+}
+
+func (d *Demuxer) packet(packet []byte) error {
+	start := packet[1]&0x40 != 0
+	pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+	adaptation := (packet[3] >> 4) & 0x3
+
+	payload := packet[4:]
+	if adaptation == 2 {
+		return nil
+	}
+	if adaptation == 3 {
+		if int(payload[0])+1 > len(payload) {
+			return errors.New("remux: invalid adaptation field")
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+
+	switch {
+	case pid == 0:
+		d.pat(psiSection(payload, start))
+	case d.pmtPIDs[pid]:
+		d.pmt(psiSection(payload, start))
+	default:
+		stream, ok := d.streams[pid]
+		if !ok {
+			return nil
+		}
+		if start {
+			if err := d.pes(stream); err != nil {
+				return err
+			}
+		}
+		stream.buf = append(stream.buf, payload...)
+	}
+	return nil
+}
+
+// psiSection skips the pointer field of a PSI payload
+func psiSection(payload []byte, start bool) []byte {
+	if !start || len(payload) == 0 {
+		return nil
+	}
+	offset := 1 + int(payload[0])
+	if offset > len(payload) {
+		return nil
+	}
+	return payload[offset:]
+}
+
+func (d *Demuxer) pat(section []byte) {
+	if len(section) < 8 {
+		return
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	end := 3 + length - 4
+	if end > len(section) {
+		end = len(section)
+	}
+	for i := 8; i+4 <= end; i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		if program == 0 {
+			continue
+		}
+		d.pmtPIDs[uint16(section[i+2]&0x1f)<<8|uint16(section[i+3])] = true
+	}
+}
+
+func (d *Demuxer) pmt(section []byte) {
+	if len(section) < 12 {
+		return
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	end := 3 + length - 4
+	if end > len(section) {
+		end = len(section)
+	}
+	infoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + infoLength; i+5 <= end; {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		if streamType == streamTypeH264 || streamType == streamTypeAAC {
+			if _, ok := d.streams[pid]; !ok {
+				d.streams[pid] = &pesStream{streamType: streamType}
+				d.pids = append(d.pids, pid)
+			}
+		}
+		i += 5 + esInfoLength
+	}
+}
+
+// pes parses the buffered PES packet of a stream and hands its payload to
+// the matching track
+func (d *Demuxer) pes(stream *pesStream) error {
+	buf := stream.buf
+	stream.buf = nil
+	if len(buf) < 9 {
+		return nil
+	}
+	if buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+		return errors.New("remux: invalid PES start code")
+	}
+
+	flags := buf[7]
+	headerLength := int(buf[8])
+	if 9+headerLength > len(buf) {
+		return errors.New("remux: truncated PES header")
+	}
+
+	var pts, dts int64
+	switch {
+	case flags>>6 == 2 && headerLength >= 5:
+		pts = readTimestamp(buf[9:])
+		dts = pts
+	case flags>>6 == 3 && headerLength >= 10:
+		pts = readTimestamp(buf[9:])
+		dts = readTimestamp(buf[14:])
+	default:
+		return errors.New("remux: PES packet without timestamp")
+	}
+
+	// keep timestamps monotonic across the 33 bit wrap
+	if stream.hasTS {
+		base := stream.lastTS - stream.lastTS%timestampWrap
+		dts += base
+		pts += base
+		if dts < stream.lastTS-timestampWrap/2 {
+			dts += timestampWrap
+			pts += timestampWrap
+		}
+	}
+	if pts < dts {
+		pts += timestampWrap
+	}
+	stream.lastTS = dts
+	stream.hasTS = true
+
+	// the first timestamp after a discontinuity continues the timeline
+	if d.rebase {
+		d.shift = d.end() - dts
+		d.rebase = false
+	}
+	pts += d.shift
+	dts += d.shift
+
+	payload := buf[9+headerLength:]
+	switch stream.streamType {
+	case streamTypeH264:
+		return d.addAccessUnit(payload, pts, dts)
+	case streamTypeAAC:
+		return d.addADTS(payload, pts)
+	}
+	return nil
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
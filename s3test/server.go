@@ -0,0 +1,479 @@
+// Package s3test provides an in-process S3-compatible server for tests. It
+// serves path-style requests for a single bucket and does not check
+// signatures.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is a stored object
+type Object struct {
+	Key          string
+	Body         []byte
+	ContentType  string
+	LastModified time.Time
+}
+
+// ETag returns the quoted MD5 of the body, as S3 does for simple uploads
+func (o Object) ETag() string {
+	sum := md5.Sum(o.Body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Server is a fake S3 endpoint holding one bucket
+type Server struct {
+	*httptest.Server
+
+	Bucket string
+	// PageSize caps the keys of one ListObjectsV2 page, 1000 by default
+	PageSize int
+
+	mu       sync.Mutex
+	objects  map[string]Object
+	requests map[string]int
+	denied   map[string]bool
+	uploads  map[string]*upload
+	nextID   int
+}
+
+// upload is a multipart upload in progress
+type upload struct {
+	key         string
+	contentType string
+	parts       map[int][]byte
+}
+
+// NewServer starts a fake S3 server for bucket. Close it when done.
+func NewServer(bucket string) *Server {
+	s := &Server{
+		Bucket:   bucket,
+		PageSize: 1000,
+		objects:  map[string]Object{},
+		requests: map[string]int{},
+		denied:   map[string]bool{},
+		uploads:  map[string]*upload{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Put stores an object, modified at the given time
+func (s *Server) Put(key string, body []byte, modified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[key] = Object{Key: key, Body: body, LastModified: modified.UTC().Truncate(time.Second)}
+}
+
+// DenyDelete makes batch deletes refuse the given keys with AccessDenied,
+// as S3 does when a bucket policy protects them
+func (s *Server) DenyDelete(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		s.denied[key] = true
+	}
+}
+
+// Object returns the object stored under key
+func (s *Server) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// Keys returns every stored key in order
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns how many requests of an operation were served: "list",
+// "get", "put", "delete", "multipart" for started multipart uploads, "part"
+// or "abort"
+func (s *Server) Requests(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[op]
+}
+
+// SeedSession stores a finished mix mode recording the way Agora uploads
+// it: <channel>/<unix start time>/<sid>_<channel>.m3u8 with its .ts
+// segments. It returns the playlist key.
+func (s *Server) SeedSession(channel string, startedAt time.Time, sid string, segments int) string {
+	prefix := channel + "/" + strconv.FormatInt(startedAt.Unix(), 10) + "/"
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-TARGETDURATION:10\n")
+	for i := 0; i < segments; i++ {
+		name := fmt.Sprintf("%s_%s_%s%03d.ts", sid, channel, startedAt.UTC().Add(time.Duration(i)*10*time.Second).Format("20060102150405"), 0)
+		s.Put(prefix+name, []byte{0x47}, startedAt.Add(time.Duration(i+1)*10*time.Second))
+		fmt.Fprintf(&playlist, "#EXTINF:10.000\n%s\n", name)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+
+	key := prefix + sid + "_" + channel + ".m3u8"
+	s.Put(key, []byte(playlist.String()), startedAt.Add(time.Duration(segments)*10*time.Second))
+	return key
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket != s.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	_, deleting := query["delete"]
+	_, creating := query["uploads"]
+	uploadID := query.Get("uploadId")
+	switch {
+	case key != "" && r.Method == http.MethodPost && creating:
+		s.requests["multipart"]++
+		s.createUpload(w, r, key)
+	case key != "" && r.Method == http.MethodPut && uploadID != "":
+		s.requests["part"]++
+		s.uploadPart(w, r, uploadID)
+	case key != "" && r.Method == http.MethodPost && uploadID != "":
+		s.completeUpload(w, r, key, uploadID)
+	case key != "" && r.Method == http.MethodDelete && uploadID != "":
+		s.requests["abort"]++
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case key == "" && r.Method == http.MethodGet:
+		s.requests["list"]++
+		s.list(w, r)
+	case key == "" && r.Method == http.MethodPost && deleting:
+		s.requests["delete"]++
+		s.delete(w, r)
+	case key != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.requests["get"]++
+		s.get(w, r, key)
+	case key != "" && r.Method == http.MethodPut:
+		s.requests["put"]++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		object := Object{Key: key, Body: body, ContentType: r.Header.Get("Content-Type"), LastModified: time.Now().UTC().Truncate(time.Second)}
+		s.objects[key] = object
+		w.Header().Set("ETag", object.ETag())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed")
+	}
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listEntry
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	// the continuation token is the last key of the previous page
+	after := query.Get("continuation-token")
+
+	maxKeys := s.PageSize
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listResult{Name: s.Bucket, Prefix: prefix, MaxKeys: maxKeys, ContinuationToken: after}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		object := s.objects[key]
+		result.Contents = append(result.Contents, listEntry{
+			Key:          key,
+			LastModified: object.LastModified.Format(time.RFC3339),
+			ETag:         object.ETag(),
+			Size:         len(object.Body),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	etag := object.ETag()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	if object.ContentType != "" {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body := object.Body
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, ok := parseRange(rangeHeader, len(body))
+		if !ok {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+		body = body[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// parseRange parses a single "bytes=start-end" range, either end optional
+func parseRange(header string, size int) (int, int, bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	if parts[0] == "" {
+		suffix, err := strconv.Atoi(parts[1])
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, size > 0
+	}
+
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		if end, err = strconv.Atoi(parts[1]); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+	Quiet bool
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string
+	}
+	Errors []deleteError `xml:"Error"`
+}
+
+type deleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	var req deleteRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var result deleteResult
+	for _, object := range req.Objects {
+		// failures are reported in quiet mode too
+		if s.denied[object.Key] {
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: "AccessDenied", Message: "Access Denied"})
+			continue
+		}
+		delete(s.objects, object.Key)
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, struct{ Key string }{object.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+type createUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &upload{key: key, contentType: r.Header.Get("Content-Type"), parts: map[int][]byte{}}
+	writeXML(w, http.StatusOK, createUploadResult{Bucket: s.Bucket, Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id string) {
+	upload, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	upload.parts[number] = body
+	w.Header().Set("ETag", Object{Body: body}.ETag())
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+// completeUpload joins the listed parts into the object, checking their
+// ETags like S3 does
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, key string, id string) {
+	upload, ok := s.uploads[id]
+	if !ok || upload.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	var req completeRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+
+	var body []byte
+	for i, part := range req.Parts {
+		data, ok := upload.parts[part.PartNumber]
+		if !ok || (Object{Body: data}).ETag() != part.ETag || (i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+			return
+		}
+		body = append(body, data...)
+	}
+
+	object := Object{Key: key, Body: body, ContentType: upload.contentType, LastModified: time.Now().UTC().Truncate(time.Second)}
+	s.objects[key] = object
+	delete(s.uploads, id)
+	writeXML(w, http.StatusOK, completeResult{Bucket: s.Bucket, Key: key, ETag: object.ETag()})
+}
+
+// Uploads returns how many multipart uploads are neither completed nor
+// aborted
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeXML(w, status, errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
@@ -1,8 +1,23 @@
 package schemas
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type StartCall struct {
 	// Uid     int    `json:"uid"`
-	Channel string `json:"channel"`
+	Channel            string `json:"channel"`
+	Preset             string `json:"preset"`
+	MaxDurationSeconds int    `json:"maxDurationSeconds"`
+}
+
+type CreateSchedule struct {
+	Channel         string    `json:"channel"`
+	StartTime       time.Time `json:"startTime"`
+	DurationSeconds int       `json:"durationSeconds"`
+	Preset          string    `json:"preset"`
+	Recurrence      string    `json:"recurrence"`
 }
 
 type StopCall struct {
@@ -10,6 +25,7 @@ type StopCall struct {
 	Channel string `json:"channel"`
 	Rid     string `json:"rid"`
 	Sid     string `json:"sid"`
+	Mode    string `json:"mode"`
 }
 
 type UserCredentials struct {
@@ -18,6 +34,37 @@ type UserCredentials struct {
 }
 
 type CallStatus struct {
-	Rid string `json:"rid"`
-	Sid string `json:"sid"`
+	Rid  string `json:"rid"`
+	Sid  string `json:"sid"`
+	Mode string `json:"mode"`
+}
+
+// Notification is an Agora Notification Center (NCS) event
+type Notification struct {
+	NoticeID  string          `json:"noticeId"`
+	ProductID int             `json:"productId"`
+	EventType int             `json:"eventType"`
+	NotifyMs  int64           `json:"notifyMs"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// RecordingEvent is the payload of a cloud recording notification
+type RecordingEvent struct {
+	Cname       string                 `json:"cname"`
+	Uid         string                 `json:"uid"`
+	Sid         string                 `json:"sid"`
+	Sequence    int                    `json:"sequence"`
+	Sendts      int64                  `json:"sendts"`
+	ServiceType int                    `json:"serviceType"`
+	Details     map[string]interface{} `json:"details"`
+}
+
+// ChannelEvent is the payload of an RTC channel notification
+type ChannelEvent struct {
+	ChannelName string `json:"channelName"`
+	Uid         int    `json:"uid"`
+	ClientSeq   int64  `json:"clientSeq"`
+	Ts          int64  `json:"ts"`
+	Platform    int    `json:"platform"`
+	Reason      int    `json:"reason"`
 }
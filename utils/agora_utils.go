@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// agoraHTTPClient is shared by every cloud recording client. Its timeout is
+// a backstop; calls are bounded by their operation timeout.
+var agoraHTTPClient = &http.Client{Timeout: 2 * time.Minute}
+
+// GetRetryPolicy returns the AGORA_RETRY policy
+func GetRetryPolicy() cloudrecording.RetryPolicy {
+	policy := CurrentConfig().AgoraRetry
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// AgoraClient returns a cloud recording client for the project of tenant
+func AgoraClient(tenant Tenant) *cloudrecording.Client {
+	client := cloudrecording.NewClient(tenant.AppID, tenant.CustomerID, tenant.CustomerCertificate)
+	if tenant.AgoraBaseURL != "" {
+		client.BaseURL = tenant.AgoraBaseURL
+	}
+	client.HTTPClient = agoraHTTPClient
+	client.Observe = agoraAttempt
+	client.Retry = GetRetryPolicy()
+	client.Timeouts = map[string]time.Duration{}
+	for _, op := range []string{OpAcquire, OpStart, OpQuery, OpUpdate, OpUpdateLayout, OpStop} {
+		client.Timeouts[op] = OperationTimeout(op)
+	}
+	return client
+}
+
+// agoraAttempt logs and counts one attempt of a cloud recording API call
+func agoraAttempt(ctx context.Context, op string, err error, elapsed time.Duration) {
+	code := agoraOutcome(err)
+	observeAgoraCall(op, code, elapsed)
+
+	fields := Fields{"op": op, "code": code, "duration_ms": elapsed.Milliseconds()}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	LogEvent(ctx, "agora", "call", fields)
+}
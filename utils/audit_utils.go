@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditRecordingStart = "recording.start"
+	AuditRecordingStop  = "recording.stop"
+	AuditTokenRTC       = "token.rtc"
+	AuditTokenRTM       = "token.rtm"
+	AuditDownload       = "recording.download"
+)
+
+// AuditEvent is one line of the audit log: who did what to which channel,
+// recording or files
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Principal string    `json:"principal"`
+	Tenant    string    `json:"tenant"`
+	RequestID string    `json:"request_id,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	UID       string    `json:"uid,omitempty"`
+	SID       string    `json:"sid,omitempty"`
+	Files     []string  `json:"files,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditPath string
+)
+
+// Audit appends event to AUDIT_LOG_PATH, filling in the time, tenant and
+// request ID from ctx. The file is only ever appended to. A failed write
+// is logged and does not fail the audited operation.
+func Audit(ctx context.Context, event AuditEvent) {
+	event.Time = time.Now().UTC()
+	event.Tenant = TenantFrom(ctx).ID
+	event.RequestID = RequestIDFrom(ctx)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("audit:", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	path := CurrentConfig().AuditLogPath
+	if path == "" {
+		return
+	}
+	// the path may change on reload
+	if auditFile == nil || auditPath != path {
+		if auditFile != nil {
+			auditFile.Close()
+			auditFile = nil
+		}
+		auditFile, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Printf("audit: %s: %s", path, err)
+			return
+		}
+		auditPath = path
+	}
+
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		log.Printf("audit: %s: %s", path, err)
+	}
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+// Agora RTC channel event types delivered through the Notification Center
+const (
+	ProductRTC = 1
+
+	EventChannelDestroy    = 102
+	EventBroadcasterJoin   = 103
+	EventBroadcasterLeave  = 104
+	EventRoleToBroadcaster = 111
+	EventRoleToAudience    = 112
+)
+
+// autoRecordPrincipalPrefix marks sessions started and stopped by a rule
+const autoRecordPrincipalPrefix = "rule:"
+
+// AutoRecordRule records every channel matching Pattern (a path.Match glob
+// such as "class-*") while someone broadcasts in it
+type AutoRecordRule struct {
+	Pattern            string `mapstructure:"pattern" json:"pattern"`
+	Preset             string `mapstructure:"preset" json:"preset"`
+	MaxDurationSeconds int    `mapstructure:"max_duration_seconds" json:"max_duration_seconds"`
+}
+
+// channelActivity is what the rules engine knows about one channel of a
+// tenant. lastSeq holds the clientSeq of the latest event of each user.
+type channelActivity struct {
+	broadcasters map[int]bool
+	lastSeq      map[int]int64
+	rule         *AutoRecordRule
+	sid          string
+	botUID       int
+	starting     bool
+}
+
+var (
+	channels   = map[string]*channelActivity{}
+	channelsMu sync.Mutex
+
+	// starts that fail are retried while someone broadcasts, after a delay
+	// doubling from autoRecordRetryInitial up to autoRecordRetryMax
+	autoRecordRetryInitial = 5 * time.Second
+	autoRecordRetryMax     = 5 * time.Minute
+)
+
+// GetAutoRecordRules returns the configured auto record rules
+func GetAutoRecordRules() []AutoRecordRule {
+	return CurrentConfig().AutoRecordRules
+}
+
+// matchAutoRecordRule returns the first rule whose pattern matches channel
+func matchAutoRecordRule(rules []AutoRecordRule, channel string) *AutoRecordRule {
+	for i, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, channel); ok {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// HandleChannelEvent feeds an RTC channel event of tenant to the rules engine.
+// Recordings are started when a matching channel gets its first broadcaster
+// and stopped when the last one leaves or the channel is destroyed. Events
+// older than the latest clientSeq seen for a user are ignored, since Agora
+// does not guarantee delivery order.
+func HandleChannelEvent(tenant Tenant, eventType int, channel string, uid int, clientSeq int64) {
+	rule := matchAutoRecordRule(GetAutoRecordRules(), channel)
+	if rule == nil {
+		return
+	}
+
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+
+	key := tenant.ID + "/" + channel
+	activity, ok := channels[key]
+	if !ok {
+		activity = &channelActivity{
+			broadcasters: map[int]bool{},
+			lastSeq:      map[int]int64{},
+		}
+		channels[key] = activity
+	}
+
+	if eventType != EventChannelDestroy {
+		// the recording bot shows up in the channel like any other user
+		if activity.sid != "" && uid == activity.botUID {
+			return
+		}
+		if seq, ok := activity.lastSeq[uid]; ok && clientSeq <= seq {
+			return
+		}
+		activity.lastSeq[uid] = clientSeq
+	}
+
+	switch eventType {
+	case EventBroadcasterJoin, EventRoleToBroadcaster:
+		activity.broadcasters[uid] = true
+	case EventBroadcasterLeave, EventRoleToAudience:
+		delete(activity.broadcasters, uid)
+	case EventChannelDestroy:
+		activity.broadcasters = map[int]bool{}
+		activity.lastSeq = map[int]int64{}
+	default:
+		return
+	}
+
+	if len(activity.broadcasters) > 0 && activity.sid == "" && !activity.starting {
+		activity.starting = true
+		activity.rule = rule
+		rule := *rule
+		runJob(func() { startAutoRecording(tenant, key, channel, activity, rule, 0) })
+	}
+	if len(activity.broadcasters) == 0 && activity.sid != "" {
+		sid := activity.sid
+		activity.sid = ""
+		rule := *activity.rule
+		runJob(func() { stopAutoRecording(sid, rule) })
+	}
+	forgetChannel(key, activity)
+}
+
+// forgetChannel drops the activity of a channel nobody broadcasts in and
+// that has no recording going. The caller must hold channelsMu.
+func forgetChannel(key string, activity *channelActivity) {
+	if len(activity.broadcasters) > 0 || activity.sid != "" || activity.starting {
+		return
+	}
+	if channels[key] == activity {
+		delete(channels, key)
+	}
+}
+
+// startAutoRecording makes the attempt-th try to record channel. Failed
+// tries are retried as long as someone still broadcasts.
+func startAutoRecording(tenant Tenant, key string, channel string, activity *channelActivity, rule AutoRecordRule, attempt int) {
+	channelsMu.Lock()
+	if len(activity.broadcasters) == 0 {
+		activity.starting = false
+		forgetChannel(key, activity)
+		channelsMu.Unlock()
+		return
+	}
+	channelsMu.Unlock()
+
+	transcoding, ok := TranscodingPreset(tenant, rule.Preset)
+	if !ok {
+		transcoding = DefaultTranscodingConfig
+	}
+
+	ctx := WithLogFields(WithTenant(ServerContext(), tenant), Fields{"channel": channel})
+	_, session, err := StartSession(ctx, channel, transcoding, MaxDuration(tenant, rule.MaxDurationSeconds), autoRecordPrincipalPrefix+rule.Pattern)
+
+	channelsMu.Lock()
+	if err != nil {
+		retry := len(activity.broadcasters) > 0 && ServerContext().Err() == nil
+		if !retry {
+			activity.starting = false
+			forgetChannel(key, activity)
+		}
+		channelsMu.Unlock()
+
+		if !retry {
+			LogEvent(ctx, "auto-record", "start failed", Fields{"error": err.Error()})
+			return
+		}
+		delay := retryDelay(attempt, autoRecordRetryInitial, autoRecordRetryMax)
+		LogEvent(ctx, "auto-record", "start failed", Fields{"error": err.Error(), "retry_in": delay.String()})
+		time.AfterFunc(delay, func() {
+			select {
+			case <-Draining():
+				return
+			default:
+			}
+			runJob(func() { startAutoRecording(tenant, key, channel, activity, rule, attempt+1) })
+		})
+		return
+	}
+	activity.starting = false
+	activity.sid = session.SID
+	activity.botUID = session.UID
+	// everyone left while the recording was starting
+	empty := len(activity.broadcasters) == 0
+	if empty {
+		activity.sid = ""
+		forgetChannel(key, activity)
+	}
+	channelsMu.Unlock()
+
+	LogEvent(sessionLogContext(ctx, session), "auto-record", "started", nil)
+	if empty {
+		stopAutoRecording(session.SID, rule)
+	}
+}
+
+func stopAutoRecording(sid string, rule AutoRecordRule) {
+	session, ok, err := Sessions.Get(sid)
+	if err != nil || !ok || session.Status != SessionRecording {
+		return
+	}
+
+	ctx := sessionLogContext(ServerContext(), session)
+	if err := StopSession(ctx, session, autoRecordPrincipalPrefix+rule.Pattern, "last broadcaster left"); err != nil {
+		LogEvent(ctx, "auto-record", "stop failed", Fields{"error": err.Error()})
+		return
+	}
+	LogEvent(ctx, "auto-record", "stopped", nil)
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording/cloudrecordingtest"
+)
+
+// newTestAutoRecord records channels matching class-* against a fake Agora
+// server with no channel activity
+func newTestAutoRecord(t *testing.T) (*cloudrecordingtest.Server, Tenant) {
+	fake, _, cfg := newTestAgora(t)
+	cfg.AutoRecordRules = []AutoRecordRule{{Pattern: "class-*"}}
+
+	channelsMu.Lock()
+	channels = map[string]*channelActivity{}
+	channelsMu.Unlock()
+
+	tenant, _ := GetTenant("")
+	return fake, tenant
+}
+
+// channelState returns the recording of a channel, and whether the rules
+// engine still tracks it, once background jobs are done
+func channelState(t *testing.T, tenant Tenant, channel string) (string, bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitForJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+	activity, ok := channels[tenant.ID+"/"+channel]
+	if !ok {
+		return "", false
+	}
+	return activity.sid, true
+}
+
+func TestAutoRecord(t *testing.T) {
+	fake, tenant := newTestAutoRecord(t)
+
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "lobby", 1, 1)
+	if _, tracked := channelState(t, tenant, "lobby"); tracked {
+		t.Error("channel without a rule tracked")
+	}
+
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "class-a", 1, 1)
+	sid, _ := channelState(t, tenant, "class-a")
+	if sid == "" {
+		t.Fatal("no recording after the first broadcaster joined")
+	}
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "class-a", 2, 1)
+	HandleChannelEvent(tenant, EventBroadcasterLeave, "class-a", 1, 2)
+	// a join delivered late does not bring the user back
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "class-a", 1, 1)
+	if got, _ := channelState(t, tenant, "class-a"); got != sid {
+		t.Errorf("recording %q, want %s to keep going", got, sid)
+	}
+
+	HandleChannelEvent(tenant, EventBroadcasterLeave, "class-a", 2, 2)
+	if _, tracked := channelState(t, tenant, "class-a"); tracked {
+		t.Error("channel still tracked after the last broadcaster left")
+	}
+	if session, _, _ := Sessions.Get(sid); session.Status != SessionStopped || session.StoppedBy != "rule:class-*" {
+		t.Errorf("session = %+v, want it stopped by the rule", session)
+	}
+
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "class-b", 3, 1)
+	sid, _ = channelState(t, tenant, "class-b")
+	HandleChannelEvent(tenant, EventChannelDestroy, "class-b", 0, 0)
+	if _, tracked := channelState(t, tenant, "class-b"); tracked {
+		t.Error("channel still tracked after it was destroyed")
+	}
+	if session, _, _ := Sessions.Get(sid); session.Status != SessionStopped {
+		t.Errorf("session = %+v, want it stopped with the channel", session)
+	}
+	if got := fake.Calls(cloudrecording.OpStart); got != 2 {
+		t.Errorf("starts = %d, want one per channel", got)
+	}
+}
+
+func TestAutoRecordRetriesStart(t *testing.T) {
+	fake, tenant := newTestAutoRecord(t)
+	initial, max := autoRecordRetryInitial, autoRecordRetryMax
+	autoRecordRetryInitial, autoRecordRetryMax = 10*time.Millisecond, 20*time.Millisecond
+	defer func() { autoRecordRetryInitial, autoRecordRetryMax = initial, max }()
+
+	refused := cloudrecording.Error{StatusCode: http.StatusBadRequest, Code: 2, Reason: "invalid parameter"}
+	fake.Fail(cloudrecording.OpAcquire, refused, 2)
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "class-a", 1, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if sid, _ := channelState(t, tenant, "class-a"); sid != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("start not retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fake.Calls(cloudrecording.OpAcquire); got != 3 {
+		t.Errorf("acquires = %d, want two failures and a success", got)
+	}
+
+	// nobody is left to record, so the failed start is given up
+	fake.Fail(cloudrecording.OpAcquire, refused, 100)
+	HandleChannelEvent(tenant, EventBroadcasterJoin, "class-b", 1, 1)
+	HandleChannelEvent(tenant, EventBroadcasterLeave, "class-b", 1, 2)
+	time.Sleep(100 * time.Millisecond)
+	if _, tracked := channelState(t, tenant, "class-b"); tracked {
+		t.Error("channel still tracked after the broadcaster left")
+	}
+	acquires := fake.Calls(cloudrecording.OpAcquire)
+	time.Sleep(100 * time.Millisecond)
+	if got := fake.Calls(cloudrecording.OpAcquire); got != acquires {
+		t.Errorf("acquires went from %d to %d with nobody broadcasting", acquires, got)
+	}
+}
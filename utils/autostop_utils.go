@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// autoStopPrincipal is recorded as StoppedBy for sessions stopped on deadline
+const autoStopPrincipal = "auto-stop"
+
+var (
+	autoStops   = map[string]*time.Timer{}
+	autoStopsMu sync.Mutex
+
+	// failed auto stops are retried after a delay doubling from
+	// autoStopRetryInitial up to autoStopRetryMax
+	autoStopRetryInitial = 5 * time.Second
+	autoStopRetryMax     = 5 * time.Minute
+)
+
+// MaxDuration clamps a requested recording duration to the maximum recording
+// length of tenant. A zero request means no limit unless a ceiling is
+// configured.
+func MaxDuration(tenant Tenant, requestedSeconds int) time.Duration {
+	ceiling := tenant.Recording.MaxRecordingSeconds
+	seconds := requestedSeconds
+	if ceiling > 0 && (seconds <= 0 || seconds > ceiling) {
+		seconds = ceiling
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// StopSession stops a tracked session on behalf of the service and records
+// why it was stopped. The session is stopped for the tenant it belongs to.
+func StopSession(ctx context.Context, session Session, principal string, reason string) (err error) {
+	ctx, span := startSpan(ctx, "StopSession", cloudrecording.SpanAttributes(session.Channel, session.Mode, session.RID, session.SID)...)
+	defer func() { endSpan(span, err) }()
+
+	ctx, err = withTenantID(ctx, session.Tenant)
+	if err != nil {
+		return err
+	}
+	ctx = sessionLogContext(ctx, session)
+	tenant := TenantFrom(ctx)
+
+	result, err := AgoraClient(tenant).Stop(ctx, session.RID, session.SID, session.Mode, cloudrecording.StopRequest{
+		Cname: session.Channel,
+		UID:   strconv.Itoa(session.UID),
+	})
+	if err != nil {
+		return err
+	}
+	ScheduleConsolidation(tenant, session.Channel, session.SID)
+
+	session.EndReason = reason
+	if err := Sessions.Save(session); err != nil {
+		return err
+	}
+
+	_, err = CompleteSession(ctx, session.Channel, session.UID, session.RID, session.SID, principal, result.Files())
+	return err
+}
+
+// ScheduleAutoStop stops the session at its StopAt deadline. Deadlines that
+// have already passed fire immediately.
+func ScheduleAutoStop(session Session) {
+	if session.StopAt == nil || session.Status != SessionRecording {
+		return
+	}
+	scheduleAutoStop(session.SID, time.Until(*session.StopAt), 0)
+}
+
+// scheduleAutoStop runs the attempt-th try to stop sid after delay
+func scheduleAutoStop(sid string, delay time.Duration, attempt int) {
+	timer := time.AfterFunc(delay, func() {
+		runJob(func() { autoStop(sid, attempt) })
+	})
+
+	autoStopsMu.Lock()
+	if previous, ok := autoStops[sid]; ok {
+		previous.Stop()
+	}
+	autoStops[sid] = timer
+	autoStopsMu.Unlock()
+}
+
+// retryDelay returns how long to wait before retrying a failed attempt,
+// doubling from initial up to max
+func retryDelay(attempt int, initial time.Duration, max time.Duration) time.Duration {
+	delay := initial
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// autoStop stops the session sid when its deadline is reached. Failures are
+// retried until the stop succeeds or Agora no longer knows the recording.
+func autoStop(sid string, attempt int) {
+	autoStopsMu.Lock()
+	delete(autoStops, sid)
+	autoStopsMu.Unlock()
+
+	// the session may have been stopped since it was scheduled
+	current, ok, err := Sessions.Get(sid)
+	if err != nil {
+		LogEvent(ServerContext(), "auto-stop", "reading session failed", Fields{"sid": sid, "error": err.Error()})
+		return
+	}
+	if !ok || current.Status != SessionRecording {
+		return
+	}
+
+	ctx := sessionLogContext(ServerContext(), current)
+	err = StopSession(ctx, current, autoStopPrincipal, "max duration reached")
+	switch {
+	case err == nil:
+		LogEvent(ctx, "auto-stop", "stopped", nil)
+	case cloudrecording.NotFound(err):
+		// the recording already ended, on its own or through a stop made
+		// meanwhile, which must not be overwritten
+		current, changed, err := Sessions.Update(sid, func(session *Session) bool {
+			if session.Status != SessionRecording {
+				return false
+			}
+			session.EndReason = "max duration reached, not found on Agora"
+			return true
+		})
+		if err != nil {
+			LogEvent(ctx, "auto-stop", "saving session failed", Fields{"error": err.Error()})
+			return
+		}
+		if !changed {
+			return
+		}
+		tenantCtx, err := withTenantID(ctx, current.Tenant)
+		if err != nil {
+			LogEvent(ctx, "auto-stop", "writing manifest failed", Fields{"error": err.Error()})
+			return
+		}
+		if _, err := CompleteSession(tenantCtx, current.Channel, current.UID, current.RID, sid, autoStopPrincipal, nil); err != nil {
+			LogEvent(tenantCtx, "auto-stop", "writing manifest failed", Fields{"error": err.Error()})
+		}
+	case ctx.Err() != nil:
+		// the deadline is picked up again by ResumeAutoStops on the next boot
+		LogEvent(ctx, "auto-stop", "stop failed", Fields{"error": err.Error()})
+	default:
+		delay := retryDelay(attempt, autoStopRetryInitial, autoStopRetryMax)
+		LogEvent(ctx, "auto-stop", "stop failed", Fields{"error": err.Error(), "retry_in": delay.String()})
+		scheduleAutoStop(sid, delay, attempt+1)
+	}
+}
+
+// ResumeAutoStops reattaches to the recordings left running by the last
+// shutdown and reschedules their deadlines. It is called once at startup.
+func ResumeAutoStops() error {
+	sessions, err := Sessions.List()
+	if err != nil {
+		return err
+	}
+	running := 0
+	for _, session := range sessions {
+		if session.Status == SessionRecording {
+			running++
+		}
+		ScheduleAutoStop(session)
+	}
+	if running > 0 {
+		log.Printf("auto-stop: resumed %d recordings left running", running)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// waitForStop waits until the session sid is no longer recording and the
+// stop is done
+func waitForStop(t *testing.T, sid string) Session {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if session, _, _ := Sessions.Get(sid); session.Status != SessionRecording {
+			// let the job write the manifest before the bucket goes away
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := waitForJobs(ctx); err != nil {
+				t.Fatal(err)
+			}
+			return session
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s still recording", sid)
+	return Session{}
+}
+
+func TestAutoStopRetries(t *testing.T) {
+	fake, _, _ := newTestAgora(t)
+	initial, max := autoStopRetryInitial, autoStopRetryMax
+	autoStopRetryInitial, autoStopRetryMax = 10*time.Millisecond, 20*time.Millisecond
+	defer func() { autoStopRetryInitial, autoStopRetryMax = initial, max }()
+
+	fake.Fail(cloudrecording.OpStop, cloudrecording.Error{StatusCode: http.StatusBadRequest, Code: 2, Reason: "invalid parameter"}, 2)
+	_, session, err := StartSession(context.Background(), "demo", DefaultTranscodingConfig, 50*time.Millisecond, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := waitForStop(t, session.SID)
+	if stopped.Status != SessionStopped || stopped.StoppedBy != autoStopPrincipal || stopped.EndReason != "max duration reached" {
+		t.Errorf("session = %+v, want it stopped on deadline", stopped)
+	}
+	if got := fake.Calls(cloudrecording.OpStop); got != 3 {
+		t.Errorf("stop calls = %d, want two failures and a success", got)
+	}
+	if recording, _ := fake.Recording(session.SID); !cloudrecording.Ended(recording.Status) {
+		t.Errorf("recording status %d on Agora, want it stopped", recording.Status)
+	}
+}
+
+func TestAutoStopEndedOnAgora(t *testing.T) {
+	fake, _, _ := newTestAgora(t)
+
+	_, session, err := StartSession(context.Background(), "demo", DefaultTranscodingConfig, 50*time.Millisecond, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.End(session.SID, 20)
+
+	// the recording is gone, so the deadline completes the session instead
+	// of retrying
+	stopped := waitForStop(t, session.SID)
+	if stopped.Status != SessionStopped || stopped.StoppedBy != autoStopPrincipal {
+		t.Errorf("session = %+v, want it completed by auto-stop", stopped)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := fake.Calls(cloudrecording.OpStop); got != 1 {
+		t.Errorf("stop calls = %d, want one", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt, want := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		if got := retryDelay(attempt, 5*time.Second, time.Minute); got != want {
+			t.Errorf("attempt %d: delay %s, want %s", attempt, got, want)
+		}
+	}
+	if got := retryDelay(100, 5*time.Second, time.Minute); got != time.Minute {
+		t.Errorf("delay %s, want capped at a minute", got)
+	}
+}
@@ -0,0 +1,359 @@
+package utils
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	"github.com/spf13/viper"
+)
+
+// Config is the configuration of the service. Keys match config.json and
+// the environment variables that override it. Fields tagged secret are
+// redacted from logs; those tagged restart keep their value on reload.
+type Config struct {
+	Port int `mapstructure:"PORT" restart:"true"`
+
+	AppID               string `mapstructure:"APP_ID"`
+	AppCertificate      string `mapstructure:"APP_CERTIFICATE" secret:"true"`
+	CustomerID          string `mapstructure:"CUSTOMER_ID" secret:"true"`
+	CustomerCertificate string `mapstructure:"CUSTOMER_CERTIFICATE" secret:"true"`
+	AgoraBaseURL        string `mapstructure:"AGORA_BASE_URL"`
+	NCSSecret           string `mapstructure:"NCS_SECRET" secret:"true"`
+
+	RecordingVendor    int    `mapstructure:"RECORDING_VENDOR"`
+	RecordingRegion    int    `mapstructure:"RECORDING_REGION"`
+	BucketName         string `mapstructure:"BUCKET_NAME"`
+	BucketAccessKey    string `mapstructure:"BUCKET_ACCESS_KEY" secret:"true"`
+	BucketAccessSecret string `mapstructure:"BUCKET_ACCESS_SECRET" secret:"true"`
+	S3Endpoint         string `mapstructure:"S3_ENDPOINT"`
+
+	TranscodingPresets  map[string]TranscodingConfig `mapstructure:"TRANSCODING_PRESETS"`
+	MaxRecordingSeconds int                          `mapstructure:"MAX_RECORDING_SECONDS"`
+	Tenants             map[string]Tenant            `mapstructure:"TENANTS"`
+
+	MaxConcurrentRecordings   int `mapstructure:"MAX_CONCURRENT_RECORDINGS"`
+	MaxRecordingMinutesPerDay int `mapstructure:"MAX_RECORDING_MINUTES_PER_DAY"`
+	TokenRatePerMinute        int `mapstructure:"TOKEN_RATE_PER_MINUTE"`
+	StartRatePerMinute        int `mapstructure:"START_RATE_PER_MINUTE"`
+
+	RetentionIntervalMinutes int             `mapstructure:"RETENTION_INTERVAL_MINUTES" restart:"true"`
+	RetentionDryRun          bool            `mapstructure:"RETENTION_DRY_RUN"`
+	RetentionRules           []RetentionRule `mapstructure:"RETENTION_RULES"`
+
+	PlaylistURLExpirySeconds int    `mapstructure:"PLAYLIST_URL_EXPIRY_SECONDS"`
+	ConsolidateMP4           bool   `mapstructure:"CONSOLIDATE_MP4"`
+	ConsolidationStorePath   string `mapstructure:"CONSOLIDATION_STORE_PATH" restart:"true"`
+
+	SessionStorePath         string `mapstructure:"SESSION_STORE_PATH" restart:"true"`
+	StatusPollSeconds        int    `mapstructure:"STATUS_POLL_SECONDS"`
+	ReconcileIntervalSeconds int    `mapstructure:"RECONCILE_INTERVAL_SECONDS" restart:"true"`
+	MaxSessionMinutes        int    `mapstructure:"MAX_SESSION_MINUTES"`
+	ReconcileAutoStop        bool   `mapstructure:"RECONCILE_AUTO_STOP"`
+
+	ScheduleStorePath string           `mapstructure:"SCHEDULE_STORE_PATH" restart:"true"`
+	AutoRecordRules   []AutoRecordRule `mapstructure:"AUTO_RECORD_RULES"`
+
+	AgoraRetry cloudrecording.RetryPolicy `mapstructure:"AGORA_RETRY"`
+	Timeouts   map[string]int             `mapstructure:"TIMEOUTS"`
+
+	ShutdownTimeoutSeconds int  `mapstructure:"SHUTDOWN_TIMEOUT_SECONDS"`
+	ShutdownStopRecordings bool `mapstructure:"SHUTDOWN_STOP_RECORDINGS"`
+
+	AuditLogPath string `mapstructure:"AUDIT_LOG_PATH"`
+
+	OTLPEndpoint string `mapstructure:"OTLP_ENDPOINT" restart:"true"`
+	OTLPInsecure bool   `mapstructure:"OTLP_INSECURE" restart:"true"`
+
+	// the arguments and file the config was loaded from, for reloads
+	args []string
+	path string
+}
+
+// DefaultConfig returns the configuration used for keys that are not set
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                     3000,
+		AgoraBaseURL:             cloudrecording.DefaultBaseURL,
+		RecordingVendor:          1,
+		RetentionDryRun:          true,
+		PlaylistURLExpirySeconds: 3600,
+		SessionStorePath:         "sessions.json",
+		StatusPollSeconds:        5,
+		ScheduleStorePath:        "schedules.json",
+		ConsolidationStorePath:   "consolidations.json",
+		AgoraRetry:               cloudrecording.DefaultRetryPolicy,
+		ShutdownTimeoutSeconds:   30,
+		AuditLogPath:             "audit.log",
+		TokenRatePerMinute:       60,
+		StartRatePerMinute:       10,
+	}
+}
+
+var currentConfig atomic.Value
+
+// SetConfig makes cfg the configuration used by the service
+func SetConfig(cfg *Config) {
+	currentConfig.Store(cfg)
+}
+
+// CurrentConfig returns the configuration set by SetConfig, or the defaults
+func CurrentConfig() *Config {
+	if cfg, ok := currentConfig.Load().(*Config); ok {
+		return cfg
+	}
+	return DefaultConfig()
+}
+
+// keyValueFlags collects repeated -set KEY=VALUE flags
+type keyValueFlags map[string]string
+
+func (f keyValueFlags) String() string {
+	return ""
+}
+
+func (f keyValueFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.New("expected KEY=VALUE")
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// LoadConfig reads the configuration from the config file, then environment
+// variables named like its top-level keys, then the command line flags, and
+// validates it. The file named by -config is optional unless set
+// explicitly. Secrets may be given as file:<path> or env:<VAR> references.
+func LoadConfig(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("recording", flag.ContinueOnError)
+	path := flags.String("config", "config.json", "config file")
+	port := flags.Int("port", 0, "port to listen on, overrides PORT")
+	overrides := keyValueFlags{}
+	flags.Var(overrides, "set", "override a config key, as KEY=VALUE (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(*path)
+	v.SetConfigType("json")
+
+	// scalar keys need a default for environment variables to apply
+	cfg := DefaultConfig()
+	defaults := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < defaults.NumField(); i++ {
+		if defaults.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		switch defaults.Field(i).Kind() {
+		case reflect.String, reflect.Int, reflect.Bool:
+			v.SetDefault(defaults.Type().Field(i).Tag.Get("mapstructure"), defaults.Field(i).Interface())
+		}
+	}
+
+	explicit := false
+	flags.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "config"
+	})
+	if err := v.ReadInConfig(); err != nil {
+		if !os.IsNotExist(err) || explicit {
+			return nil, fmt.Errorf("config file %s: %s", *path, err)
+		}
+	}
+	v.AutomaticEnv()
+
+	for key, value := range overrides {
+		v.Set(key, value)
+	}
+	if *port != 0 {
+		v.Set("PORT", *port)
+	}
+
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	cfg.args = args
+	cfg.path = *path
+	return cfg, nil
+}
+
+// resolveSecret returns the value a secret reference points to: the
+// trimmed contents of file:<path> or the variable named by env:<VAR>.
+// Other values are returned as they are.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " is not set")
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces every secret reference with the secret
+func (cfg *Config) resolveSecrets() error {
+	resolve := func(secrets map[string]*string) error {
+		for name, value := range secrets {
+			secret, err := resolveSecret(*value)
+			if err != nil {
+				return fmt.Errorf("config: %s: %s", name, err)
+			}
+			*value = secret
+		}
+		return nil
+	}
+
+	err := resolve(map[string]*string{
+		"APP_CERTIFICATE":      &cfg.AppCertificate,
+		"CUSTOMER_CERTIFICATE": &cfg.CustomerCertificate,
+		"BUCKET_ACCESS_KEY":    &cfg.BucketAccessKey,
+		"BUCKET_ACCESS_SECRET": &cfg.BucketAccessSecret,
+		"NCS_SECRET":           &cfg.NCSSecret,
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, tenant := range cfg.Tenants {
+		prefix := "TENANTS." + id + "."
+		err := resolve(map[string]*string{
+			prefix + "app_certificate":       &tenant.AppCertificate,
+			prefix + "customer_certificate":  &tenant.CustomerCertificate,
+			prefix + "ncs_secret":            &tenant.NCSSecret,
+			prefix + "storage.access_key":    &tenant.Storage.AccessKey,
+			prefix + "storage.access_secret": &tenant.Storage.AccessSecret,
+		})
+		if err != nil {
+			return err
+		}
+		cfg.Tenants[id] = tenant
+	}
+	return nil
+}
+
+// storageID identifies a bucket by its endpoint and name
+func storageID(endpoint string, bucket string) string {
+	return strings.TrimSuffix(endpoint, "/") + " " + bucket
+}
+
+// Validate reports every missing or invalid setting at once
+func (cfg *Config) Validate() error {
+	var problems []string
+	required := func(name string, value string) {
+		if value == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+	storage := func(vendorKey string, vendor int, regionKey string, region int) {
+		if vendor < 0 {
+			problems = append(problems, vendorKey+" must be a non-negative number")
+		}
+		if _, ok := Regions[region]; !ok {
+			problems = append(problems, fmt.Sprintf("%s %d is not a known region", regionKey, region))
+		}
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT %d is out of range", cfg.Port))
+	}
+
+	required("APP_ID", cfg.AppID)
+	required("APP_CERTIFICATE", cfg.AppCertificate)
+	required("CUSTOMER_ID", cfg.CustomerID)
+	required("CUSTOMER_CERTIFICATE", cfg.CustomerCertificate)
+	required("BUCKET_NAME", cfg.BucketName)
+	required("BUCKET_ACCESS_KEY", cfg.BucketAccessKey)
+	required("BUCKET_ACCESS_SECRET", cfg.BucketAccessSecret)
+	storage("RECORDING_VENDOR", cfg.RecordingVendor, "RECORDING_REGION", cfg.RecordingRegion)
+	if len(cfg.AutoRecordRules) > 0 && cfg.NCSSecret == "" {
+		problems = append(problems, "NCS_SECRET is required with AUTO_RECORD_RULES")
+	}
+
+	// recording listings, deletes and the proxy cover a whole bucket, so
+	// tenants must not share one
+	bucketOwners := map[string]string{storageID(cfg.S3Endpoint, cfg.BucketName): "BUCKET_NAME"}
+
+	var ids []string
+	for id := range cfg.Tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		tenant := cfg.Tenants[id]
+		prefix := "TENANTS." + id + "."
+		if id == DefaultTenantID {
+			problems = append(problems, "TENANTS."+id+" is reserved for the top-level settings")
+		}
+		required(prefix+"app_id", tenant.AppID)
+		required(prefix+"app_certificate", tenant.AppCertificate)
+		required(prefix+"customer_id", tenant.CustomerID)
+		required(prefix+"customer_certificate", tenant.CustomerCertificate)
+		required(prefix+"storage.bucket", tenant.Storage.Bucket)
+		required(prefix+"storage.access_key", tenant.Storage.AccessKey)
+		required(prefix+"storage.access_secret", tenant.Storage.AccessSecret)
+		storage(prefix+"storage.vendor", tenant.Storage.Vendor, prefix+"storage.region", tenant.Storage.Region)
+		if tenant.Storage.Bucket != "" {
+			bucket := storageID(tenant.Storage.Endpoint, tenant.Storage.Bucket)
+			if owner, ok := bucketOwners[bucket]; ok {
+				problems = append(problems, prefix+"storage.bucket is already used by "+owner)
+			}
+			bucketOwners[bucket] = prefix + "storage.bucket"
+		}
+		if tenant.Recording.MaxConcurrentRecordings < 0 || tenant.Recording.MaxMinutesPerDay < 0 {
+			problems = append(problems, prefix+"recording quotas must not be negative")
+		}
+	}
+
+	for op, seconds := range cfg.Timeouts {
+		if seconds < 0 {
+			problems = append(problems, "TIMEOUTS."+op+" must not be negative")
+		}
+	}
+	for name, value := range map[string]int{
+		"MAX_RECORDING_SECONDS":         cfg.MaxRecordingSeconds,
+		"RETENTION_INTERVAL_MINUTES":    cfg.RetentionIntervalMinutes,
+		"PLAYLIST_URL_EXPIRY_SECONDS":   cfg.PlaylistURLExpirySeconds,
+		"STATUS_POLL_SECONDS":           cfg.StatusPollSeconds,
+		"RECONCILE_INTERVAL_SECONDS":    cfg.ReconcileIntervalSeconds,
+		"MAX_SESSION_MINUTES":           cfg.MaxSessionMinutes,
+		"SHUTDOWN_TIMEOUT_SECONDS":      cfg.ShutdownTimeoutSeconds,
+		"MAX_CONCURRENT_RECORDINGS":     cfg.MaxConcurrentRecordings,
+		"MAX_RECORDING_MINUTES_PER_DAY": cfg.MaxRecordingMinutesPerDay,
+		"TOKEN_RATE_PER_MINUTE":         cfg.TokenRatePerMinute,
+		"START_RATE_PER_MINUTE":         cfg.StartRatePerMinute,
+	} {
+		if value < 0 {
+			problems = append(problems, name+" must not be negative")
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New("invalid config: " + strings.Join(problems, "; "))
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes data to name in a temporary directory
+func writeTestFile(t *testing.T, name string, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setTestEnv sets an environment variable for the rest of the test
+func setTestEnv(t *testing.T, key string, value string) {
+	os.Setenv(key, value)
+	t.Cleanup(func() { os.Unsetenv(key) })
+}
+
+const testConfigFile = `{
+  "APP_ID": "file-app",
+  "APP_CERTIFICATE": "env:TEST_APP_CERTIFICATE",
+  "CUSTOMER_ID": "customer",
+  "CUSTOMER_CERTIFICATE": "file:%s",
+  "RECORDING_REGION": "4",
+  "BUCKET_NAME": "file-bucket",
+  "BUCKET_ACCESS_KEY": "key",
+  "BUCKET_ACCESS_SECRET": "secret",
+  "TIMEOUTS": { "updateLayout": 7 },
+  "TENANTS": {
+    "Acme": {
+      "app_id": "acme-app",
+      "app_certificate": "acme-cert",
+      "customer_id": "acme-customer",
+      "customer_certificate": "env:TEST_ACME_CERTIFICATE",
+      "storage": { "bucket": "acme", "access_key": "k", "access_secret": "s" }
+    }
+  }
+}`
+
+func TestLoadConfig(t *testing.T) {
+	certificate := writeTestFile(t, "certificate", "from-file\n")
+	path := writeTestFile(t, "config.json", strings.Replace(testConfigFile, "%s", certificate, 1))
+	setTestEnv(t, "TEST_APP_CERTIFICATE", "from-env")
+	setTestEnv(t, "TEST_ACME_CERTIFICATE", "acme-from-env")
+	setTestEnv(t, "APP_ID", "env-app")
+	setTestEnv(t, "BUCKET_NAME", "env-bucket")
+
+	cfg, err := LoadConfig([]string{"-config", path, "-port", "8080", "-set", "BUCKET_NAME=flag-bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.AppID != "env-app" || cfg.BucketName != "flag-bucket" || cfg.Port != 8080 {
+		t.Errorf("overrides: APP_ID %q, BUCKET_NAME %q, PORT %d", cfg.AppID, cfg.BucketName, cfg.Port)
+	}
+	if cfg.AppCertificate != "from-env" || cfg.CustomerCertificate != "from-file" {
+		t.Errorf("secrets: APP_CERTIFICATE %q, CUSTOMER_CERTIFICATE %q", cfg.AppCertificate, cfg.CustomerCertificate)
+	}
+	if cfg.RecordingRegion != 4 || cfg.PlaylistURLExpirySeconds != 3600 {
+		t.Errorf("RECORDING_REGION %d, PLAYLIST_URL_EXPIRY_SECONDS %d", cfg.RecordingRegion, cfg.PlaylistURLExpirySeconds)
+	}
+
+	setTestConfig(t, cfg)
+	if got := OperationTimeout(OpUpdateLayout); got != 7*time.Second {
+		t.Errorf("updateLayout timeout = %s", got)
+	}
+	tenant, ok := GetTenant("ACME")
+	if !ok || tenant.CustomerCertificate != "acme-from-env" || tenant.Storage.Bucket != "acme" {
+		t.Errorf("tenant = %+v", tenant)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	path := writeTestFile(t, "config.json", `{"PORT": 70000, "RECORDING_REGION": 99, "AUTO_RECORD_RULES": [{"pattern": "class-*"}], "TENANTS": {"acme": {"app_id": "acme"}, "beta": {"storage": {"bucket": "shared"}}, "gamma": {"storage": {"bucket": "shared"}}}}`)
+
+	_, err := LoadConfig([]string{"-config", path})
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, problem := range []string{
+		"PORT 70000 is out of range",
+		"APP_ID is required",
+		"CUSTOMER_CERTIFICATE is required",
+		"RECORDING_REGION 99 is not a known region",
+		"NCS_SECRET is required with AUTO_RECORD_RULES",
+		"TENANTS.acme.storage.bucket is required",
+		"TENANTS.gamma.storage.bucket is already used by TENANTS.beta.storage.bucket",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q does not report %q", err, problem)
+		}
+	}
+
+	if _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("missing config file named by -config accepted")
+	}
+
+	path = writeTestFile(t, "config.json", `{"APP_CERTIFICATE": "env:TEST_UNSET_SECRET"}`)
+	if _, err := LoadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "TEST_UNSET_SECRET") {
+		t.Errorf("unset secret variable: err = %v", err)
+	}
+}
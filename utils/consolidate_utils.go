@@ -0,0 +1,408 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/remux"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrPlaylistIncomplete is returned while Agora is still uploading a session
+var ErrPlaylistIncomplete = errors.New("playlist is not finished yet")
+
+const (
+	consolidateAttempts = 10
+	consolidateDelay    = 30 * time.Second
+)
+
+var (
+	consolidating   = map[string]bool{}
+	consolidatingMu sync.Mutex
+
+	// deferredMu guards the file of consolidations left for the next start
+	deferredMu sync.Mutex
+)
+
+// deferredConsolidation is a consolidation a shutdown left for the next
+// start
+type deferredConsolidation struct {
+	Tenant  string `json:"tenant"`
+	Channel string `json:"channel"`
+	SID     string `json:"sid"`
+}
+
+func consolidationStorePath() string {
+	if path := CurrentConfig().ConsolidationStorePath; path != "" {
+		return path
+	}
+	return "consolidations.json"
+}
+
+// FindSessionPlaylist returns the key of the mix mode playlist Agora wrote
+// for sid under channel. Agora names it <sid>_<channel>.m3u8.
+func FindSessionPlaylist(ctx context.Context, channel string, sid string) (string, error) {
+	objects, err := listObjects(ctx, newS3Client(ctx), strings.Trim(channel, "/")+"/")
+	if err != nil {
+		return "", err
+	}
+
+	for _, object := range objects {
+		key := aws.ToString(object.Key)
+		if strings.HasSuffix(key, ".m3u8") && strings.HasPrefix(path.Base(key), sid+"_") {
+			return key, nil
+		}
+	}
+	return "", ErrPlaylistNotFound
+}
+
+// playlistSegment is a segment of a playlist. Discontinuity is set when
+// its timestamps do not follow those of the segment before.
+type playlistSegment struct {
+	Key           string
+	Discontinuity bool
+}
+
+// playlistSegments returns the segments of a finished playlist in order
+func playlistSegments(playlist []byte, dir string) ([]playlistSegment, error) {
+	var segments []playlistSegment
+	finished := false
+	discontinuity := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "#EXT-X-ENDLIST":
+			finished = true
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case !strings.HasPrefix(line, "#") && isRelativeURI(line):
+			key, err := resolveURI(line, dir, func(key string) (string, error) { return key, nil })
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, playlistSegment{Key: key, Discontinuity: discontinuity})
+			discontinuity = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !finished {
+		return nil, ErrPlaylistIncomplete
+	}
+
+	return segments, nil
+}
+
+var (
+	// consolidated MP4s larger than multipartThreshold are uploaded in
+	// parts of multipartPartSize, the S3 minimum being 5 MiB
+	multipartThreshold int64 = 64 << 20
+	multipartPartSize  int64 = 16 << 20
+)
+
+// ConsolidatePlaylist remuxes the segments of an HLS playlist into one MP4
+// stored next to it and returns the MP4 key. Segments are streamed through
+// temporary files, so memory use does not grow with the recording.
+func ConsolidatePlaylist(ctx context.Context, playlistKey string) (string, error) {
+	client := newS3Client(ctx)
+
+	playlist, err := readObject(ctx, client, playlistKey)
+	if err != nil {
+		return "", err
+	}
+
+	segments, err := playlistSegments(playlist, path.Dir(playlistKey))
+	if err != nil {
+		return "", err
+	}
+
+	media, err := tempFile("consolidate-media-")
+	if err != nil {
+		return "", err
+	}
+	defer removeTempFile(media)
+
+	sink := bufio.NewWriter(media)
+	demuxer := remux.NewDemuxer(sink)
+	for _, segment := range segments {
+		if segment.Discontinuity {
+			if err := demuxer.Discontinuity(); err != nil {
+				return "", err
+			}
+		}
+		if err := demuxSegment(ctx, client, segment.Key, demuxer); err != nil {
+			return "", err
+		}
+	}
+	if err := demuxer.Flush(); err != nil {
+		return "", err
+	}
+	if err := sink.Flush(); err != nil {
+		return "", err
+	}
+	if _, err := media.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	mp4, err := tempFile("consolidate-mp4-")
+	if err != nil {
+		return "", err
+	}
+	defer removeTempFile(mp4)
+
+	out := bufio.NewWriter(mp4)
+	if err := remux.WriteMP4(out, demuxer, bufio.NewReader(media)); err != nil {
+		return "", err
+	}
+	if err := out.Flush(); err != nil {
+		return "", err
+	}
+	size, err := mp4.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+
+	mp4Key := strings.TrimSuffix(playlistKey, ".m3u8") + ".mp4"
+	if err := uploadFile(ctx, client, mp4Key, mp4, size); err != nil {
+		return "", err
+	}
+	return mp4Key, nil
+}
+
+func tempFile(prefix string) (*os.File, error) {
+	return ioutil.TempFile("", prefix)
+}
+
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// demuxSegment streams one TS segment into the demuxer
+func demuxSegment(ctx context.Context, client *s3.Client, key string, demuxer *remux.Demuxer) error {
+	ctx, cancel := operationContext(ctx, OpRead)
+	defer cancel()
+
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName(ctx)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return demuxer.Write(bufio.NewReader(resp.Body))
+}
+
+// uploadFile stores the first size bytes of f under key, in parts when it
+// is larger than multipartThreshold. A failed multipart upload is aborted
+// so its parts are not billed.
+func uploadFile(ctx context.Context, client *s3.Client, key string, f *os.File, size int64) error {
+	if size <= multipartThreshold {
+		putCtx, cancel := operationContext(ctx, OpWrite)
+		defer cancel()
+
+		_, err := client.PutObject(putCtx, &s3.PutObjectInput{
+			Bucket:        aws.String(bucketName(ctx)),
+			Key:           aws.String(key),
+			Body:          io.NewSectionReader(f, 0, size),
+			ContentLength: size,
+			ContentType:   aws.String(ContentTypeFor(key)),
+		})
+		return err
+	}
+
+	createCtx, cancel := operationContext(ctx, OpWrite)
+	created, err := client.CreateMultipartUpload(createCtx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucketName(ctx)),
+		Key:         aws.String(key),
+		ContentType: aws.String(ContentTypeFor(key)),
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	var parts []types.CompletedPart
+	for offset, number := int64(0), int32(1); offset < size; offset, number = offset+multipartPartSize, number+1 {
+		length := multipartPartSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		partCtx, cancel := operationContext(ctx, OpWrite)
+		part, err := client.UploadPart(partCtx, &s3.UploadPartInput{
+			Bucket:        aws.String(bucketName(ctx)),
+			Key:           aws.String(key),
+			UploadId:      created.UploadId,
+			PartNumber:    number,
+			Body:          io.NewSectionReader(f, offset, length),
+			ContentLength: length,
+		})
+		cancel()
+		if err != nil {
+			abortUpload(ctx, client, key, created.UploadId)
+			return err
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: number})
+	}
+
+	completeCtx, cancel := operationContext(ctx, OpWrite)
+	defer cancel()
+	_, err = client.CompleteMultipartUpload(completeCtx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucketName(ctx)),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abortUpload(ctx, client, key, created.UploadId)
+	}
+	return err
+}
+
+func abortUpload(ctx context.Context, client *s3.Client, key string, uploadID *string) {
+	ctx, cancel := operationContext(ctx, OpDelete)
+	defer cancel()
+
+	_, err := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName(ctx)),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("consolidate: abort upload of %s: %s", key, err)
+	}
+}
+
+// deferConsolidation records a consolidation for ResumeConsolidations
+func deferConsolidation(tenantID string, channel string, sid string) {
+	deferredMu.Lock()
+	defer deferredMu.Unlock()
+
+	deferred := map[string]deferredConsolidation{}
+	err := readJSONFile(consolidationStorePath(), &deferred)
+	if err == nil {
+		deferred[tenantID+"/"+sid] = deferredConsolidation{Tenant: tenantID, Channel: channel, SID: sid}
+		err = writeJSONFile(consolidationStorePath(), deferred)
+	}
+	if err != nil {
+		log.Printf("consolidate: %s/%s: keeping for the next start: %s", channel, sid, err)
+		return
+	}
+	log.Printf("consolidate: %s/%s left for the next start", channel, sid)
+}
+
+// ResumeConsolidations schedules the consolidations the last shutdown left
+// behind. It is called once at startup.
+func ResumeConsolidations() error {
+	deferredMu.Lock()
+	deferred := map[string]deferredConsolidation{}
+	err := readJSONFile(consolidationStorePath(), &deferred)
+	if err == nil && len(deferred) > 0 {
+		err = writeJSONFile(consolidationStorePath(), map[string]deferredConsolidation{})
+	}
+	deferredMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range deferred {
+		tenant, ok := GetTenant(job.Tenant)
+		if !ok {
+			log.Printf("consolidate: %s/%s: tenant %s is no longer configured", job.Channel, job.SID, job.Tenant)
+			continue
+		}
+		ScheduleConsolidation(tenant, job.Channel, job.SID)
+	}
+	return nil
+}
+
+// ScheduleConsolidation builds the MP4 for a stopped session of tenant in
+// the background, waiting for Agora to finish uploading the playlist. It
+// does nothing unless CONSOLIDATE_MP4 is set, and at most one job runs per
+// sid. Waiting for the upload could hold up a shutdown until its timeout, so
+// jobs scheduled or still waiting once draining starts are left for
+// ResumeConsolidations on the next start instead.
+func ScheduleConsolidation(tenant Tenant, channel string, sid string) {
+	if !CurrentConfig().ConsolidateMP4 || sid == "" {
+		return
+	}
+	// the job outlives the request that scheduled it
+	tenantID, channel, sid := copyString(tenant.ID), copyString(channel), copyString(sid)
+
+	select {
+	case <-Draining():
+		deferConsolidation(tenantID, channel, sid)
+		return
+	default:
+	}
+
+	job := tenantID + "/" + sid
+	consolidatingMu.Lock()
+	if consolidating[job] {
+		consolidatingMu.Unlock()
+		return
+	}
+	consolidating[job] = true
+	consolidatingMu.Unlock()
+
+	runJob(func() {
+		defer func() {
+			consolidatingMu.Lock()
+			delete(consolidating, job)
+			consolidatingMu.Unlock()
+		}()
+
+		server := ServerContext()
+		for attempt := 1; attempt <= consolidateAttempts; attempt++ {
+			// looked up on each attempt so reloaded credentials apply
+			ctx, err := withTenantID(server, tenantID)
+			if err != nil {
+				log.Printf("consolidate: %s/%s: %s", channel, sid, err)
+				return
+			}
+			playlistKey, err := FindSessionPlaylist(ctx, channel, sid)
+			if err == nil {
+				var mp4Key string
+				mp4Key, err = ConsolidatePlaylist(ctx, playlistKey)
+				if err == nil {
+					log.Printf("consolidate: wrote %s", mp4Key)
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				// cancelled at the end of a shutdown
+				deferConsolidation(tenantID, channel, sid)
+				return
+			}
+			if err != ErrPlaylistNotFound && err != ErrPlaylistIncomplete {
+				log.Printf("consolidate: %s/%s: %s", channel, sid, err)
+				return
+			}
+			select {
+			case <-Draining():
+				deferConsolidation(tenantID, channel, sid)
+				return
+			case <-time.After(consolidateDelay):
+			}
+		}
+		log.Printf("consolidate: %s/%s: gave up waiting for upload", channel, sid)
+	})
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/s3test"
+)
+
+func TestPlaylistSegments(t *testing.T) {
+	playlist := "#EXTM3U\n#EXTINF:1.0\na.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:1.0\nb.ts\n#EXTINF:1.0\nc.ts\n"
+
+	if _, err := playlistSegments([]byte(playlist), "demo/1"); err != ErrPlaylistIncomplete {
+		t.Fatalf("unfinished playlist: err = %v", err)
+	}
+
+	segments, err := playlistSegments([]byte(playlist+"#EXT-X-ENDLIST\n"), "demo/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []playlistSegment{{Key: "demo/1/a.ts"}, {Key: "demo/1/b.ts", Discontinuity: true}, {Key: "demo/1/c.ts"}}
+	if len(segments) != len(want) {
+		t.Fatalf("segments = %+v", segments)
+	}
+	for i := range want {
+		if segments[i] != want[i] {
+			t.Errorf("segment %d = %+v, want %+v", i, segments[i], want[i])
+		}
+	}
+}
+
+// seedFixtures stores the remux fixtures as a finished recording
+func seedFixtures(t *testing.T, fake *s3test.Server) string {
+	t.Helper()
+
+	now := time.Now()
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:1\n"
+	for i, name := range []string{"seg0.ts", "seg1.ts", "seg2.ts"} {
+		data, err := ioutil.ReadFile(filepath.Join("..", "remux", "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.Put("demo/1620000000/sid_demo_"+name, data, now)
+		if i == 2 {
+			playlist += "#EXT-X-DISCONTINUITY\n"
+		}
+		playlist += "#EXTINF:1.000\nsid_demo_" + name + "\n"
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+
+	key := "demo/1620000000/sid_demo.m3u8"
+	fake.Put(key, []byte(playlist), now)
+	return key
+}
+
+func TestConsolidatePlaylist(t *testing.T) {
+	fake, _ := newTestBucket(t)
+	playlistKey := seedFixtures(t, fake)
+
+	mp4Key, err := ConsolidatePlaylist(context.Background(), playlistKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp4Key != "demo/1620000000/sid_demo.mp4" {
+		t.Errorf("key = %s", mp4Key)
+	}
+	object, ok := fake.Object(mp4Key)
+	if !ok || !bytes.Equal(object.Body[4:8], []byte("ftyp")) || object.ContentType != "video/mp4" {
+		t.Fatalf("stored %s: %v", mp4Key, ok)
+	}
+	if fake.Requests("multipart") != 0 {
+		t.Error("small MP4 uploaded in parts")
+	}
+
+	// the same file again, in parts
+	threshold, partSize := multipartThreshold, multipartPartSize
+	multipartThreshold, multipartPartSize = 1024, 8*1024
+	defer func() { multipartThreshold, multipartPartSize = threshold, partSize }()
+
+	if _, err := ConsolidatePlaylist(context.Background(), playlistKey); err != nil {
+		t.Fatal(err)
+	}
+	parts, _ := fake.Object(mp4Key)
+	if !bytes.Equal(parts.Body, object.Body) {
+		t.Error("multipart upload differs from single upload")
+	}
+	if fake.Requests("multipart") != 1 || fake.Requests("part") != (len(object.Body)+8*1024-1)/(8*1024) {
+		t.Errorf("multipart requests = %d, parts = %d", fake.Requests("multipart"), fake.Requests("part"))
+	}
+	if fake.Uploads() != 0 {
+		t.Error("multipart upload left open")
+	}
+}
+
+// startTestDrain starts draining for the rest of the test, then lets the
+// service run again
+func startTestDrain(t *testing.T) {
+	StartDraining()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := waitForJobs(ctx); err != nil {
+			t.Error(err)
+		}
+		draining = make(chan struct{})
+		drainingOnce = sync.Once{}
+	})
+}
+
+func TestConsolidationDeferredOnShutdown(t *testing.T) {
+	_, _, cfg := newTestAgora(t)
+	cfg.ConsolidateMP4 = true
+	cfg.ConsolidationStorePath = filepath.Join(t.TempDir(), "consolidations.json")
+	tenant, _ := GetTenant("")
+
+	// the playlist is not uploaded yet, so the job waits for it
+	ScheduleConsolidation(tenant, "demo", "waiting")
+	startTestDrain(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := waitForJobs(ctx); err != nil {
+		t.Fatalf("shutdown held up by a consolidation waiting for its upload: %s", err)
+	}
+
+	// jobs scheduled while draining are not started at all
+	ScheduleConsolidation(tenant, "demo", "late")
+
+	var deferred map[string]deferredConsolidation
+	if err := readJSONFile(cfg.ConsolidationStorePath, &deferred); err != nil {
+		t.Fatal(err)
+	}
+	if len(deferred) != 2 || deferred["default/waiting"].Channel != "demo" || deferred["default/late"].SID != "late" {
+		t.Fatalf("deferred = %+v, want both jobs", deferred)
+	}
+
+	// the next start picks them up once
+	draining = make(chan struct{})
+	drainingOnce = sync.Once{}
+	if err := ResumeConsolidations(); err != nil {
+		t.Fatal(err)
+	}
+	consolidatingMu.Lock()
+	resumed := consolidating["default/waiting"] && consolidating["default/late"]
+	consolidatingMu.Unlock()
+	if !resumed {
+		t.Error("deferred consolidations not resumed")
+	}
+	deferred = nil
+	if err := readJSONFile(cfg.ConsolidationStorePath, &deferred); err != nil || len(deferred) != 0 {
+		t.Errorf("deferred = %+v, %v after resuming, want none", deferred, err)
+	}
+	startTestDrain(t)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// Operations with their own timeout, configured in seconds under TIMEOUTS
+const (
+	OpAcquire      = cloudrecording.OpAcquire
+	OpStart        = cloudrecording.OpStart
+	OpQuery        = cloudrecording.OpQuery
+	OpUpdate       = cloudrecording.OpUpdate
+	OpUpdateLayout = cloudrecording.OpUpdateLayout
+	OpStop         = cloudrecording.OpStop
+	OpList         = "list"
+	OpRead         = "read"
+	OpWrite        = "write"
+	OpDelete       = "delete"
+	OpPresign      = "presign"
+)
+
+// DefaultTimeouts is used for operations missing from TIMEOUTS
+var DefaultTimeouts = map[string]int{
+	OpAcquire:      15,
+	OpStart:        30,
+	OpQuery:        10,
+	OpUpdate:       15,
+	OpUpdateLayout: 15,
+	OpStop:         30,
+	OpList:         30,
+	OpRead:         30,
+	OpWrite:        60,
+	OpDelete:       60,
+	OpPresign:      5,
+}
+
+var serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+
+// ServerContext is the parent context of background work. It is cancelled
+// by Shutdown.
+func ServerContext() context.Context {
+	return serverCtx
+}
+
+// Shutdown cancels ServerContext and every Agora or storage call made with it
+func Shutdown() {
+	cancelServerCtx()
+}
+
+// OperationTimeout returns the configured timeout of op
+func OperationTimeout(op string) time.Duration {
+	timeouts := CurrentConfig().Timeouts
+	seconds, ok := timeouts[op]
+	if !ok {
+		// keys read from the config file are lower case
+		seconds = timeouts[strings.ToLower(op)]
+	}
+	if seconds <= 0 {
+		seconds = DefaultTimeouts[op]
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// operationContext bounds a single Agora or storage operation by its timeout
+func operationContext(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	timeout := OperationTimeout(op)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields are the attributes of a structured log line
+type Fields map[string]interface{}
+
+// redacted replaces secrets in log lines
+const redacted = "[redacted]"
+
+var (
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+
+	// fields whose names contain one of these are never logged
+	secretFieldNames = []string{"token", "secret", "certificate", "password", "authorization", "access_key"}
+
+	// Agora access tokens (006 followed by the app ID, or AccessToken2's 007
+	// followed by base64) and HTTP credentials that may show up in messages
+	secretPattern = regexp.MustCompile(`\b006[0-9a-f]{32}[A-Za-z0-9+/=_-]+|\b007[A-Za-z0-9+/_-]{32,}=*|(?i)(basic|bearer) [A-Za-z0-9+/=._-]+`)
+
+	// the "component: " prefix used by the log lines of this service
+	componentPattern = regexp.MustCompile(`^([a-z][a-z-]*): `)
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request it
+// serves
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the request ID of ctx, if any
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields returns a copy of ctx whose log lines carry fields, such as
+// the channel and SID of the recording being worked on
+func WithLogFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	for name, value := range logFieldsFrom(ctx) {
+		merged[name] = value
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// logFieldsFrom returns the log fields of ctx
+func logFieldsFrom(ctx context.Context) Fields {
+	fields, _ := ctx.Value(logFieldsKey{}).(Fields)
+	return fields
+}
+
+// sessionLogContext returns a copy of ctx whose log lines name session
+func sessionLogContext(ctx context.Context, session Session) context.Context {
+	return WithLogFields(ctx, Fields{"channel": session.Channel, "sid": session.SID})
+}
+
+// redact masks secret fields and any token or credential in string values
+func redact(fields Fields) Fields {
+	clean := Fields{}
+	for name, value := range fields {
+		lower := strings.ToLower(name)
+		for _, secret := range secretFieldNames {
+			if strings.Contains(lower, secret) {
+				value = redacted
+				break
+			}
+		}
+		if text, ok := value.(string); ok {
+			value = secretPattern.ReplaceAllString(text, redacted)
+		}
+		clean[name] = value
+	}
+	return clean
+}
+
+// writeLogLine writes fields as one JSON line with its time
+func writeLogLine(fields Fields) {
+	fields = redact(fields)
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		data, _ = json.Marshal(Fields{"time": fields["time"], "msg": "log: " + err.Error()})
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(data, '\n'))
+}
+
+// LogEvent writes a structured log line tagged with the request ID, tenant
+// and log fields of ctx
+func LogEvent(ctx context.Context, component string, msg string, fields Fields) {
+	line := Fields{}
+	for name, value := range logFieldsFrom(ctx) {
+		line[name] = value
+	}
+	for name, value := range fields {
+		line[name] = value
+	}
+	line["component"] = component
+	line["msg"] = msg
+	if id := RequestIDFrom(ctx); id != "" {
+		line["request_id"] = id
+	}
+	if tenant, ok := ctx.Value(tenantKey{}).(Tenant); ok {
+		line["tenant"] = tenant.ID
+	}
+	writeLogLine(line)
+}
+
+// stdLogWriter turns the lines of the standard logger into JSON
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	line := Fields{"msg": msg}
+	if match := componentPattern.FindStringSubmatch(msg); match != nil {
+		line["component"] = match[1]
+		line["msg"] = strings.TrimPrefix(msg, match[0])
+	}
+	writeLogLine(line)
+	return len(p), nil
+}
+
+// SetupLogging makes the standard logger write JSON lines
+func SetupLogging() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
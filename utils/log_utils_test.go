@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLog collects the JSON log lines written for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logMu.Lock()
+	previous := logOutput
+	logOutput = &buf
+	logMu.Unlock()
+	t.Cleanup(func() {
+		logMu.Lock()
+		logOutput = previous
+		logMu.Unlock()
+	})
+	return &buf
+}
+
+func TestLogEventRedacts(t *testing.T) {
+	buf := captureLog(t)
+	token := "006970ca35de60c44645bbae8a215061b33IACZ2mo9lBT5ZdAAp8bdJmvxPqRLDsgSQ1mIOqEM+Ig8tw=="
+	token2 := "007eJxTYDh+ar/L1XUVe9bMuVWhbVr6rSyz4W9kbnR9fPJOdtVfE/wLpsyrL8z6vEkh4dUN3cTi4+Y2Kw=="
+
+	ctx := WithRequestID(WithTenant(context.Background(), Tenant{ID: "acme"}), "req-1")
+	ctx = WithLogFields(ctx, Fields{"sid": "sid-1"})
+	LogEvent(ctx, "agora", "call", Fields{
+		"rtc_token":    "plain",
+		"customer_key": "kept",
+		"error":        "start failed for token " + token + " and " + token2 + " with Basic Y3VzdG9tZXI6c2VjcmV0",
+	})
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q: %s", buf, err)
+	}
+	if line["request_id"] != "req-1" || line["tenant"] != "acme" || line["component"] != "agora" || line["sid"] != "sid-1" {
+		t.Errorf("log line = %v", line)
+	}
+	if line["rtc_token"] != redacted || line["customer_key"] != "kept" {
+		t.Errorf("fields = %v", line)
+	}
+	if text := buf.String(); strings.Contains(text, token) || strings.Contains(text, "eJxTYDh") || strings.Contains(text, "Y3VzdG9tZXI6c2VjcmV0") {
+		t.Errorf("log line %q reveals a secret", text)
+	}
+}
+
+func TestStdLogWriter(t *testing.T) {
+	buf := captureLog(t)
+	logger := log.New(stdLogWriter{}, "", 0)
+
+	logger.Println("auto-stop: stopped sid on demo")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q: %s", buf, err)
+	}
+	if line["component"] != "auto-stop" || line["msg"] != "stopped sid on demo" || line["time"] == nil {
+		t.Errorf("log line = %v", line)
+	}
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// manifestName is the file written into every session prefix at stop time
+const manifestName = "manifest.json"
+
+// Manifest describes a finished recording session
+type Manifest struct {
+	Tenant      string            `json:"tenant,omitempty"`
+	Channel     string            `json:"channel"`
+	BotUID      int               `json:"bot_uid"`
+	RID         string            `json:"rid"`
+	SID         string            `json:"sid"`
+	Mode        string            `json:"mode"`
+	Prefix      string            `json:"prefix"`
+	Transcoding TranscodingConfig `json:"transcoding"`
+	StartedAt   time.Time         `json:"started_at"`
+	StoppedAt   time.Time         `json:"stopped_at"`
+	StartedBy   string            `json:"started_by"`
+	StoppedBy   string            `json:"stopped_by"`
+	Files       []RecordingFile   `json:"files"`
+}
+
+// CompleteSession marks a session stopped in the session store and writes
+// its manifest. Sessions started before the store existed are looked up by
+// their playlist; if that fails too no manifest is written.
+func CompleteSession(ctx context.Context, channel string, uid int, rid string, sid string, stoppedBy string, files []RecordingFile) (*Manifest, error) {
+	return completeSession(ctx, channel, uid, rid, sid, stoppedBy, files, time.Now().UTC())
+}
+
+// completeSession is CompleteSession for a session that stopped at stoppedAt
+func completeSession(ctx context.Context, channel string, uid int, rid string, sid string, stoppedBy string, files []RecordingFile, stoppedAt time.Time) (*Manifest, error) {
+	session, ok, err := Sessions.Get(sid)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		playlistKey, err := FindSessionPlaylist(ctx, channel, sid)
+		if err == ErrPlaylistNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		session = Session{
+			Tenant:  TenantFrom(ctx).ID,
+			Channel: channel,
+			UID:     uid,
+			RID:     rid,
+			SID:     sid,
+			Mode:    cloudrecording.ModeMix,
+			Prefix:  path.Dir(playlistKey) + "/",
+		}
+	}
+
+	if session.Status == SessionRecording {
+		observeRecordingEnded(session, stoppedAt)
+	}
+	session.Status = SessionStopped
+	session.StoppedAt = &stoppedAt
+	session.StoppedBy = stoppedBy
+	if err := Sessions.Save(session); err != nil {
+		return nil, err
+	}
+	Audit(ctx, AuditEvent{
+		Action:    AuditRecordingStop,
+		Principal: stoppedBy,
+		Channel:   session.Channel,
+		UID:       strconv.Itoa(session.UID),
+		SID:       session.SID,
+	})
+
+	manifest := &Manifest{
+		Tenant:      TenantID(session.Tenant),
+		Channel:     session.Channel,
+		BotUID:      session.UID,
+		RID:         session.RID,
+		SID:         session.SID,
+		Mode:        session.Mode,
+		Prefix:      session.Prefix,
+		Transcoding: session.Transcoding,
+		StartedAt:   session.StartedAt,
+		StoppedAt:   stoppedAt,
+		StartedBy:   session.StartedBy,
+		StoppedBy:   stoppedBy,
+		Files:       files,
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	putCtx, cancel := operationContext(ctx, OpWrite)
+	defer cancel()
+
+	_, err = newS3Client(ctx).PutObject(putCtx, &s3.PutObjectInput{
+		Bucket:        aws.String(bucketName(ctx)),
+		Key:           aws.String(session.Prefix + manifestName),
+		Body:          bytes.NewReader(data),
+		ContentLength: int64(len(data)),
+		ContentType:   aws.String("application/json"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// GetManifests returns the manifests of every session stored under channel
+// by the tenant of ctx. Manifests of other tenants sharing the bucket are
+// skipped.
+func GetManifests(ctx context.Context, channel string) ([]Manifest, error) {
+	client := newS3Client(ctx)
+	tenant := TenantFrom(ctx).ID
+
+	objects, err := listObjects(ctx, client, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []Manifest{}
+	for _, object := range objects {
+		key := aws.ToString(object.Key)
+		if !strings.HasSuffix(key, "/"+manifestName) {
+			continue
+		}
+
+		data, err := readObject(ctx, client, key)
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, err
+		}
+		if TenantID(manifest.Tenant) != tenant {
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests, nil
+}
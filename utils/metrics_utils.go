@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// outcomeError labels calls that failed without a response
+const outcomeError = "error"
+
+var (
+	agoraRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "recording_agora_requests_total",
+		Help: "Cloud recording REST API attempts by method and HTTP status code, or error when no response arrived.",
+	}, []string{"method", "code"})
+
+	agoraDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "recording_agora_request_duration_seconds",
+		Help:    "Latency of cloud recording REST API attempts by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// recordingMinutes is gathered by sessionCollector, which first adds the
+	// minutes of running sessions
+	recordingMinutes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "recording_minutes_total",
+		Help: "Minutes recorded by this process, by tenant and mode. Running sessions are counted up to the scrape.",
+	}, []string{"tenant", "mode"})
+
+	tokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "recording_tokens_issued_total",
+		Help: "Tokens issued by type and role.",
+	}, []string{"type", "role"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "recording_storage_request_duration_seconds",
+		Help:    "Latency of object storage requests by operation and HTTP status code, or error when no response arrived.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+
+	activeSessionsDesc = prometheus.NewDesc(
+		"recording_active_sessions",
+		"Sessions in the session store that are recording, by tenant and mode.",
+		[]string{"tenant", "mode"}, nil,
+	)
+)
+
+var (
+	// processStart bounds the minutes counted for sessions that were already
+	// running when this process started
+	processStart = time.Now().UTC()
+
+	accruedMu sync.Mutex
+	// how far the minutes of each running session have been counted
+	accrued = map[string]time.Time{}
+)
+
+func init() {
+	prometheus.MustRegister(sessionCollector{})
+}
+
+// sessionCollector counts the active sessions when metrics are scraped, so
+// the count always matches the session store, and brings the recorded
+// minutes up to date
+type sessionCollector struct{}
+
+func (sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSessionsDesc
+	recordingMinutes.Describe(ch)
+}
+
+func (sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	defer recordingMinutes.Collect(ch)
+
+	sessions, err := Sessions.List()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(activeSessionsDesc, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	active := map[[2]string]int{}
+	for _, session := range sessions {
+		if session.Status == SessionRecording {
+			active[[2]string{TenantID(session.Tenant), session.Mode}]++
+			accrueRecording(session, now)
+		}
+	}
+	for labels, count := range active {
+		ch <- prometheus.MustNewConstMetric(activeSessionsDesc, prometheus.GaugeValue, float64(count), labels[0], labels[1])
+	}
+}
+
+// agoraOutcome returns the HTTP status code of a cloud recording API call
+func agoraOutcome(err error) string {
+	var apiErr *cloudrecording.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.StatusCode)
+	case err != nil:
+		return outcomeError
+	}
+	return strconv.Itoa(http.StatusOK)
+}
+
+// observeAgoraCall records one attempt of a cloud recording API call
+func observeAgoraCall(op string, code string, elapsed time.Duration) {
+	agoraRequests.WithLabelValues(op, code).Inc()
+	agoraDuration.WithLabelValues(op).Observe(elapsed.Seconds())
+}
+
+// accrueRecording adds the minutes session recorded up to t that are not
+// counted yet
+func accrueRecording(session Session, t time.Time) {
+	if session.StartedAt.IsZero() {
+		return
+	}
+
+	accruedMu.Lock()
+	defer accruedMu.Unlock()
+
+	from, ok := accrued[session.SID]
+	if !ok {
+		from = session.StartedAt
+		if from.Before(processStart) {
+			from = processStart
+		}
+	}
+	if !t.After(from) {
+		return
+	}
+	recordingMinutes.WithLabelValues(TenantID(session.Tenant), session.Mode).Add(t.Sub(from).Minutes())
+	accrued[session.SID] = t
+}
+
+// observeRecordingEnded counts the rest of an ended session in the recorded
+// minutes. Minutes already counted past stoppedAt by a scrape are kept.
+func observeRecordingEnded(session Session, stoppedAt time.Time) {
+	accrueRecording(session, stoppedAt)
+
+	accruedMu.Lock()
+	delete(accrued, session.SID)
+	accruedMu.Unlock()
+}
+
+// observeToken counts an issued token
+func observeToken(tokenType string, role string) {
+	tokensIssued.WithLabelValues(tokenType, role).Inc()
+}
+
+// storageMetrics times every request an S3 client sends. It runs after the
+// retry and signing steps, so each attempt is timed on its own and presigned
+// URLs, which never reach it, are not.
+func storageMetrics(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("StorageMetrics", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		begin := time.Now()
+		out, metadata, err := next.HandleFinalize(ctx, in)
+
+		code := outcomeError
+		var respErr *smithyhttp.ResponseError
+		if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+			code = strconv.Itoa(resp.StatusCode)
+		} else if errors.As(err, &respErr) {
+			code = strconv.Itoa(respErr.HTTPStatusCode())
+		}
+		storageDuration.WithLabelValues(awsmiddleware.GetOperationName(ctx), code).Observe(time.Since(begin).Seconds())
+		return out, metadata, err
+	}), middleware.After)
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordingMinutes(t *testing.T) {
+	session := Session{Tenant: "acme", SID: "minutes", Mode: "mix", StartedAt: time.Now().UTC()}
+	counter := recordingMinutes.WithLabelValues("acme", "mix")
+	// the counter is global, so only what this test adds is checked
+	before := testutil.ToFloat64(counter)
+	added := func() float64 { return testutil.ToFloat64(counter) - before }
+
+	accrueRecording(session, session.StartedAt.Add(4*time.Minute))
+	if got := added(); math.Abs(got-4) > 1e-6 {
+		t.Errorf("running session counted %f minutes, want 4", got)
+	}
+
+	// a session found to have ended before the last scrape keeps what was
+	// counted
+	observeRecordingEnded(session, session.StartedAt.Add(3*time.Minute))
+	if got := added(); math.Abs(got-4) > 1e-6 {
+		t.Errorf("ended session counted %f minutes, want 4", got)
+	}
+	if _, ok := accrued[session.SID]; ok {
+		t.Error("ended session still tracked")
+	}
+}
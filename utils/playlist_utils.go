@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrPlaylistNotFound is returned when a session has no .m3u8 playlist
+var ErrPlaylistNotFound = errors.New("no playlist found for session")
+
+// the URI attribute of tags such as EXT-X-KEY and EXT-X-MAP
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// PlaylistExpiry returns how long presigned segment URLs stay valid
+func PlaylistExpiry() time.Duration {
+	seconds := CurrentConfig().PlaylistURLExpirySeconds
+	if seconds <= 0 {
+		seconds = 3600
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// readObject downloads an object from the recording bucket
+func readObject(ctx context.Context, client *s3.Client, key string) ([]byte, error) {
+	ctx, cancel := operationContext(ctx, OpRead)
+	defer cancel()
+
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName(ctx)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// isRelativeURI reports whether a playlist URI is a key relative to the
+// playlist rather than an absolute URL
+func isRelativeURI(uri string) bool {
+	return uri != "" && !strings.Contains(uri, "://")
+}
+
+// resolveURI turns a relative playlist URI into the URL returned by resolve
+// for its key. Keys outside dir are refused, so a playlist cannot point at
+// other recordings.
+func resolveURI(uri string, dir string, resolve func(key string) (string, error)) (string, error) {
+	name, err := url.PathUnescape(uri)
+	if err != nil {
+		return "", fmt.Errorf("playlist URI %q: %s", uri, err)
+	}
+	key := path.Join(dir, name)
+	if !strings.HasPrefix(key, strings.TrimSuffix(dir, "/")+"/") {
+		return "", fmt.Errorf("playlist URI %q is outside the session", uri)
+	}
+	return resolve(key)
+}
+
+// RewritePlaylist replaces every segment line of an HLS playlist, and the
+// URI attribute of tags such as EXT-X-KEY and EXT-X-MAP, with the URL
+// returned by resolve. Relative URIs are resolved against dir and must stay
+// inside it; other tags, comments and absolute URLs are left untouched.
+func RewritePlaylist(playlist []byte, dir string, resolve func(key string) (string, error)) ([]byte, error) {
+	var out bytes.Buffer
+
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var err error
+		switch {
+		case strings.HasPrefix(line, "#"):
+			line = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := uriAttribute.FindStringSubmatch(attr)[1]
+				if !isRelativeURI(uri) || err != nil {
+					return attr
+				}
+				var resolved string
+				resolved, err = resolveURI(uri, dir, resolve)
+				return `URI="` + resolved + `"`
+			})
+		case isRelativeURI(line):
+			line, err = resolveURI(line, dir, resolve)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// PresignedSegments resolves playlist segments to presigned URLs that all
+// stay valid for expires
+func PresignedSegments(ctx context.Context, expires time.Duration) func(key string) (string, error) {
+	psClient := s3.NewPresignClient(newS3Client(ctx), s3.WithPresignExpires(expires))
+	bucket := bucketName(ctx)
+
+	return func(key string) (string, error) {
+		ctx, cancel := operationContext(ctx, OpPresign)
+		defer cancel()
+
+		resp, err := GetPresignedURL(ctx, psClient, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", err
+		}
+		return resp.URL, nil
+	}
+}
+
+// ProxiedSegments resolves playlist segments to URLs under the given proxy
+// route prefix
+func ProxiedSegments(prefix string) func(key string) (string, error) {
+	return func(key string) (string, error) {
+		return strings.TrimSuffix(prefix, "/") + "/" + escapeKey(key), nil
+	}
+}
+
+// escapeKey escapes each segment of an object key for use in a URL path
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// GetSessionPlaylist fetches the playlist of a recording session and points
+// each segment at the URL returned by resolve
+func GetSessionPlaylist(ctx context.Context, channel string, session string, resolve func(key string) (string, error)) ([]byte, error) {
+	client := newS3Client(ctx)
+
+	objects, err := listObjects(ctx, client, sessionPrefix(channel, session))
+	if err != nil {
+		return nil, err
+	}
+
+	playlistKey := ""
+	for _, object := range objects {
+		if strings.HasSuffix(aws.ToString(object.Key), ".m3u8") {
+			playlistKey = aws.ToString(object.Key)
+			break
+		}
+	}
+	if playlistKey == "" {
+		return nil, ErrPlaylistNotFound
+	}
+
+	playlist, err := readObject(ctx, client, playlistKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return RewritePlaylist(playlist, path.Dir(playlistKey), resolve)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewritePlaylist(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:10.000,
+sid_demo_0.ts
+#EXTINF:10.000,
+my%20segment.ts
+#EXTINF:10.000,
+https://cdn.example.com/live.ts
+#EXT-X-ENDLIST
+`
+	resolve := func(key string) (string, error) { return "signed:" + key, nil }
+
+	got, err := RewritePlaylist([]byte(playlist), "demo/1619863200", resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`#EXT-X-KEY:METHOD=AES-128,URI="signed:demo/1619863200/key.bin",IV=0x1`,
+		`#EXT-X-MAP:URI="signed:demo/1619863200/init.mp4"`,
+		"\nsigned:demo/1619863200/sid_demo_0.ts\n",
+		"\nsigned:demo/1619863200/my segment.ts\n",
+		"\nhttps://cdn.example.com/live.ts\n",
+		"#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rewritten playlist lacks %q:\n%s", want, got)
+		}
+	}
+
+	for _, escape := range []string{
+		"#EXTINF:10,\n../1619870000/other.ts\n",
+		"#EXTINF:10,\n../../other/1619870000/other.ts\n",
+		`#EXT-X-MAP:URI="../secret.mp4"` + "\n",
+		"#EXTINF:10,\n%2e%2e/other.ts\n",
+	} {
+		if _, err := RewritePlaylist([]byte("#EXTM3U\n"+escape), "demo/1619863200", resolve); err == nil {
+			t.Errorf("playlist with %q rewritten, want it refused", escape)
+		}
+	}
+}
+
+func TestProxiedSegments(t *testing.T) {
+	resolve := ProxiedSegments("https://example.com/api/proxy/")
+	got, _ := resolve("demo room/1619863200/a#b?c.ts")
+	if got != "https://example.com/api/proxy/demo%20room/1619863200/a%23b%3Fc.ts" {
+		t.Errorf("proxied URL = %s", got)
+	}
+	u, err := url.Parse(got)
+	if err != nil || u.Path != "/api/proxy/demo room/1619863200/a#b?c.ts" {
+		t.Errorf("proxied URL does not round-trip: %v %v", u, err)
+	}
+}
+
+func TestGetSessionPlaylist(t *testing.T) {
+	fake, _ := newTestBucket(t)
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	fake.SeedSession("demo", start, "sid", 2)
+
+	got, err := GetSessionPlaylist(context.Background(), "demo", "1619863200", func(key string) (string, error) { return "/" + key, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(got), "\n/demo/1619863200/sid_demo_"); lines != 2 {
+		t.Errorf("rewritten %d segments, want 2:\n%s", lines, got)
+	}
+
+	if _, err := GetSessionPlaylist(context.Background(), "demo", "1", nil); err != ErrPlaylistNotFound {
+		t.Errorf("missing session: err = %v", err)
+	}
+}
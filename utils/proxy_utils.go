@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ContentTypes maps recording file extensions to the type they are served as
+var ContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+	".aac":  "audio/aac",
+	".webm": "video/webm",
+	".jpg":  "image/jpeg",
+}
+
+// ContentTypeFor returns the content type for a recording file key
+func ContentTypeFor(key string) string {
+	if contentType, ok := ContentTypes[strings.ToLower(path.Ext(key))]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// ObjectStream is an open recording file ready to be proxied to a client
+type ObjectStream struct {
+	Body          io.ReadCloser
+	Status        int
+	ContentType   string
+	ContentLength int64
+	ContentRange  string
+	ETag          string
+	LastModified  time.Time
+}
+
+// IsRecordingFile reports whether key names a file of a type listed in
+// ContentTypes directly inside a recording session, as
+// <channel>/<session>/<file>
+func IsRecordingFile(key string) bool {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || path.Clean(key) != key || parts[0] == "" || parts[2] == "" {
+		return false
+	}
+	if _, err := strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return false
+	}
+	_, ok := ContentTypes[strings.ToLower(path.Ext(key))]
+	return ok
+}
+
+// StatusError is returned when storage answers with a non-success status
+// that should be passed on to the client, e.g. 304, 404 or 416. ETag is set
+// for 304 and ContentRange, as bytes */<size>, for 416.
+type StatusError struct {
+	Status       int
+	Err          error
+	ETag         string
+	ContentRange string
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// OpenObject opens a recording file for streaming. Only recording files
+// can be opened; other keys fail with a 403 *StatusError. rangeHeader and
+// ifNoneMatch are forwarded to storage as-is when set. The body is read
+// under ctx, so ctx must stay alive until the body is closed.
+func OpenObject(ctx context.Context, key string, rangeHeader string, ifNoneMatch string) (*ObjectStream, error) {
+	if !IsRecordingFile(key) {
+		return nil, &StatusError{Status: http.StatusForbidden, Err: errors.New(key + " is not a recording file")}
+	}
+
+	client := newS3Client(ctx)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName(ctx)),
+		Key:    aws.String(key),
+	}
+	if rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+
+	resp, err := client.GetObject(ctx, input)
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if !errors.As(err, &respErr) {
+			return nil, err
+		}
+		statusErr := &StatusError{Status: respErr.HTTPStatusCode(), Err: err}
+		switch statusErr.Status {
+		case http.StatusNotModified:
+			statusErr.ETag = respErr.Response.Header.Get("ETag")
+		case http.StatusRequestedRangeNotSatisfiable:
+			// storage does not say how large the object is
+			headCtx, cancel := operationContext(ctx, OpRead)
+			head, err := client.HeadObject(headCtx, &s3.HeadObjectInput{Bucket: input.Bucket, Key: input.Key})
+			cancel()
+			if err == nil {
+				statusErr.ContentRange = fmt.Sprintf("bytes */%d", head.ContentLength)
+			}
+		}
+		return nil, statusErr
+	}
+
+	stream := &ObjectStream{
+		Body:          resp.Body,
+		Status:        http.StatusOK,
+		ContentType:   ContentTypeFor(key),
+		ContentLength: resp.ContentLength,
+		ContentRange:  aws.ToString(resp.ContentRange),
+		ETag:          aws.ToString(resp.ETag),
+	}
+	if stream.ContentRange != "" {
+		stream.Status = http.StatusPartialContent
+	}
+	if resp.LastModified != nil {
+		stream.LastModified = *resp.LastModified
+	}
+
+	return stream, nil
+}
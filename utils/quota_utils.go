@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// quotaRetry is the retry hint when no running recording of a tenant is
+// due to stop on its own
+const quotaRetry = time.Minute
+
+// QuotaError is returned when starting a recording would exceed a quota of
+// the tenant. RetryAfter hints when a start may succeed.
+type QuotaError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return "recording quota exceeded: " + e.Reason
+}
+
+var (
+	quotaMu sync.Mutex
+	// starts that passed the quota check and are not in the session store yet
+	pendingStarts = map[string]int{}
+)
+
+// reserveRecording checks the quotas of tenant against the session store
+// and holds a slot for a new recording until the returned function is
+// called, once the recording is saved or failed to start
+func reserveRecording(tenant Tenant) (func(), error) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if err := checkQuotas(tenant, pendingStarts[tenant.ID], time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	pendingStarts[tenant.ID]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaMu.Lock()
+			defer quotaMu.Unlock()
+			if pendingStarts[tenant.ID]--; pendingStarts[tenant.ID] == 0 {
+				delete(pendingStarts, tenant.ID)
+			}
+		})
+	}, nil
+}
+
+// checkQuotas reports whether tenant, with pending recordings starting, may
+// start another one. Minutes are counted per UTC day, including the time
+// recorded so far by running sessions.
+func checkQuotas(tenant Tenant, pending int, now time.Time) error {
+	maxConcurrent := tenant.Recording.MaxConcurrentRecordings
+	maxMinutes := tenant.Recording.MaxMinutesPerDay
+	if maxConcurrent <= 0 && maxMinutes <= 0 {
+		return nil
+	}
+
+	sessions, err := Sessions.List()
+	if err != nil {
+		return err
+	}
+
+	day := now.Truncate(24 * time.Hour)
+	running := pending
+	var recorded time.Duration
+	var nextStop *time.Time
+	for _, session := range sessions {
+		if TenantID(session.Tenant) != tenant.ID {
+			continue
+		}
+
+		end := now
+		if session.Status == SessionRecording {
+			running++
+			if session.StopAt != nil && (nextStop == nil || session.StopAt.Before(*nextStop)) {
+				nextStop = session.StopAt
+			}
+		} else if session.StoppedAt != nil {
+			end = *session.StoppedAt
+		} else {
+			continue
+		}
+		start := session.StartedAt
+		if start.Before(day) {
+			start = day
+		}
+		if end.After(start) {
+			recorded += end.Sub(start)
+		}
+	}
+
+	if maxConcurrent > 0 && running >= maxConcurrent {
+		retry := quotaRetry
+		if nextStop != nil && nextStop.After(now) {
+			retry = nextStop.Sub(now)
+		}
+		return &QuotaError{
+			Reason:     fmt.Sprintf("%d of %d concurrent recordings running", running, maxConcurrent),
+			RetryAfter: retry,
+		}
+	}
+	if maxMinutes > 0 && recorded >= time.Duration(maxMinutes)*time.Minute {
+		return &QuotaError{
+			Reason:     fmt.Sprintf("%d minutes recorded today, the daily limit is %d", int(recorded/time.Minute), maxMinutes),
+			RetryAfter: day.Add(24 * time.Hour).Sub(now),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var limits RateLimiter
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limits.Allow("a", 2); !ok {
+			t.Fatalf("event %d refused within the rate", i+1)
+		}
+	}
+	ok, retryAfter := limits.Allow("a", 2)
+	if ok {
+		t.Fatal("event over the rate allowed")
+	}
+	if retryAfter <= 0 || retryAfter > 30*time.Second {
+		t.Errorf("retry after %s, want up to half a minute", retryAfter)
+	}
+	if ok, _ := limits.Allow("b", 2); !ok {
+		t.Error("another key shares the bucket")
+	}
+	if ok, _ := limits.Allow("a", 0); !ok {
+		t.Error("a zero rate limits")
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SessionStorePath = filepath.Join(t.TempDir(), "sessions.json")
+	SetConfig(cfg)
+	t.Cleanup(func() { SetConfig(DefaultConfig()) })
+	Sessions = &SessionStore{}
+	t.Cleanup(func() { Sessions = &SessionStore{} })
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stopAt := now.Add(10 * time.Minute)
+	stoppedAt := now.Add(-time.Hour)
+	for _, session := range []Session{
+		// 20 minutes today, still running
+		{SID: "running", Status: SessionRecording, StartedAt: now.Add(-20 * time.Minute), StopAt: &stopAt},
+		// 30 of its minutes fall on yesterday
+		{SID: "overnight", Status: SessionStopped, StartedAt: time.Date(2024, 4, 30, 23, 30, 0, 0, time.UTC), StoppedAt: &stoppedAt},
+		{SID: "other", Tenant: "other", Status: SessionRecording, StartedAt: now.Add(-6 * time.Hour)},
+	} {
+		if err := Sessions.Save(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 20 + 660 minutes recorded today
+	tenant := Tenant{ID: DefaultTenantID}
+
+	if err := checkQuotas(tenant, 0, now); err != nil {
+		t.Errorf("no quotas: %s", err)
+	}
+
+	tenant.Recording.MaxConcurrentRecordings = 2
+	if err := checkQuotas(tenant, 0, now); err != nil {
+		t.Errorf("one of two recordings running: %s", err)
+	}
+	err, ok := checkQuotas(tenant, 1, now).(*QuotaError)
+	if !ok || err.RetryAfter != 10*time.Minute {
+		t.Errorf("two of two recordings running and starting: err = %v, want a retry once one stops", err)
+	}
+
+	tenant.Recording.MaxConcurrentRecordings = 0
+	tenant.Recording.MaxMinutesPerDay = 681
+	if err := checkQuotas(tenant, 0, now); err != nil {
+		t.Errorf("680 of 681 minutes: %s", err)
+	}
+	tenant.Recording.MaxMinutesPerDay = 680
+	err, ok = checkQuotas(tenant, 0, now).(*QuotaError)
+	if !ok || err.RetryAfter != 12*time.Hour {
+		t.Errorf("680 of 680 minutes: err = %v, want a retry at midnight", err)
+	}
+}
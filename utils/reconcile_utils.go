@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// reconcilerPrincipal is recorded as StoppedBy for sessions it ends
+const reconcilerPrincipal = "reconciler"
+
+var (
+	lastSeenMu sync.Mutex
+	// when each running session was last found recording on Agora
+	lastSeen = map[string]time.Time{}
+)
+
+// ReconcileSessions checks every recording session against Agora. Sessions
+// Agora no longer knows about, or reports as stopped, are marked stopped.
+// Sessions running longer than MAX_SESSION_MINUTES are flagged and, with
+// RECONCILE_AUTO_STOP set, stopped.
+func ReconcileSessions(ctx context.Context) error {
+	sessions, err := Sessions.List()
+	if err != nil {
+		return err
+	}
+
+	maxDuration := time.Duration(CurrentConfig().MaxSessionMinutes) * time.Minute
+
+	// forget sessions stopped since the last run
+	recording := map[string]bool{}
+	for _, session := range sessions {
+		recording[session.SID] = session.Status == SessionRecording
+	}
+	lastSeenMu.Lock()
+	for sid := range lastSeen {
+		if !recording[sid] {
+			delete(lastSeen, sid)
+		}
+	}
+	lastSeenMu.Unlock()
+
+	for _, session := range sessions {
+		if session.Status != SessionRecording {
+			continue
+		}
+
+		sessionCtx, err := withTenantID(sessionLogContext(ctx, session), session.Tenant)
+		if err != nil {
+			LogEvent(sessionCtx, "reconcile", "skipped", Fields{"error": err.Error()})
+			continue
+		}
+		status, err := AgoraClient(TenantFrom(sessionCtx)).Query(sessionCtx, session.RID, session.SID, session.Mode)
+		if cloudrecording.NotFound(err) {
+			endSession(sessionCtx, session, "not found on Agora")
+			continue
+		}
+		if err != nil {
+			LogEvent(sessionCtx, "reconcile", "query failed", Fields{"error": err.Error()})
+			continue
+		}
+
+		if cloudrecording.Ended(status.ServerResponse.Status) {
+			endSession(sessionCtx, session, "agora reported "+status.ServerResponse.State)
+			continue
+		}
+		lastSeenMu.Lock()
+		lastSeen[session.SID] = time.Now().UTC()
+		lastSeenMu.Unlock()
+
+		if maxDuration <= 0 || time.Since(session.StartedAt) < maxDuration {
+			continue
+		}
+
+		if !session.Overdue {
+			LogEvent(sessionCtx, "reconcile", "overdue", Fields{"started_at": session.StartedAt.Format(time.RFC3339)})
+			session.Overdue = true
+			if err := Sessions.Save(session); err != nil {
+				LogEvent(sessionCtx, "reconcile", "saving session failed", Fields{"error": err.Error()})
+				continue
+			}
+		}
+
+		if CurrentConfig().ReconcileAutoStop {
+			if err := StopSession(sessionCtx, session, reconcilerPrincipal, "exceeded MAX_SESSION_MINUTES"); err != nil {
+				LogEvent(sessionCtx, "reconcile", "stop failed", Fields{"error": err.Error()})
+			}
+		}
+	}
+
+	return nil
+}
+
+// endedAt returns the best known end of a session found ended on Agora: the
+// exit Agora notified, else the last time the session was seen recording,
+// else its auto-stop deadline if that has passed, else now
+func endedAt(session Session) time.Time {
+	if session.ExitedAt != nil {
+		return *session.ExitedAt
+	}
+
+	lastSeenMu.Lock()
+	seen, ok := lastSeen[session.SID]
+	delete(lastSeen, session.SID)
+	lastSeenMu.Unlock()
+	if ok {
+		return seen
+	}
+
+	now := time.Now().UTC()
+	if session.StopAt != nil && session.StopAt.Before(now) {
+		return *session.StopAt
+	}
+	return now
+}
+
+// endSession records why a session ended and writes its manifest
+func endSession(ctx context.Context, session Session, reason string) {
+	LogEvent(ctx, "reconcile", "ended", Fields{"reason": reason})
+
+	session.EndReason = reason
+	if err := Sessions.Save(session); err != nil {
+		LogEvent(ctx, "reconcile", "saving session failed", Fields{"error": err.Error()})
+		return
+	}
+
+	_, err := completeSession(ctx, session.Channel, session.UID, session.RID, session.SID, reconcilerPrincipal, nil, endedAt(session))
+	if err != nil {
+		LogEvent(ctx, "reconcile", "writing manifest failed", Fields{"error": err.Error()})
+	}
+}
+
+// StartReconciler runs ReconcileSessions every RECONCILE_INTERVAL_SECONDS.
+// It does nothing when the interval is not set and stops on shutdown.
+func StartReconciler() {
+	interval := CurrentConfig().ReconcileIntervalSeconds
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		ctx := ServerContext()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := ReconcileSessions(ctx); err != nil {
+				log.Println("reconcile:", err)
+			}
+		}
+	}()
+}
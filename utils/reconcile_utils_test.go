@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReconcileSessions(t *testing.T) {
+	fake, _, cfg := newTestAgora(t)
+	cfg.MaxSessionMinutes = 60
+
+	start := func(channel string) Session {
+		t.Helper()
+		_, session, err := StartSession(context.Background(), channel, DefaultTranscodingConfig, 0, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	running := start("running")
+	exited := start("exited")
+	overdue := start("overdue")
+	overdue.StartedAt = time.Now().Add(-2 * time.Hour)
+	if err := Sessions.Save(overdue); err != nil {
+		t.Fatal(err)
+	}
+	// a session Agora has never heard of, as after losing a stop response
+	gone := Session{Channel: "gone", UID: 1, RID: "rid", SID: "gone", Mode: overdue.Mode, Status: SessionRecording, StartedAt: time.Now()}
+	if err := Sessions.Save(gone); err != nil {
+		t.Fatal(err)
+	}
+	fake.End(exited.SID, 20)
+	exitedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+	if err := Sessions.RecordExit(exited.SID, exitedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReconcileSessions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sid := range []string{exited.SID, gone.SID} {
+		session, _, _ := Sessions.Get(sid)
+		if session.Status != SessionStopped || session.StoppedBy != reconcilerPrincipal || session.EndReason == "" {
+			t.Errorf("%s = %+v, want it ended by the reconciler", sid, session)
+		}
+	}
+	if session, _, _ := Sessions.Get(exited.SID); session.StoppedAt == nil || !session.StoppedAt.Equal(exitedAt) {
+		t.Errorf("exited stopped at %v, want the exit Agora notified at %s", session.StoppedAt, exitedAt)
+	}
+	if session, _, _ := Sessions.Get(running.SID); session.Status != SessionRecording || session.Overdue {
+		t.Errorf("running = %+v, want it left alone", session)
+	}
+	// overdue sessions are only flagged unless auto stop is on
+	if session, _, _ := Sessions.Get(overdue.SID); session.Status != SessionRecording || !session.Overdue {
+		t.Errorf("overdue = %+v, want it flagged", session)
+	}
+
+	cfg.ReconcileAutoStop = true
+	if err := ReconcileSessions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if session, _, _ := Sessions.Get(overdue.SID); session.Status != SessionStopped || session.StoppedBy != reconcilerPrincipal {
+		t.Errorf("overdue = %+v, want it stopped by the reconciler", session)
+	}
+	if session, _, _ := Sessions.Get(running.SID); session.Status != SessionRecording {
+		t.Errorf("running = %+v, want it still recording", session)
+	}
+}
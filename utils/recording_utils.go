@@ -1,19 +1,17 @@
 package utils
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/spf13/viper"
 )
 
 var Regions = map[int]string{
@@ -37,260 +35,190 @@ var Regions = map[int]string{
 	17: "us-gov-west-1",
 }
 
-// Recorder manages cloud recording
-type Recorder struct {
-	http.Client
-	Channel string
-	Token   string
-	UID     int
-	RID     string
-	SID     string
-}
+// TranscodingConfig is the layout and encoding of a mix mode recording
+type TranscodingConfig = cloudrecording.TranscodingConfig
+
+// RecordingFile is an uploaded file reported by Agora
+type RecordingFile = cloudrecording.RecordingFile
 
-type StatusStruct struct {
-	Resourceid     string `json:"resourceId"`
-	Sid            string `json:"sid"`
-	Serverresponse struct {
-		Filelistmode string `json:"fileListMode"`
-		Filelist     []struct {
-			Filename       string `json:"filename"`
-			Tracktype      string `json:"trackType"`
-			UID            string `json:"uid"`
-			Mixedalluser   bool   `json:"mixedAllUser"`
-			Isplayable     bool   `json:"isPlayable"`
-			Slicestarttime int64  `json:"sliceStartTime"`
-		} `json:"fileList"`
-		Status         int   `json:"status"`
-		Slicestarttime int64 `json:"sliceStartTime"`
-	} `json:"serverResponse"`
+// DefaultTranscodingConfig is used when a Recorder has no transcoding config
+var DefaultTranscodingConfig = TranscodingConfig{
+	Height:           720,
+	Width:            1280,
+	Bitrate:          2260,
+	FPS:              15,
+	MixedVideoLayout: 1,
+	BackgroundColor:  "#000000",
 }
 
-// Acquire runs the acquire endpoint for Cloud Recording
-func (rec *Recorder) Acquire() (string, error) {
-	creds, err := GenerateUserCredentials(rec.Channel)
-	if err != nil {
-		return "", err
+// TranscodingPreset returns the preset of tenant called name. An empty name
+// selects the tenant's default preset, or the default config if it has none.
+func TranscodingPreset(tenant Tenant, name string) (TranscodingConfig, bool) {
+	if name == "" {
+		name = tenant.Recording.DefaultPreset
 	}
-
-	rec.UID = creds.UID
-	rec.Token = creds.Rtc
-
-	requestBody := fmt.Sprintf(`
-		{
-			"cname": "%s",
-			"uid": "%d",
-			"clientRequest": {
-				"resourceExpiredHour": 24
-			}
-		}
-	`, rec.Channel, rec.UID)
-	req, err := http.NewRequest("POST", "https://api.agora.io/v1/apps/"+viper.GetString("APP_ID")+"/cloud_recording/acquire",
-		bytes.NewBuffer([]byte(requestBody)))
-	if err != nil {
-		return "", err
+	if name == "" {
+		return DefaultTranscodingConfig, true
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(viper.GetString("CUSTOMER_ID"), viper.GetString("CUSTOMER_CERTIFICATE"))
+	preset, ok := tenant.Recording.Presets[name]
+	return preset, ok
+}
 
-	resp, err := rec.Do(req)
-	if err != nil {
-		return "", err
-	}
+// Recorder manages cloud recording
+type Recorder struct {
+	http.Client
+	Tenant      Tenant
+	Channel     string
+	Token       string
+	UID         int
+	RID         string
+	SID         string
+	Transcoding TranscodingConfig
+	StartedAt   time.Time
+
+	acquiredAt time.Time
+}
 
-	defer resp.Body.Close()
+// Prefix returns the storage prefix Start asks Agora to upload files to
+func (rec *Recorder) Prefix() string {
+	return sessionPrefix(rec.Channel, strconv.FormatInt(rec.StartedAt.Unix(), 10))
+}
 
-	var result map[string]string
-	json.NewDecoder(resp.Body).Decode(&result)
+// resourceLifetime is how long Agora keeps an acquired resource ID that has
+// not been used to start a recording
+const resourceLifetime = 5 * time.Minute
 
-	rec.RID = result["resourceId"]
-	b, _ := json.Marshal(result)
+// ResourceValid reports whether the acquired resource ID can still be used
+// to start a recording
+func (rec *Recorder) ResourceValid() bool {
+	return rec.RID != "" && time.Since(rec.acquiredAt) < resourceLifetime
+}
 
-	return string(b), nil
+// client returns the cloud recording client used by the Recorder. It keeps
+// the shared HTTP client, whose connections are reused, rather than the
+// embedded one; calls are bounded by their operation timeouts.
+func (rec *Recorder) client() *cloudrecording.Client {
+	return AgoraClient(rec.Tenant)
 }
 
-// Start starts the recording
-func (rec *Recorder) Start() (string, error) {
-	currentTime := strconv.FormatInt(time.Now().Unix(), 10)
-
-	var requestBody string
-
-	requestBody = fmt.Sprintf(`
-		{
-			"cname": "%s",
-			"uid": "%d",
-			"clientRequest": {
-				"token": "%s",
-				"recordingConfig": {
-					"maxIdleTime": 30,
-					"streamTypes": 2,
-					"channelType": 1,
-					"transcodingConfig": {
-						"height": 720,
-						"width": 1280,
-						"bitrate": 2260,
-						"fps": 15,
-						"mixedVideoLayout": 1,
-						"backgroundColor": "#000000"
-					}
-				},
-				"storageConfig": {
-					"vendor": %d,
-					"region": %d,
-					"bucket": "%s",
-					"accessKey": "%s",
-					"secretKey": "%s",
-					"fileNamePrefix": ["%s", "%s"]
-				}
-			}
-		}
-	`, rec.Channel, rec.UID, rec.Token, viper.GetInt("RECORDING_VENDOR"), viper.GetInt("RECORDING_REGION"), viper.GetString("BUCKET_NAME"),
-		viper.GetString("BUCKET_ACCESS_KEY"), viper.GetString("BUCKET_ACCESS_SECRET"),
-		rec.Channel, currentTime)
+// Acquire runs the acquire endpoint for Cloud Recording
+func (rec *Recorder) Acquire(ctx context.Context) (_ string, err error) {
+	ctx, span := startSpan(ctx, "Recorder.Acquire", cloudrecording.SpanAttributes(rec.Channel, cloudrecording.ModeMix, "", "")...)
+	defer func() { endSpan(span, err) }()
 
-	req, err := http.NewRequest("POST", "https://api.agora.io/v1/apps/"+viper.GetString("APP_ID")+"/cloud_recording/resourceid/"+rec.RID+"/mode/mix/start",
-		bytes.NewBuffer([]byte(requestBody)))
+	creds, err := GenerateUserCredentials(rec.Tenant, rec.Channel)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(viper.GetString("CUSTOMER_ID"), viper.GetString("CUSTOMER_CERTIFICATE"))
+	rec.UID = creds.UID
+	rec.Token = creds.Rtc
 
-	resp, err := rec.Do(req)
+	result, err := rec.client().Acquire(ctx, cloudrecording.AcquireRequest{
+		Cname: rec.Channel,
+		UID:   strconv.Itoa(rec.UID),
+		ClientRequest: cloudrecording.AcquireClientRequest{
+			ResourceExpiredHour: 24,
+		},
+	})
 	if err != nil {
 		return "", err
 	}
 
-	defer resp.Body.Close()
-	var result map[string]string
-	json.NewDecoder(resp.Body).Decode(&result)
-	rec.SID = result["sid"]
+	rec.RID = result.ResourceID
+	rec.acquiredAt = time.Now()
+	span.SetAttributes(cloudrecording.AttrRID.String(rec.RID))
 	b, _ := json.Marshal(result)
+
 	return string(b), nil
 }
 
-// Stop stops the cloud recording
-func Stop(channel string, uid int, rid string, sid string) (string, error) {
-	requestBody := fmt.Sprintf(`
-		{
-			"cname": "%s",
-			"uid": "%d",
-			"clientRequest": {
-			}
-		}
-	`, channel, uid)
-
-	req, err := http.NewRequest("POST", "https://api.agora.io/v1/apps/"+viper.GetString("APP_ID")+"/cloud_recording/resourceid/"+rid+"/sid/"+sid+"/mode/mix/stop",
-		bytes.NewBuffer([]byte(requestBody)))
-	if err != nil {
-		return "", err
-	}
+// Start starts the recording
+func (rec *Recorder) Start(ctx context.Context) (_ string, err error) {
+	ctx, span := startSpan(ctx, "Recorder.Start", cloudrecording.SpanAttributes(rec.Channel, cloudrecording.ModeMix, rec.RID, "")...)
+	defer func() { endSpan(span, err) }()
 
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(viper.GetString("CUSTOMER_ID"), viper.GetString("CUSTOMER_CERTIFICATE"))
+	rec.StartedAt = time.Now()
+	currentTime := strconv.FormatInt(rec.StartedAt.Unix(), 10)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	if rec.Transcoding.Width == 0 || rec.Transcoding.Height == 0 {
+		rec.Transcoding = DefaultTranscodingConfig
+	}
+	transcoding := rec.Transcoding
+	storage := rec.Tenant.Storage
+
+	result, err := rec.client().Start(ctx, rec.RID, cloudrecording.ModeMix, cloudrecording.StartRequest{
+		Cname: rec.Channel,
+		UID:   strconv.Itoa(rec.UID),
+		ClientRequest: cloudrecording.StartClientRequest{
+			Token: rec.Token,
+			RecordingConfig: &cloudrecording.RecordingConfig{
+				MaxIdleTime:       30,
+				StreamTypes:       2,
+				ChannelType:       1,
+				TranscodingConfig: &transcoding,
+			},
+			StorageConfig: cloudrecording.StorageConfig{
+				Vendor:         storage.Vendor,
+				Region:         storage.Region,
+				Bucket:         storage.Bucket,
+				AccessKey:      storage.AccessKey,
+				SecretKey:      storage.AccessSecret,
+				FileNamePrefix: []string{rec.Channel, currentTime},
+			},
+		},
+	})
 	if err != nil {
 		return "", err
 	}
 
-	defer resp.Body.Close()
-
-	var result map[string]string
-	json.NewDecoder(resp.Body).Decode(&result)
+	rec.SID = result.SID
+	span.SetAttributes(cloudrecording.AttrSID.String(rec.SID))
 	b, _ := json.Marshal(result)
 	return string(b), nil
 }
 
 // Listing recordings on s3 bucket
-type Creds struct{}
+type Creds struct {
+	AccessKeyID     string
+	SecretAccessKey string
+}
 
-// TODO: eliminate viper getString overhead by shifting to fetch to initialization
 func (c Creds) Retrieve(context.Context) (aws.Credentials, error) {
 	return aws.Credentials{
-		AccessKeyID:     viper.GetString("BUCKET_ACCESS_KEY"),
-		SecretAccessKey: viper.GetString("BUCKET_ACCESS_SECRET"),
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
 	}, nil
 }
 
-func GetRecordingsURLs(channel string) ([]string, error) {
-
-	bucket := viper.GetString("BUCKET_NAME")
-
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return nil, err
-	}
-
-	var creds aws.CredentialsProvider
-
-	creds = Creds{}
-
-	cfg = aws.Config{
-		Region:      Regions[viper.GetInt("RECORDING_REGION")],
-		Credentials: creds,
-	}
-
-	client := s3.NewFromConfig(cfg)
-
-	objects, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: &bucket,
-		Prefix: &channel,
-	})
-
+// GetRecordingsURLs returns the unsigned URLs of the playlists stored under
+// channel
+func GetRecordingsURLs(ctx context.Context, channel string) ([]string, error) {
+	keys, err := GetRecordingsList(ctx, channel)
 	if err != nil {
 		return nil, err
 	}
 
 	var recordings []string
-
-	for _, object := range objects.Contents {
-		objectValue := aws.ToString(object.Key)
-		if objectValue[len(objectValue)-4:] == "m3u8" {
-			recordings = append(recordings, "https://"+bucket+".s3."+viper.GetString("RECORDING_REGION")+".amazonaws.com/"+objectValue)
-		}
+	for _, key := range keys {
+		recordings = append(recordings, objectURL(ctx, key))
 	}
 
 	return recordings, nil
 }
 
-func GetRecordingsList(channel string) ([]string, error) {
-
-	bucket := viper.GetString("BUCKET_NAME")
-
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return nil, err
-	}
-
-	var creds aws.CredentialsProvider
-
-	creds = Creds{}
-
-	cfg = aws.Config{
-		Region:      Regions[viper.GetInt("RECORDING_REGION")],
-		Credentials: creds,
-	}
-
-	client := s3.NewFromConfig(cfg)
-
-	objects, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: &bucket,
-		Prefix: &channel,
-	})
-
+// GetRecordingsList returns the keys of the playlists stored under channel
+func GetRecordingsList(ctx context.Context, channel string) ([]string, error) {
+	objects, err := listObjects(ctx, newS3Client(ctx), channel)
 	if err != nil {
 		return nil, err
 	}
 
 	var recordings []string
-
-	for _, object := range objects.Contents {
-		objectValue := aws.ToString(object.Key)
-		if objectValue[len(objectValue)-4:] == "m3u8" {
-			recordings = append(recordings, objectValue)
+	for _, object := range objects {
+		if key := aws.ToString(object.Key); strings.HasSuffix(key, ".m3u8") {
+			recordings = append(recordings, key)
 		}
 	}
 
@@ -309,28 +237,19 @@ func GetPresignedURL(c context.Context, api S3PresignGetObjectAPI, input *s3.Get
 	return api.PresignGetObject(c, input)
 }
 
-func GetRecordings(object string) (string, error) {
-	bucket := viper.GetString("BUCKET_NAME")
-
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return "", err
-	}
-
-	var creds aws.CredentialsProvider
-
-	creds = Creds{}
+// GetRecordings presigns the URL of a recording file. It stays valid for
+// PLAYLIST_URL_EXPIRY_SECONDS.
+func GetRecordings(ctx context.Context, object string) (string, error) {
+	bucket := bucketName(ctx)
 
-	cfg = aws.Config{
-		Region:      Regions[viper.GetInt("RECORDING_REGION")],
-		Credentials: creds,
-	}
+	client := newS3Client(ctx)
 
-	client := s3.NewFromConfig(cfg)
+	psClient := s3.NewPresignClient(client, s3.WithPresignExpires(PlaylistExpiry()))
 
-	psClient := s3.NewPresignClient(client)
+	ctx, cancel := operationContext(ctx, OpPresign)
+	defer cancel()
 
-	resp, err := GetPresignedURL(context.TODO(), psClient, &s3.GetObjectInput{
+	resp, err := GetPresignedURL(ctx, psClient, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(object),
 	})
@@ -340,31 +259,3 @@ func GetRecordings(object string) (string, error) {
 
 	return resp.URL, nil
 }
-
-func CallStatus(rid string, sid string) (StatusStruct, error) {
-	url := "https://api.agora.io/v1/apps/" + viper.GetString("APP_ID") + "/cloud_recording/resourceid/" + rid + "/sid/" + sid + "/mode/mix/query"
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return StatusStruct{}, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(viper.GetString("CUSTOMER_ID"), viper.GetString("CUSTOMER_CERTIFICATE"))
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return StatusStruct{}, err
-	}
-
-	defer resp.Body.Close()
-
-	var result StatusStruct
-	json.NewDecoder(resp.Body).Decode(&result)
-	// // b, _ := json.Marshal(result)
-	// bodyBytes, err := ioutil.ReadAll(resp.Body)
-	// if err != nil {
-	//     return "", err
-	// }
-	// result := string(bodyBytes)
-	return result, nil
-}
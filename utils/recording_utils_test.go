@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/s3test"
+)
+
+// setTestConfig makes cfg the config for the rest of the test
+func setTestConfig(t *testing.T, cfg *Config) {
+	SetConfig(cfg)
+	t.Cleanup(func() { SetConfig(DefaultConfig()) })
+}
+
+// newTestBucket points storage at a fake S3 server
+func newTestBucket(t *testing.T) (*s3test.Server, *Config) {
+	fake := s3test.NewServer("recordings")
+	t.Cleanup(fake.Close)
+
+	cfg := DefaultConfig()
+	cfg.S3Endpoint = fake.URL
+	cfg.BucketName = "recordings"
+	cfg.BucketAccessKey = "key"
+	cfg.BucketAccessSecret = "secret"
+	setTestConfig(t, cfg)
+	return fake, cfg
+}
+
+func TestGetRecordingsListPaginates(t *testing.T) {
+	fake, _ := newTestBucket(t)
+	fake.PageSize = 2
+
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	var want []string
+	for i := 0; i < 3; i++ {
+		want = append(want, fake.SeedSession("demo", start.Add(time.Duration(i)*time.Hour), "sid"+string(rune('a'+i)), 3))
+	}
+	fake.SeedSession("demo2", start, "other", 1)
+	fake.Put("demo/notes.txt", []byte("x"), start)
+
+	got, err := GetRecordingsList(context.Background(), "demo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecordingsList = %v, want %v", got, want)
+	}
+
+	// 3 sessions of 4 objects plus notes.txt, 2 keys a page
+	if requests := fake.Requests("list"); requests != 7 {
+		t.Errorf("list requests = %d, want 7", requests)
+	}
+}
+
+func TestGetRecordingsListEmpty(t *testing.T) {
+	newTestBucket(t)
+
+	got, err := GetRecordingsList(context.Background(), "missing/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("GetRecordingsList = %v, want none", got)
+	}
+}
+
+func TestGetRecordingsURLs(t *testing.T) {
+	fake, _ := newTestBucket(t)
+	key := fake.SeedSession("demo", time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC), "sid", 2)
+
+	got, err := GetRecordingsURLs(context.Background(), "demo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{fake.URL + "/recordings/" + key}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecordingsURLs = %v, want %v", got, want)
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BucketName = "recordings"
+	cfg.RecordingRegion = 4
+	setTestConfig(t, cfg)
+
+	if got, want := objectURL(context.Background(), "demo/1/a.m3u8"), "https://recordings.s3.eu-west-1.amazonaws.com/demo/1/a.m3u8"; got != want {
+		t.Errorf("objectURL = %q, want %q", got, want)
+	}
+
+	cfg.S3Endpoint = "http://minio:9000/"
+	if got, want := objectURL(context.Background(), "demo/1/a.m3u8"), "http://minio:9000/recordings/demo/1/a.m3u8"; got != want {
+		t.Errorf("objectURL with endpoint = %q, want %q", got, want)
+	}
+}
+
+func TestGetRecordingsPresignExpiry(t *testing.T) {
+	fake, cfg := newTestBucket(t)
+	key := fake.SeedSession("demo", time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC), "sid", 1)
+
+	for _, tc := range []struct {
+		seconds int
+		want    string
+	}{
+		{0, "3600"},
+		{600, "600"},
+	} {
+		cfg.PlaylistURLExpirySeconds = tc.seconds
+
+		presigned, err := GetRecordings(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(presigned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Query().Get("X-Amz-Expires"); got != tc.want {
+			t.Errorf("expiry seconds %d: X-Amz-Expires = %q, want %q", tc.seconds, got, tc.want)
+		}
+		if u.Path != "/recordings/"+key {
+			t.Errorf("presigned path = %q, want path-style", u.Path)
+		}
+	}
+
+	presigned, _ := GetRecordings(context.Background(), key)
+	resp, err := http.Get(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	object, _ := fake.Object(key)
+	if resp.StatusCode != http.StatusOK || string(body) != string(object.Body) {
+		t.Errorf("GET presigned URL: status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	fake, _ := newTestBucket(t)
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	fake.SeedSession("demo", start, "sid", 3)
+	kept := fake.SeedSession("demo", start.Add(time.Hour), "later", 1)
+
+	deleted, err := DeleteSession(context.Background(), "demo", "1619863200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 4 {
+		t.Errorf("deleted %d keys, want 4", len(deleted))
+	}
+	if keys := fake.Keys(); len(keys) != 2 || keys[0] != kept {
+		t.Errorf("remaining keys = %v", keys)
+	}
+}
+
+func TestDeleteSessionRefused(t *testing.T) {
+	fake, _ := newTestBucket(t)
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	playlist := fake.SeedSession("demo", start, "sid", 2)
+	fake.DenyDelete(playlist)
+
+	deleted, err := DeleteSession(context.Background(), "demo", "1619863200")
+	deleteErr, ok := err.(*DeleteError)
+	if !ok || len(deleteErr.Failed) != 1 || deleteErr.Failed[playlist] == "" {
+		t.Fatalf("err = %v, want the playlist reported", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("deleted = %v, want the segments only", deleted)
+	}
+	for _, key := range deleted {
+		if key == playlist {
+			t.Error("refused key reported as deleted")
+		}
+	}
+	if keys := fake.Keys(); len(keys) != 1 || keys[0] != playlist {
+		t.Errorf("remaining keys = %v", keys)
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay lets a burst of file events settle into a single reload
+const reloadDelay = 200 * time.Millisecond
+
+// ReloadConfig loads the configuration again from the same file,
+// environment and flags and swaps it in. Credentials, presets and policies
+// apply to the next call made with them, so running recordings carry on.
+// Settings that need a restart keep their current value. An invalid config,
+// or one that drops a tenant with recordings running, is rejected and the
+// current one kept.
+func ReloadConfig() error {
+	current := CurrentConfig()
+	cfg, err := LoadConfig(current.args)
+	if err != nil {
+		return err
+	}
+	if err := checkActiveTenants(cfg); err != nil {
+		return err
+	}
+
+	pending := keepRestartSettings(current, cfg)
+	changes := ConfigChanges(current, cfg)
+	SetConfig(cfg)
+
+	if len(changes) == 0 && len(pending) == 0 {
+		log.Println("config: reloaded, nothing changed")
+	}
+	for _, change := range changes {
+		log.Println("config: reloaded", change)
+	}
+	for _, key := range pending {
+		log.Printf("config: %s changed, restart to apply", key)
+	}
+	return nil
+}
+
+// checkActiveTenants fails if cfg drops a tenant that has recordings running
+// or schedules pending
+func checkActiveTenants(cfg *Config) error {
+	kept := func(id string) bool {
+		id = TenantID(id)
+		if id == DefaultTenantID {
+			return true
+		}
+		_, ok := cfg.Tenants[id]
+		return ok
+	}
+
+	sessions, err := Sessions.List()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Status == SessionRecording && !kept(session.Tenant) {
+			return fmt.Errorf("config: tenant %s has recordings running and cannot be removed", TenantID(session.Tenant))
+		}
+	}
+
+	schedules, err := Schedules.List()
+	if err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		if !schedule.Done && !kept(schedule.Tenant) {
+			return fmt.Errorf("config: tenant %s has schedules pending and cannot be removed", TenantID(schedule.Tenant))
+		}
+	}
+	return nil
+}
+
+// keepRestartSettings copies the settings tagged restart from current into
+// cfg and returns the keys whose new value was held back
+func keepRestartSettings(current *Config, cfg *Config) []string {
+	var pending []string
+	from := reflect.ValueOf(current).Elem()
+	to := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < to.NumField(); i++ {
+		field := to.Type().Field(i)
+		if field.Tag.Get("restart") != "true" {
+			continue
+		}
+		if !reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			pending = append(pending, field.Tag.Get("mapstructure"))
+			to.Field(i).Set(from.Field(i))
+		}
+	}
+	return pending
+}
+
+// ConfigChanges describes the settings that differ between two configs,
+// one per line. Secrets are reported as changed without their values.
+func ConfigChanges(old *Config, new *Config) []string {
+	var changes []string
+	diffValues("", reflect.ValueOf(*old), reflect.ValueOf(*new), false, &changes)
+	return changes
+}
+
+// fieldKey returns the config key of a struct field
+func fieldKey(field reflect.StructField) string {
+	for _, tag := range []string{"mapstructure", "json"} {
+		if key := strings.Split(field.Tag.Get(tag), ",")[0]; key != "" {
+			return key
+		}
+	}
+	return field.Name
+}
+
+func diffValues(key string, old reflect.Value, new reflect.Value, secret bool, changes *[]string) {
+	switch {
+	case old.Kind() == reflect.Struct:
+		for i := 0; i < old.NumField(); i++ {
+			field := old.Type().Field(i)
+			name := fieldKey(field)
+			if field.PkgPath != "" || name == "-" {
+				continue
+			}
+			if key != "" {
+				name = key + "." + name
+			}
+			diffValues(name, old.Field(i), new.Field(i), secret || field.Tag.Get("secret") == "true", changes)
+		}
+
+	case old.Kind() == reflect.Map && old.Type().Key().Kind() == reflect.String && old.Type().Elem().Kind() == reflect.Struct:
+		names := map[string]bool{}
+		for _, name := range append(old.MapKeys(), new.MapKeys()...) {
+			names[name.String()] = true
+		}
+		var sorted []string
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+
+		for _, name := range sorted {
+			oldEntry := old.MapIndex(reflect.ValueOf(name))
+			newEntry := new.MapIndex(reflect.ValueOf(name))
+			switch {
+			case !oldEntry.IsValid():
+				*changes = append(*changes, key+"."+name+" added")
+			case !newEntry.IsValid():
+				*changes = append(*changes, key+"."+name+" removed")
+			default:
+				diffValues(key+"."+name, oldEntry, newEntry, secret, changes)
+			}
+		}
+
+	case reflect.DeepEqual(old.Interface(), new.Interface()):
+
+	case secret:
+		*changes = append(*changes, key+" changed (redacted)")
+
+	default:
+		*changes = append(*changes, fmt.Sprintf("%s: %v -> %v", key, old.Interface(), new.Interface()))
+	}
+}
+
+// WatchConfig reloads the configuration whenever its file changes or the
+// process receives SIGHUP, until ctx is done. Secrets read from other files
+// are only picked up on SIGHUP.
+func WatchConfig(ctx context.Context) error {
+	path := CurrentConfig().path
+	if path == "" {
+		path = "config.json"
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// editors and Kubernetes config maps replace the file rather than
+	// write to it, so the directory is watched
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	reload := func(reason string) {
+		log.Printf("config: reloading, %s", reason)
+		if err := ReloadConfig(); err != nil {
+			log.Println("config: reload failed, keeping the current config:", err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hangup)
+
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				reload("received SIGHUP")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(event.Name)
+				if name == filepath.Base(path) || name == "..data" {
+					settled = time.After(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("config: watch:", err)
+			case <-settled:
+				settled = nil
+				reload(path + " changed")
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadConfigFile = `{
+  "PORT": %d,
+  "APP_ID": "app",
+  "APP_CERTIFICATE": "%s",
+  "CUSTOMER_ID": "customer",
+  "CUSTOMER_CERTIFICATE": "customer-secret",
+  "BUCKET_NAME": "recordings",
+  "BUCKET_ACCESS_KEY": "key",
+  "BUCKET_ACCESS_SECRET": "secret",
+  "SESSION_STORE_PATH": "%s",
+  "SCHEDULE_STORE_PATH": "%s",
+  "TENANTS": {%s}
+}`
+
+const reloadTenant = `"acme": {
+  "app_id": "acme-app",
+  "app_certificate": "acme-cert",
+  "customer_id": "acme-customer",
+  "customer_certificate": "acme-secret",
+  "storage": { "bucket": "acme", "access_key": "k", "access_secret": "s" }
+}`
+
+// writeReloadConfig writes a config file to path, keeping sessions and
+// schedules next to it
+func writeReloadConfig(t *testing.T, path string, port int, certificate string, tenants string) {
+	sessions := filepath.Join(filepath.Dir(path), "sessions.json")
+	schedules := filepath.Join(filepath.Dir(path), "schedules.json")
+	data := fmt.Sprintf(reloadConfigFile, port, certificate, sessions, schedules, tenants)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadReloadConfig loads the config file at path and makes it current
+func loadReloadConfig(t *testing.T, path string) {
+	cfg, err := LoadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, cfg)
+	Sessions = &SessionStore{}
+	Schedules = &ScheduleStore{}
+	t.Cleanup(func() {
+		Sessions = &SessionStore{}
+		Schedules = &ScheduleStore{}
+	})
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := DefaultConfig()
+	old.AppCertificate = "old-certificate"
+	old.Tenants = map[string]Tenant{"acme": {AppID: "a"}}
+	new := DefaultConfig()
+	new.AppCertificate = "new-certificate"
+	new.MaxRecordingSeconds = 60
+	new.Tenants = map[string]Tenant{"acme": {AppID: "b", Storage: TenantStorage{AccessSecret: "s"}}, "beta": {}}
+
+	got := strings.Join(ConfigChanges(old, new), "\n")
+	for _, want := range []string{
+		"APP_CERTIFICATE changed (redacted)",
+		"MAX_RECORDING_SECONDS: 0 -> 60",
+		"TENANTS.acme.app_id: a -> b",
+		"TENANTS.acme.storage.access_secret changed (redacted)",
+		"TENANTS.beta added",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("changes %q do not include %q", got, want)
+		}
+	}
+	if strings.Contains(got, "certificate\n") || strings.Contains(got, "-certificate") {
+		t.Errorf("changes %q reveal a secret", got)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeReloadConfig(t, path, 3000, "old-certificate", reloadTenant)
+	loadReloadConfig(t, path)
+
+	writeReloadConfig(t, path, 4000, "new-certificate", reloadTenant)
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := CurrentConfig(); cfg.AppCertificate != "new-certificate" || cfg.Port != 3000 {
+		t.Errorf("APP_CERTIFICATE %q, PORT %d: want the new certificate and the old port", cfg.AppCertificate, cfg.Port)
+	}
+
+	writeReloadConfig(t, path, 3000, "", reloadTenant)
+	if err := ReloadConfig(); err == nil {
+		t.Error("invalid config accepted")
+	}
+	if CurrentConfig().AppCertificate != "new-certificate" {
+		t.Error("invalid config replaced the current one")
+	}
+
+	if err := Sessions.Save(Session{SID: "sid", Tenant: "acme", Status: SessionRecording}); err != nil {
+		t.Fatal(err)
+	}
+	writeReloadConfig(t, path, 3000, "new-certificate", "")
+	if err := ReloadConfig(); err == nil || !strings.Contains(err.Error(), "acme") {
+		t.Errorf("removing a tenant with recordings running: err = %v", err)
+	}
+	if _, ok := GetTenant("acme"); !ok {
+		t.Error("tenant with recordings running was removed")
+	}
+
+	if err := Sessions.Save(Session{SID: "sid", Tenant: "acme", Status: SessionStopped}); err != nil {
+		t.Fatal(err)
+	}
+	schedule, err := Schedules.Create(Schedule{Tenant: "acme", Channel: "demo", StartAt: time.Now().Add(time.Hour), DurationSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfig(); err == nil || !strings.Contains(err.Error(), "schedules pending") {
+		t.Errorf("removing a tenant with schedules pending: err = %v", err)
+	}
+
+	// once its work is gone the tenant can go, and what is left of it is
+	// not run against another project
+	if _, err := Schedules.Delete(schedule.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withTenantID(context.Background(), "acme"); err == nil {
+		t.Error("removed tenant resolved")
+	}
+	if err := StopSession(context.Background(), Session{SID: "orphan", Tenant: "acme", Status: SessionRecording}, "tester", "test"); err == nil || !strings.Contains(err.Error(), "acme") {
+		t.Errorf("stopping a session of a removed tenant: err = %v", err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeReloadConfig(t, path, 3000, "old-certificate", "")
+	loadReloadConfig(t, path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := WatchConfig(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	writeReloadConfig(t, path, 3000, "new-certificate", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for CurrentConfig().AppCertificate != "new-certificate" {
+		if time.Now().After(deadline) {
+			t.Fatal("config change not picked up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RetentionRule describes how long recordings for channels matching Prefix
+// are kept. Zero values disable the corresponding limit.
+type RetentionRule struct {
+	Prefix       string `mapstructure:"prefix" json:"prefix"`
+	KeepDays     int    `mapstructure:"keep_days" json:"keep_days"`
+	KeepSessions int    `mapstructure:"keep_sessions" json:"keep_sessions"`
+	LegalHold    bool   `mapstructure:"legal_hold" json:"legal_hold"`
+}
+
+// RetentionAction is a session selected for deletion by a retention rule.
+// After a run Keys holds the deleted keys and Failed those storage refused
+// to delete.
+type RetentionAction struct {
+	Channel string   `json:"channel"`
+	Session string   `json:"session"`
+	Reason  string   `json:"reason"`
+	Keys    []string `json:"keys"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// RetentionReport is the outcome of a retention run
+type RetentionReport struct {
+	DryRun  bool              `json:"dry_run"`
+	RanAt   time.Time         `json:"ran_at"`
+	Actions []RetentionAction `json:"actions"`
+}
+
+// GetRetentionRules returns the configured retention rules
+func GetRetentionRules() []RetentionRule {
+	return CurrentConfig().RetentionRules
+}
+
+// matchRetentionRule returns the rule with the longest prefix matching channel
+func matchRetentionRule(rules []RetentionRule, channel string) (RetentionRule, bool) {
+	var match RetentionRule
+	found := false
+	for _, rule := range rules {
+		if !strings.HasPrefix(channel, rule.Prefix) {
+			continue
+		}
+		if !found || len(rule.Prefix) > len(match.Prefix) {
+			match = rule
+			found = true
+		}
+	}
+	return match, found
+}
+
+// PlanRetention selects the sessions that the rules allow to be deleted.
+// Objects are grouped by the <channel>/<timestamp>/ layout used by Start;
+// keys that do not follow it are never selected.
+func PlanRetention(rules []RetentionRule, objects []types.Object, now time.Time) []RetentionAction {
+	sessions := map[string]map[string][]string{}
+	for _, object := range objects {
+		key := aws.ToString(object.Key)
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		if _, err := strconv.ParseInt(parts[1], 10, 64); err != nil {
+			continue
+		}
+		if sessions[parts[0]] == nil {
+			sessions[parts[0]] = map[string][]string{}
+		}
+		sessions[parts[0]][parts[1]] = append(sessions[parts[0]][parts[1]], key)
+	}
+
+	var channels []string
+	for channel := range sessions {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	var actions []RetentionAction
+	for _, channel := range channels {
+		rule, ok := matchRetentionRule(rules, channel)
+		if !ok || rule.LegalHold {
+			continue
+		}
+
+		var started []int64
+		for session := range sessions[channel] {
+			ts, _ := strconv.ParseInt(session, 10, 64)
+			started = append(started, ts)
+		}
+		// newest first so the index is the number of newer sessions
+		sort.Slice(started, func(i, j int) bool { return started[i] > started[j] })
+
+		for i, ts := range started {
+			session := strconv.FormatInt(ts, 10)
+			reason := ""
+			if rule.KeepSessions > 0 && i >= rule.KeepSessions {
+				reason = "exceeds keep_sessions " + strconv.Itoa(rule.KeepSessions)
+			} else if rule.KeepDays > 0 && now.Sub(time.Unix(ts, 0)) > time.Duration(rule.KeepDays)*24*time.Hour {
+				reason = "older than keep_days " + strconv.Itoa(rule.KeepDays)
+			}
+			if reason == "" {
+				continue
+			}
+			actions = append(actions, RetentionAction{
+				Channel: channel,
+				Session: session,
+				Reason:  reason,
+				Keys:    sessions[channel][session],
+			})
+		}
+	}
+
+	return actions
+}
+
+// RunRetention applies the configured retention rules to the recording
+// bucket of the tenant of ctx. With dryRun set nothing is deleted and the
+// report lists what would have been. Keys that could not be deleted are
+// reported in a *DeleteError after every action has been tried.
+func RunRetention(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+	rules := GetRetentionRules()
+
+	client := newS3Client(ctx)
+	objects, err := listObjects(ctx, client, "")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetentionReport{
+		DryRun:  dryRun,
+		RanAt:   time.Now().UTC(),
+		Actions: PlanRetention(rules, objects, time.Now()),
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	failed := map[string]string{}
+	for i, action := range report.Actions {
+		deleted, err := deleteObjects(ctx, client, action.Keys)
+		report.Actions[i].Keys = deleted
+		deleteErr, ok := err.(*DeleteError)
+		if err != nil && !ok {
+			return report, err
+		}
+		if ok {
+			for _, key := range action.Keys {
+				if reason, refused := deleteErr.Failed[key]; refused {
+					report.Actions[i].Failed = append(report.Actions[i].Failed, key)
+					failed[key] = reason
+				}
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return report, &DeleteError{Failed: failed}
+	}
+	return report, nil
+}
+
+// StartRetentionJob runs the retention rules against the bucket of every
+// tenant every RETENTION_INTERVAL_MINUTES. It does nothing when the interval
+// is not set and stops on shutdown.
+func StartRetentionJob() {
+	interval := CurrentConfig().RetentionIntervalMinutes
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+		defer ticker.Stop()
+		ctx := ServerContext()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for _, tenant := range Tenants() {
+				report, err := RunRetention(WithTenant(ctx, tenant), CurrentConfig().RetentionDryRun)
+				if err != nil {
+					log.Printf("retention: %s: %s", tenant.ID, err)
+				}
+				if report == nil {
+					continue
+				}
+				for _, action := range report.Actions {
+					if report.DryRun {
+						log.Printf("retention: %s: would delete %s/%s (%s, %d objects)", tenant.ID, action.Channel, action.Session, action.Reason, len(action.Keys))
+					} else {
+						log.Printf("retention: %s: deleted %s/%s (%s, %d objects)", tenant.ID, action.Channel, action.Session, action.Reason, len(action.Keys))
+					}
+				}
+			}
+		}
+	}()
+}
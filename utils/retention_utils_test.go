@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestPlanRetention(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := func(daysAgo int) string {
+		return strconv.FormatInt(now.Add(-time.Duration(daysAgo)*24*time.Hour).Unix(), 10)
+	}
+	var objects []types.Object
+	for _, key := range []string{
+		"demo/" + day(1) + "/a.m3u8",
+		"demo/" + day(10) + "/b.m3u8",
+		"demo/" + day(10) + "/b0.ts",
+		"demo/" + day(40) + "/c.m3u8",
+		"demo/notes.txt",
+		"demo/draft/d.m3u8",
+		"vip-room/" + day(90) + "/e.m3u8",
+		"other/" + day(90) + "/f.m3u8",
+	} {
+		objects = append(objects, types.Object{Key: aws.String(key)})
+	}
+	rules := []RetentionRule{
+		{Prefix: "", KeepSessions: 2},
+		{Prefix: "demo", KeepDays: 30, KeepSessions: 2},
+		{Prefix: "vip", KeepDays: 30, LegalHold: true},
+	}
+
+	actions := PlanRetention(rules, objects, now)
+
+	var got []string
+	for _, action := range actions {
+		got = append(got, action.Channel+"/"+action.Session+": "+action.Reason)
+	}
+	want := []string{
+		"demo/" + day(40) + ": exceeds keep_sessions 2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+
+	rules[1].KeepSessions = 0
+	rules[1].KeepDays = 5
+	actions = PlanRetention(rules, objects, now)
+	got = nil
+	for _, action := range actions {
+		got = append(got, action.Channel+"/"+action.Session+": "+action.Reason)
+	}
+	want = []string{
+		"demo/" + day(10) + ": older than keep_days 5",
+		"demo/" + day(40) + ": older than keep_days 5",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+	if len(actions) == 2 && len(actions[0].Keys) != 2 {
+		t.Errorf("keys of the first action = %v, want the playlist and its segment", actions[0].Keys)
+	}
+}
+
+func TestRunRetention(t *testing.T) {
+	fake, cfg := newTestBucket(t)
+	cfg.RetentionRules = []RetentionRule{{Prefix: "demo", KeepSessions: 1}}
+	start := time.Now().Add(-48 * time.Hour)
+	old := fake.SeedSession("demo", start, "old", 2)
+	older := fake.SeedSession("demo", start.Add(-time.Hour), "older", 1)
+	kept := fake.SeedSession("demo", start.Add(time.Hour), "kept", 1)
+
+	report, err := RunRetention(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Actions) != 2 || len(fake.Keys()) != 7 || fake.Requests("delete") != 0 {
+		t.Fatalf("dry run: %d actions, %d keys left, %d deletes", len(report.Actions), len(fake.Keys()), fake.Requests("delete"))
+	}
+
+	fake.DenyDelete(older)
+	report, err = RunRetention(context.Background(), false)
+	deleteErr, ok := err.(*DeleteError)
+	if !ok || len(deleteErr.Failed) != 1 {
+		t.Fatalf("err = %v, want the refused playlist reported", err)
+	}
+	deleted := 0
+	for _, action := range report.Actions {
+		deleted += len(action.Keys)
+		if action.Session == strconv.FormatInt(start.Add(-time.Hour).Unix(), 10) && !reflect.DeepEqual(action.Failed, []string{older}) {
+			t.Errorf("failed keys = %v, want %s", action.Failed, older)
+		}
+	}
+	if deleted != 4 {
+		t.Errorf("reported %d deleted keys, want 4", deleted)
+	}
+	if _, ok := fake.Object(old); ok {
+		t.Error("old session kept")
+	}
+	for _, key := range []string{older, kept} {
+		if _, ok := fake.Object(key); !ok {
+			t.Errorf("%s deleted", key)
+		}
+	}
+}
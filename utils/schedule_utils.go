@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recurrence is the supported subset of an iCalendar RRULE:
+// FREQ=DAILY|WEEKLY with optional INTERVAL, COUNT and UNTIL
+type Recurrence struct {
+	Freq     string     `json:"freq"`
+	Interval int        `json:"interval"`
+	Count    int        `json:"count,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// ParseRecurrence parses a rule such as "FREQ=WEEKLY;INTERVAL=2;COUNT=10".
+// An empty rule returns nil for a one-off schedule.
+func ParseRecurrence(rule string) (*Recurrence, error) {
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	if rule == "" {
+		return nil, nil
+	}
+
+	r := &Recurrence{Interval: 1}
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid recurrence part %q", part)
+		}
+
+		var err error
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(kv[1])
+		case "COUNT":
+			r.Count, err = strconv.Atoi(kv[1])
+		case "UNTIL":
+			var until time.Time
+			until, err = time.Parse("20060102T150405Z", kv[1])
+			if err != nil {
+				until, err = time.Parse(time.RFC3339, kv[1])
+			}
+			r.Until = &until
+		default:
+			return nil, fmt.Errorf("unsupported recurrence part %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid recurrence %s: %s", kv[0], err)
+		}
+	}
+
+	if r.Freq != "DAILY" && r.Freq != "WEEKLY" {
+		return nil, errors.New("recurrence FREQ must be DAILY or WEEKLY")
+	}
+	if r.Interval <= 0 || r.Count < 0 {
+		return nil, errors.New("recurrence INTERVAL and COUNT must be positive")
+	}
+	return r, nil
+}
+
+// next returns the occurrence after t
+func (r *Recurrence) next(t time.Time) time.Time {
+	if r.Freq == "WEEKLY" {
+		return t.AddDate(0, 0, 7*r.Interval)
+	}
+	return t.AddDate(0, 0, r.Interval)
+}
+
+// Schedule is a recording the service starts on its own
+type Schedule struct {
+	ID              string      `json:"id"`
+	Tenant          string      `json:"tenant,omitempty"`
+	Channel         string      `json:"channel"`
+	StartAt         time.Time   `json:"start_at"`
+	DurationSeconds int         `json:"duration_seconds"`
+	Preset          string      `json:"preset,omitempty"`
+	Recurrence      *Recurrence `json:"recurrence,omitempty"`
+	Runs            int         `json:"runs"`
+	SIDs            []string    `json:"sids,omitempty"`
+	LastError       string      `json:"last_error,omitempty"`
+	Done            bool        `json:"done"`
+	CreatedBy       string      `json:"created_by"`
+}
+
+// ScheduleStore persists schedules to SCHEDULE_STORE_PATH and keeps a timer
+// for each pending one
+type ScheduleStore struct {
+	mu        sync.Mutex
+	loaded    bool
+	schedules map[string]Schedule
+	timers    map[string]*time.Timer
+}
+
+// Schedules is the schedule store of this service
+var Schedules = &ScheduleStore{}
+
+func (s *ScheduleStore) path() string {
+	if path := CurrentConfig().ScheduleStorePath; path != "" {
+		return path
+	}
+	return "schedules.json"
+}
+
+// load reads the store file on first use. The caller must hold mu.
+func (s *ScheduleStore) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	s.schedules = map[string]Schedule{}
+	s.timers = map[string]*time.Timer{}
+	if err := readJSONFile(s.path(), &s.schedules); err != nil {
+		return err
+	}
+
+	s.loaded = true
+	return nil
+}
+
+// Create validates and stores a new schedule and arms its timer
+func (s *ScheduleStore) Create(schedule Schedule) (Schedule, error) {
+	if schedule.Channel == "" {
+		return Schedule{}, errors.New("channel is required")
+	}
+	if schedule.StartAt.IsZero() {
+		return Schedule{}, errors.New("start time is required")
+	}
+	if schedule.DurationSeconds <= 0 {
+		return Schedule{}, errors.New("duration must be positive")
+	}
+	tenant, ok := GetTenant(schedule.Tenant)
+	if !ok {
+		return Schedule{}, errors.New("unknown tenant " + schedule.Tenant)
+	}
+	// the timer resolves the tenant long after the request is gone
+	schedule.Tenant = copyString(tenant.ID)
+	if _, ok := TranscodingPreset(tenant, schedule.Preset); !ok {
+		return Schedule{}, errors.New("unknown transcoding preset " + schedule.Preset)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Schedule{}, err
+	}
+	schedule.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return Schedule{}, err
+	}
+	s.schedules[schedule.ID] = schedule
+	if err := writeJSONFile(s.path(), s.schedules); err != nil {
+		return Schedule{}, err
+	}
+	s.arm(schedule)
+
+	return schedule, nil
+}
+
+// Delete removes a schedule. Recordings it already started keep running.
+func (s *ScheduleStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if _, ok := s.schedules[id]; !ok {
+		return false, nil
+	}
+
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	delete(s.schedules, id)
+	return true, writeJSONFile(s.path(), s.schedules)
+}
+
+// Get returns the schedule with the given ID
+func (s *ScheduleStore) Get(id string) (Schedule, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return Schedule{}, false, err
+	}
+	schedule, ok := s.schedules[id]
+	return schedule, ok, nil
+}
+
+// List returns all schedules ordered by their next start
+func (s *ScheduleStore) List() ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	schedules := []Schedule{}
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].StartAt.Before(schedules[j].StartAt)
+	})
+	return schedules, nil
+}
+
+// Resume arms the timers of every pending schedule. It is called once at
+// startup.
+func (s *ScheduleStore) Resume() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	for _, schedule := range s.schedules {
+		s.arm(schedule)
+	}
+	return nil
+}
+
+// arm sets the timer for the next occurrence. The caller must hold mu.
+func (s *ScheduleStore) arm(schedule Schedule) {
+	if schedule.Done {
+		return
+	}
+	if timer, ok := s.timers[schedule.ID]; ok {
+		timer.Stop()
+	}
+
+	id := schedule.ID
+	s.timers[id] = time.AfterFunc(time.Until(schedule.StartAt), func() {
+		select {
+		case <-Draining():
+			// left for the next start, which records what is left of it
+			return
+		default:
+		}
+		runJob(func() { s.fire(id) })
+	})
+}
+
+// end returns when the current occurrence is over
+func (schedule Schedule) end() time.Time {
+	return schedule.StartAt.Add(time.Duration(schedule.DurationSeconds) * time.Second)
+}
+
+// advance counts the current occurrence as run and moves to the next one,
+// marking the schedule done when there is none
+func (schedule *Schedule) advance() {
+	schedule.Runs++
+
+	r := schedule.Recurrence
+	if r == nil || (r.Count > 0 && schedule.Runs >= r.Count) {
+		schedule.Done = true
+		return
+	}
+	schedule.StartAt = r.next(schedule.StartAt)
+	if r.Until != nil && schedule.StartAt.After(*r.Until) {
+		schedule.Done = true
+	}
+}
+
+// start records the current occurrence for the time it has left
+func (schedule Schedule) start(remaining time.Duration) (Session, error) {
+	ctx, err := withTenantID(ServerContext(), schedule.Tenant)
+	if err != nil {
+		return Session{}, err
+	}
+	tenant := TenantFrom(ctx)
+	transcoding, _ := TranscodingPreset(tenant, schedule.Preset)
+	_, session, err := StartSession(ctx, schedule.Channel, transcoding, MaxDuration(tenant, int(remaining/time.Second)), "schedule:"+schedule.ID)
+	return session, err
+}
+
+// fire starts the recording of a due schedule and arms the next occurrence
+func (s *ScheduleStore) fire(id string) {
+	s.mu.Lock()
+	schedule, ok := s.schedules[id]
+	delete(s.timers, id)
+	s.mu.Unlock()
+	if !ok || schedule.Done {
+		return
+	}
+
+	// occurrences that ended while the service was down are skipped in one
+	// go; one still going is recorded for the time it has left
+	now := time.Now()
+	for !schedule.Done && !schedule.end().After(now) {
+		log.Printf("schedule: %s missed the occurrence at %s", schedule.ID, schedule.StartAt.Format(time.RFC3339))
+		schedule.advance()
+	}
+
+	if !schedule.Done && !schedule.StartAt.After(now) {
+		session, err := schedule.start(schedule.end().Sub(now))
+		if err != nil {
+			log.Printf("schedule: %s: %s", schedule.ID, err)
+			schedule.LastError = err.Error()
+		} else {
+			LogEvent(sessionLogContext(ServerContext(), session), "schedule", "started", Fields{"schedule": schedule.ID})
+			schedule.LastError = ""
+			schedule.SIDs = append(schedule.SIDs, session.SID)
+		}
+		schedule.advance()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the schedule may have been deleted while the recording started
+	if _, ok := s.schedules[id]; !ok {
+		return
+	}
+	s.schedules[id] = schedule
+	if err := writeJSONFile(s.path(), s.schedules); err != nil {
+		log.Printf("schedule: %s: %s", schedule.ID, err)
+	}
+	s.arm(schedule)
+}
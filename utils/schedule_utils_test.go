@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	until := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule string
+		want *Recurrence
+	}{
+		{"", nil},
+		{"FREQ=DAILY", &Recurrence{Freq: "DAILY", Interval: 1}},
+		{"RRULE:freq=weekly;INTERVAL=2;COUNT=10", &Recurrence{Freq: "WEEKLY", Interval: 2, Count: 10}},
+		{"FREQ=DAILY;UNTIL=20210630T120000Z", &Recurrence{Freq: "DAILY", Interval: 1, Until: &until}},
+		{"FREQ=DAILY;UNTIL=2021-06-30T12:00:00Z", &Recurrence{Freq: "DAILY", Interval: 1, Until: &until}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRecurrence(tt.rule)
+		if err != nil {
+			t.Errorf("%q: %s", tt.rule, err)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) {
+			t.Errorf("%q = %+v, want %+v", tt.rule, got, tt.want)
+			continue
+		}
+		if got == nil {
+			continue
+		}
+		if got.Freq != tt.want.Freq || got.Interval != tt.want.Interval || got.Count != tt.want.Count ||
+			(got.Until == nil) != (tt.want.Until == nil) || (got.Until != nil && !got.Until.Equal(*tt.want.Until)) {
+			t.Errorf("%q = %+v, want %+v", tt.rule, got, tt.want)
+		}
+	}
+
+	for _, rule := range []string{"FREQ=MONTHLY", "FREQ=DAILY;INTERVAL=0", "FREQ=DAILY;COUNT=-1", "FREQ=DAILY;BYDAY=MO", "FREQ", "FREQ=DAILY;UNTIL=tomorrow"} {
+		if _, err := ParseRecurrence(rule); err == nil {
+			t.Errorf("%q accepted", rule)
+		}
+	}
+}
+
+// waitForRuns waits until the schedule id has fired
+func waitForRuns(t *testing.T, id string) Schedule {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if schedule, _, _ := Schedules.Get(id); schedule.Runs > 0 {
+			return schedule
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("schedule %s never fired", id)
+	return Schedule{}
+}
+
+func TestScheduleCatchUp(t *testing.T) {
+	fake, _, cfg := newTestAgora(t)
+	cfg.ScheduleStorePath = filepath.Join(t.TempDir(), "schedules.json")
+	Schedules = &ScheduleStore{}
+	defer func() { Schedules = &ScheduleStore{} }()
+
+	if _, err := Schedules.Create(Schedule{Channel: "demo", DurationSeconds: 3600}); err == nil {
+		t.Error("schedule without a start time accepted")
+	}
+
+	now := time.Now()
+	daily := &Recurrence{Freq: "DAILY", Interval: 1}
+
+	// four daily occurrences are over, so the next one is tomorrow
+	missed, err := Schedules.Create(Schedule{Channel: "missed", StartAt: now.Add(-74 * time.Hour), DurationSeconds: 3600, Recurrence: daily})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := waitForRuns(t, missed.ID)
+	if schedule.Runs != 4 || len(schedule.SIDs) != 0 || schedule.Done {
+		t.Errorf("missed = %+v, want four runs skipped", schedule)
+	}
+	if want := missed.StartAt.AddDate(0, 0, 4); !schedule.StartAt.Equal(want) || !schedule.StartAt.After(now) {
+		t.Errorf("next start %s, want %s", schedule.StartAt, want)
+	}
+	if got := fake.Calls(OpStart); got != 0 {
+		t.Errorf("%d starts for occurrences that are over", got)
+	}
+
+	// the occurrence still going is recorded, and COUNT includes the
+	// missed ones
+	counted := &Recurrence{Freq: "DAILY", Interval: 1, Count: 3}
+	going, err := Schedules.Create(Schedule{Channel: "going", StartAt: now.Add(-48*time.Hour - 30*time.Minute), DurationSeconds: 3600, Recurrence: counted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule = waitForRuns(t, going.ID)
+	if schedule.Runs != 3 || len(schedule.SIDs) != 1 || !schedule.Done || schedule.LastError != "" {
+		t.Errorf("going = %+v, want the last occurrence recorded", schedule)
+	}
+	session, _, _ := Sessions.Get(schedule.SIDs[0])
+	if session.StopAt == nil || session.StopAt.Sub(now) > 31*time.Minute {
+		t.Errorf("session = %+v, want it stopped when the occurrence ends", session)
+	}
+}
@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// Session states
+const (
+	SessionRecording = "recording"
+	SessionStopped   = "stopped"
+)
+
+// Session is a cloud recording started by this service. EndReason explains
+// sessions that ended without a stop request; Overdue is set once a session
+// runs longer than MAX_SESSION_MINUTES. StopAt is the deadline at which the
+// service stops the session on its own.
+type Session struct {
+	Tenant      string            `json:"tenant,omitempty"`
+	Channel     string            `json:"channel"`
+	UID         int               `json:"uid"`
+	RID         string            `json:"rid"`
+	SID         string            `json:"sid"`
+	Mode        string            `json:"mode"`
+	Prefix      string            `json:"prefix"`
+	Transcoding TranscodingConfig `json:"transcoding"`
+	Status      string            `json:"status"`
+	StartedAt   time.Time         `json:"started_at"`
+	StopAt      *time.Time        `json:"stop_at,omitempty"`
+	StoppedAt   *time.Time        `json:"stopped_at,omitempty"`
+	ExitedAt    *time.Time        `json:"exited_at,omitempty"`
+	StartedBy   string            `json:"started_by"`
+	StoppedBy   string            `json:"stopped_by,omitempty"`
+	EndReason   string            `json:"end_reason,omitempty"`
+	Overdue     bool              `json:"overdue,omitempty"`
+}
+
+// SessionStore keeps track of recording sessions in a JSON file so they
+// survive restarts
+type SessionStore struct {
+	mu       sync.Mutex
+	loaded   bool
+	sessions map[string]Session
+}
+
+// Sessions is the session store of this service, persisted to
+// SESSION_STORE_PATH
+var Sessions = &SessionStore{}
+
+func (s *SessionStore) path() string {
+	if path := CurrentConfig().SessionStorePath; path != "" {
+		return path
+	}
+	return "sessions.json"
+}
+
+// load reads the store file on first use. The caller must hold mu.
+func (s *SessionStore) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	s.sessions = map[string]Session{}
+	if err := readJSONFile(s.path(), &s.sessions); err != nil {
+		return err
+	}
+
+	s.loaded = true
+	return nil
+}
+
+// persist replaces the store file. The caller must hold mu.
+func (s *SessionStore) persist() error {
+	return writeJSONFile(s.path(), s.sessions)
+}
+
+// Save adds or replaces a session, keyed by its SID
+func (s *SessionStore) Save(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.sessions[session.SID] = session
+	return s.persist()
+}
+
+// Get returns the session with the given SID
+func (s *SessionStore) Get(sid string) (Session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return Session{}, false, err
+	}
+	session, ok := s.sessions[sid]
+	return session, ok, nil
+}
+
+// Update applies change to the stored session sid under the store lock,
+// so it sees any stop saved meanwhile, and saves the session when change
+// returns true. It reports whether the session was changed.
+func (s *SessionStore) Update(sid string, change func(session *Session) bool) (Session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return Session{}, false, err
+	}
+	session, ok := s.sessions[sid]
+	if !ok || !change(&session) {
+		return session, false, nil
+	}
+	s.sessions[sid] = session
+	return session, true, s.persist()
+}
+
+// RecordExit notes when Agora reported the recording service of a running
+// session exited, which the reconciler then takes as its end
+func (s *SessionStore) RecordExit(sid string, exitedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	session, ok := s.sessions[sid]
+	if !ok || session.Status != SessionRecording || session.ExitedAt != nil {
+		return nil
+	}
+	exitedAt = exitedAt.UTC()
+	session.ExitedAt = &exitedAt
+	s.sessions[sid] = session
+	return s.persist()
+}
+
+// List returns all sessions, oldest first
+func (s *SessionStore) List() ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions, nil
+}
+
+// StartSession acquires a resource, starts a mix mode recording of channel
+// for the tenant of ctx and tracks it in the session store. A positive
+// maxDuration schedules an automatic stop. Starts beyond the quotas of the
+// tenant fail with a *QuotaError.
+func StartSession(ctx context.Context, channel string, transcoding TranscodingConfig, maxDuration time.Duration, principal string) (*Recorder, Session, error) {
+	ctx = WithLogFields(ctx, Fields{"channel": channel})
+	release, err := reserveRecording(TenantFrom(ctx))
+	if err != nil {
+		return nil, Session{}, err
+	}
+	defer release()
+
+	rec := &Recorder{
+		Tenant:      TenantFrom(ctx),
+		Channel:     channel,
+		Transcoding: transcoding,
+	}
+
+	if _, err := rec.Acquire(ctx); err != nil {
+		return nil, Session{}, err
+	}
+
+	// Start retries reuse the acquired resource; only an expired one is
+	// acquired again
+	_, err = rec.Start(ctx)
+	if err != nil && (cloudrecording.ResourceExpired(err) || !rec.ResourceValid()) {
+		if _, err = rec.Acquire(ctx); err == nil {
+			_, err = rec.Start(ctx)
+		}
+	}
+	if err != nil {
+		return nil, Session{}, err
+	}
+
+	session := Session{
+		Tenant:      rec.Tenant.ID,
+		Channel:     rec.Channel,
+		UID:         rec.UID,
+		RID:         rec.RID,
+		SID:         rec.SID,
+		Mode:        cloudrecording.ModeMix,
+		Prefix:      rec.Prefix(),
+		Transcoding: rec.Transcoding,
+		Status:      SessionRecording,
+		StartedAt:   rec.StartedAt.UTC(),
+		StartedBy:   principal,
+	}
+	if maxDuration > 0 {
+		stopAt := session.StartedAt.Add(maxDuration)
+		session.StopAt = &stopAt
+	}
+
+	// the recording is running either way, so a store failure is not fatal
+	if err := Sessions.Save(session); err != nil {
+		LogEvent(sessionLogContext(ctx, session), "session-store", "saving session failed", Fields{"error": err.Error()})
+	}
+	ScheduleAutoStop(session)
+	Audit(ctx, AuditEvent{
+		Action:    AuditRecordingStart,
+		Principal: principal,
+		Channel:   session.Channel,
+		UID:       strconv.Itoa(session.UID),
+		SID:       session.SID,
+	})
+
+	return rec, session, nil
+}
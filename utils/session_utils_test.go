@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording/cloudrecordingtest"
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/s3test"
+)
+
+// newTestAgora points the default tenant at a fake Agora server and a fake
+// bucket, with a fresh session store
+func newTestAgora(t *testing.T) (*cloudrecordingtest.Server, *s3test.Server, *Config) {
+	bucket, cfg := newTestBucket(t)
+	fake := cloudrecordingtest.NewServer("970ca35de60c44645bbae8a215061b33", "customer", "secret")
+	t.Cleanup(fake.Close)
+
+	cfg.AppID = fake.AppID
+	cfg.AppCertificate = "5cfd2fd1755d40ecb72977518be15d3b"
+	cfg.CustomerID = "customer"
+	cfg.CustomerCertificate = "secret"
+	cfg.AgoraBaseURL = fake.URL
+	cfg.SessionStorePath = filepath.Join(t.TempDir(), "sessions.json")
+	cfg.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	Sessions = &SessionStore{}
+	t.Cleanup(func() { Sessions = &SessionStore{} })
+	return fake, bucket, cfg
+}
+
+func TestSessionStore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SessionStorePath = filepath.Join(t.TempDir(), "sessions.json")
+	setTestConfig(t, cfg)
+
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	store := &SessionStore{}
+	for i, sid := range []string{"late", "early"} {
+		session := Session{SID: sid, Channel: "demo", Status: SessionRecording, StartedAt: start.Add(time.Duration(-i) * time.Hour)}
+		if err := store.Save(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopped := Session{SID: "late", Channel: "demo", Status: SessionStopped, StartedAt: start}
+	if err := store.Save(stopped); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store reads what the old one wrote
+	reloaded := &SessionStore{}
+	sessions, err := reloaded.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].SID != "early" || sessions[1].SID != "late" {
+		t.Fatalf("sessions = %+v, want early then late", sessions)
+	}
+	if session, ok, _ := reloaded.Get("late"); !ok || session.Status != SessionStopped {
+		t.Errorf("late = %+v, want it replaced by the stopped session", session)
+	}
+	if _, ok, _ := reloaded.Get("missing"); ok {
+		t.Error("unknown SID found")
+	}
+
+	// updates see the stored session, not a copy read earlier
+	endRecording := func(session *Session) bool {
+		if session.Status != SessionRecording {
+			return false
+		}
+		session.EndReason = "ended"
+		return true
+	}
+	if _, changed, err := reloaded.Update("late", endRecording); err != nil || changed {
+		t.Errorf("stopped session changed: %v, %v", changed, err)
+	}
+	if session, changed, err := reloaded.Update("early", endRecording); err != nil || !changed || session.EndReason != "ended" {
+		t.Errorf("recording session = %+v, changed %v, %v", session, changed, err)
+	}
+	if session, _, _ := (&SessionStore{}).Get("early"); session.EndReason != "ended" {
+		t.Errorf("update not saved: %+v", session)
+	}
+}
+
+func TestCompleteSession(t *testing.T) {
+	_, bucket, _ := newTestAgora(t)
+
+	_, session, err := StartSession(context.Background(), "demo", DefaultTranscodingConfig, 0, "starter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []RecordingFile{{Filename: session.SID + "_demo.m3u8", Tracktype: "audio_and_video"}}
+	manifest, err := CompleteSession(context.Background(), "demo", session.UID, session.RID, session.SID, "stopper", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _, _ := Sessions.Get(session.SID)
+	if stored.Status != SessionStopped || stored.StoppedBy != "stopper" || stored.StoppedAt == nil {
+		t.Errorf("stored session = %+v", stored)
+	}
+
+	object, ok := bucket.Object(session.Prefix + manifestName)
+	if !ok {
+		t.Fatalf("no manifest under %s", session.Prefix)
+	}
+	var written Manifest
+	if err := json.Unmarshal(object.Body, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.SID != session.SID || written.StartedBy != "starter" || written.StoppedBy != "stopper" || len(written.Files) != 1 || written.Files[0].Filename != files[0].Filename {
+		t.Errorf("manifest = %+v", written)
+	}
+	if !written.StoppedAt.Equal(manifest.StoppedAt) {
+		t.Errorf("manifest stopped at %s, returned %s", written.StoppedAt, manifest.StoppedAt)
+	}
+
+	manifests, err := GetManifests(context.Background(), "demo")
+	if err != nil || len(manifests) != 1 || manifests[0].SID != session.SID {
+		t.Errorf("GetManifests = %+v, %v", manifests, err)
+	}
+}
+
+func TestCompleteUntrackedSession(t *testing.T) {
+	_, bucket, _ := newTestAgora(t)
+
+	// without a playlist there is nothing to describe
+	manifest, err := CompleteSession(context.Background(), "demo", 1, "rid", "unknown", "stopper", nil)
+	if err != nil || manifest != nil {
+		t.Fatalf("manifest = %+v, %v", manifest, err)
+	}
+
+	// sessions started before the store existed are found by their playlist
+	playlistKey := bucket.SeedSession("demo", time.Unix(1620000000, 0), "old", 2)
+	manifest, err = CompleteSession(context.Background(), "demo", 1, "rid", "old", "stopper", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest == nil || manifest.Prefix != "demo/1620000000/" {
+		t.Fatalf("manifest = %+v for %s", manifest, playlistKey)
+	}
+	if _, ok := bucket.Object("demo/1620000000/" + manifestName); !ok {
+		t.Error("manifest not written next to the playlist")
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// shutdownPrincipal is recorded as StoppedBy for sessions stopped on shutdown
+const shutdownPrincipal = "shutdown"
+
+var (
+	draining     = make(chan struct{})
+	drainingOnce sync.Once
+
+	jobsMu   sync.Mutex
+	jobs     int
+	jobsIdle = make(chan struct{})
+)
+
+// StartDraining tells long-lived streams to end so the HTTP server can
+// finish the requests in flight. It is the first step of a shutdown.
+func StartDraining() {
+	drainingOnce.Do(func() { close(draining) })
+}
+
+// Draining is closed once the service starts shutting down
+func Draining() <-chan struct{} {
+	return draining
+}
+
+// runJob runs fn in the background as work the service finishes before it
+// exits, such as stopping a recording or writing its manifest
+func runJob(fn func()) {
+	jobsMu.Lock()
+	if jobs == 0 {
+		jobsIdle = make(chan struct{})
+	}
+	jobs++
+	jobsMu.Unlock()
+
+	go func() {
+		defer func() {
+			jobsMu.Lock()
+			jobs--
+			if jobs == 0 {
+				close(jobsIdle)
+			}
+			jobsMu.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// waitForJobs waits until no background job is running or ctx is done
+func waitForJobs(ctx context.Context) error {
+	for {
+		jobsMu.Lock()
+		running, idle := jobs, jobsIdle
+		jobsMu.Unlock()
+		if running == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+		}
+	}
+}
+
+// ShutdownTimeout returns how long a shutdown may take before the remaining
+// work is abandoned
+func ShutdownTimeout() time.Duration {
+	seconds := CurrentConfig().ShutdownTimeoutSeconds
+	if seconds <= 0 {
+		seconds = 30
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Drain finishes the work of the service once the HTTP server has stopped.
+// With SHUTDOWN_STOP_RECORDINGS set it stops every active recording;
+// otherwise recordings keep running and are picked up from the session
+// store on the next start. It then waits for background jobs until ctx is
+// done and cancels ServerContext, abandoning whatever is left.
+func Drain(ctx context.Context) error {
+	StartDraining()
+	defer Shutdown()
+
+	if CurrentConfig().ShutdownStopRecordings {
+		if err := stopAllSessions(ctx); err != nil {
+			log.Println("shutdown: listing sessions:", err)
+		}
+	}
+
+	if err := waitForJobs(ctx); err != nil {
+		log.Println("shutdown: abandoning background jobs:", err)
+		return err
+	}
+	return nil
+}
+
+// stopAllSessions stops every recording in the session store concurrently
+func stopAllSessions(ctx context.Context) error {
+	sessions, err := Sessions.List()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		if session.Status != SessionRecording {
+			continue
+		}
+		wg.Add(1)
+		go func(session Session) {
+			defer wg.Done()
+			ctx := sessionLogContext(ctx, session)
+			if err := StopSession(ctx, session, shutdownPrincipal, "service shut down"); err != nil {
+				LogEvent(ctx, "shutdown", "stop failed", Fields{"error": err.Error()})
+				return
+			}
+			LogEvent(ctx, "shutdown", "stopped", nil)
+		}(session)
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStopAllSessions(t *testing.T) {
+	fake, _, _ := newTestAgora(t)
+
+	_, session, err := StartSession(context.Background(), "demo", DefaultTranscodingConfig, 0, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stopAllSessions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Calls(OpStop); got != 1 {
+		t.Errorf("stop calls = %d, want 1", got)
+	}
+	stored, _, _ := Sessions.Get(session.SID)
+	if stored.Status == SessionRecording || stored.StoppedBy != shutdownPrincipal {
+		t.Errorf("session = %+v, want it stopped on shutdown", stored)
+	}
+}
+
+func TestWaitForJobs(t *testing.T) {
+	release := make(chan struct{})
+	runJob(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := waitForJobs(ctx); err != context.DeadlineExceeded {
+		t.Errorf("waiting on a running job: err = %v", err)
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := waitForJobs(ctx); err != nil {
+		t.Errorf("waiting on a finished job: err = %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+)
+
+// Status stream event types
+const (
+	EventState = "state"
+	EventFiles = "files"
+	EventError = "error"
+	EventEnded = "ended"
+)
+
+// StatusEvent is pushed to status stream subscribers
+type StatusEvent struct {
+	Type   string          `json:"type"`
+	SID    string          `json:"sid"`
+	State  string          `json:"state,omitempty"`
+	Paused bool            `json:"paused,omitempty"`
+	Files  []RecordingFile `json:"files,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// statusPoller queries one session on behalf of all of its subscribers so
+// Agora only sees a single poller per session
+type statusPoller struct {
+	tenantID       string
+	key            string
+	rid, sid, mode string
+
+	subscribers map[chan StatusEvent]bool
+	last        *StatusEvent
+	files       map[string]bool
+	done        chan struct{}
+}
+
+var (
+	pollers   = map[string]*statusPoller{}
+	pollersMu sync.Mutex
+)
+
+// statusPollInterval returns how often sessions with subscribers are queried
+func statusPollInterval() time.Duration {
+	seconds := CurrentConfig().StatusPollSeconds
+	if seconds <= 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SubscribeStatus streams state changes, new files and termination of a
+// session of tenant. The channel is closed once the session has ended; call
+// the returned function to unsubscribe earlier.
+func SubscribeStatus(tenant Tenant, rid string, sid string, mode string) (<-chan StatusEvent, func()) {
+	events := make(chan StatusEvent, 16)
+	key := tenant.ID + "/" + sid
+
+	pollersMu.Lock()
+	poller, ok := pollers[key]
+	if !ok {
+		poller = &statusPoller{
+			tenantID:    tenant.ID,
+			key:         key,
+			rid:         rid,
+			sid:         sid,
+			mode:        mode,
+			subscribers: map[chan StatusEvent]bool{},
+			files:       map[string]bool{},
+			done:        make(chan struct{}),
+		}
+		pollers[key] = poller
+		go poller.run()
+	}
+	poller.subscribers[events] = true
+	if poller.last != nil {
+		events <- *poller.last
+	}
+	pollersMu.Unlock()
+
+	unsubscribe := func() {
+		pollersMu.Lock()
+		defer pollersMu.Unlock()
+
+		if !poller.subscribers[events] {
+			return
+		}
+		delete(poller.subscribers, events)
+		close(events)
+		if len(poller.subscribers) == 0 && pollers[key] == poller {
+			delete(pollers, key)
+			close(poller.done)
+		}
+	}
+
+	return events, unsubscribe
+}
+
+func (p *statusPoller) run() {
+	ticker := time.NewTicker(statusPollInterval())
+	defer ticker.Stop()
+
+	ctx := ServerContext()
+	for {
+		if p.poll(ctx) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			p.end(StatusEvent{Type: EventError, SID: p.sid, Error: ctx.Err().Error()})
+			return
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll queries the session once and reports whether it has ended. The
+// tenant is looked up each time so reloaded credentials apply.
+func (p *statusPoller) poll(ctx context.Context) bool {
+	tenantCtx, err := withTenantID(ctx, p.tenantID)
+	if err != nil {
+		p.end(StatusEvent{Type: EventError, SID: p.sid, Error: err.Error()})
+		return true
+	}
+	tenantCtx = WithLogFields(tenantCtx, Fields{"sid": p.sid})
+	tenant := TenantFrom(tenantCtx)
+	status, err := AgoraClient(tenant).Query(tenantCtx, p.rid, p.sid, p.mode)
+	if cloudrecording.NotFound(err) {
+		p.end(StatusEvent{Type: EventEnded, SID: p.sid, State: cloudrecording.RecordingState(7)})
+		return true
+	}
+	if err != nil {
+		p.broadcast(StatusEvent{Type: EventError, SID: p.sid, Error: err.Error()}, false)
+		return false
+	}
+
+	state := StatusEvent{
+		Type:   EventState,
+		SID:    p.sid,
+		State:  status.ServerResponse.State,
+		Paused: status.ServerResponse.Paused,
+	}
+	pollersMu.Lock()
+	changed := p.last == nil || p.last.State != state.State || p.last.Paused != state.Paused
+	pollersMu.Unlock()
+	if changed {
+		p.broadcast(state, true)
+	}
+
+	var added []RecordingFile
+	for _, file := range status.Files() {
+		if !p.files[file.Filename] {
+			p.files[file.Filename] = true
+			added = append(added, file)
+		}
+	}
+	if len(added) > 0 {
+		p.broadcast(StatusEvent{Type: EventFiles, SID: p.sid, Files: added}, false)
+	}
+
+	if cloudrecording.Ended(status.ServerResponse.Status) {
+		p.end(StatusEvent{Type: EventEnded, SID: p.sid, State: state.State})
+		return true
+	}
+	return false
+}
+
+// broadcast sends an event to every subscriber, dropping it for clients
+// that are too slow to keep up. State events are replayed to new subscribers.
+func (p *statusPoller) broadcast(event StatusEvent, remember bool) {
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+
+	if remember {
+		p.last = &event
+	}
+	for subscriber := range p.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// end sends the final event and closes every subscription
+func (p *statusPoller) end(event StatusEvent) {
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+
+	for subscriber := range p.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+		close(subscriber)
+		delete(p.subscribers, subscriber)
+	}
+	if pollers[p.key] == p {
+		delete(pollers, p.key)
+	}
+}
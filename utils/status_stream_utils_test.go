@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for an event of a status subscription
+func nextEvent(t *testing.T, events <-chan StatusEvent) (StatusEvent, bool) {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status event")
+	}
+	return StatusEvent{}, false
+}
+
+func TestSubscribeStatus(t *testing.T) {
+	fake, _, cfg := newTestAgora(t)
+	cfg.StatusPollSeconds = 1
+
+	_, session, err := StartSession(context.Background(), "demo", DefaultTranscodingConfig, 0, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, _ := GetTenant("")
+
+	first, unsubscribeFirst := SubscribeStatus(tenant, session.RID, session.SID, session.Mode)
+	defer unsubscribeFirst()
+	if event, _ := nextEvent(t, first); event.Type != EventState || event.State != "recording" {
+		t.Fatalf("first event = %+v, want the recording state", event)
+	}
+	if event, _ := nextEvent(t, first); event.Type != EventFiles || len(event.Files) != 1 || event.Files[0].Filename != session.SID+"_demo.m3u8" {
+		t.Fatalf("second event = %+v, want the playlist", event)
+	}
+
+	// a late subscriber gets the current state replayed and shares the
+	// poller, so Agora is queried once per interval
+	second, unsubscribeSecond := SubscribeStatus(tenant, session.RID, session.SID, session.Mode)
+	defer unsubscribeSecond()
+	if event, _ := nextEvent(t, second); event.Type != EventState || event.State != "recording" {
+		t.Fatalf("replayed event = %+v", event)
+	}
+	if got := fake.Calls(OpQuery); got != 1 {
+		t.Errorf("queries = %d, want one shared poll", got)
+	}
+
+	// the bot leaves: both subscribers see the new state, then the end,
+	// and are closed
+	fake.End(session.SID, 20)
+	for _, events := range []<-chan StatusEvent{first, second} {
+		if event, _ := nextEvent(t, events); event.Type != EventState || event.State != "abnormal_exit" {
+			t.Errorf("event = %+v, want the abnormal_exit state", event)
+		}
+		if event, _ := nextEvent(t, events); event.Type != EventEnded || event.State != "abnormal_exit" {
+			t.Errorf("final event = %+v, want ended", event)
+		}
+		if _, ok := nextEvent(t, events); ok {
+			t.Error("subscription not closed after the session ended")
+		}
+	}
+
+	pollersMu.Lock()
+	left := len(pollers)
+	pollersMu.Unlock()
+	if left != 0 {
+		t.Errorf("%d pollers left", left)
+	}
+}
+
+func TestUnsubscribeStopsPolling(t *testing.T) {
+	fake, _, cfg := newTestAgora(t)
+	cfg.StatusPollSeconds = 1
+
+	_, session, err := StartSession(context.Background(), "demo", DefaultTranscodingConfig, 0, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, _ := GetTenant("")
+
+	events, unsubscribe := SubscribeStatus(tenant, session.RID, session.SID, session.Mode)
+	nextEvent(t, events)
+	unsubscribe()
+	unsubscribe()
+
+	// buffered events are still delivered, then the channel is closed
+	for range events {
+	}
+	queries := fake.Calls(OpQuery)
+	time.Sleep(1500 * time.Millisecond)
+	if got := fake.Calls(OpQuery); got != queries {
+		t.Errorf("queries went from %d to %d without subscribers", queries, got)
+	}
+}
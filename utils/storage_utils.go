@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 accepts at most 1000 keys per DeleteObjects call
+const deleteBatchSize = 1000
+
+// newS3Client returns a client for the recording bucket of the tenant of
+// ctx. With an endpoint set it talks to that S3-compatible endpoint using
+// path-style addressing.
+func newS3Client(ctx context.Context) *s3.Client {
+	storage := TenantFrom(ctx).Storage
+	return s3.NewFromConfig(aws.Config{
+		Region:      Regions[storage.Region],
+		Credentials: Creds{AccessKeyID: storage.AccessKey, SecretAccessKey: storage.AccessSecret},
+	}, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, storageMetrics, storageTracing)
+		if storage.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(storage.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// bucketName returns the recording bucket of the tenant of ctx
+func bucketName(ctx context.Context) string {
+	return TenantFrom(ctx).Storage.Bucket
+}
+
+// objectURL returns the unsigned URL of an object in the recording bucket
+func objectURL(ctx context.Context, key string) string {
+	storage := TenantFrom(ctx).Storage
+	if storage.Endpoint != "" {
+		return strings.TrimSuffix(storage.Endpoint, "/") + "/" + storage.Bucket + "/" + key
+	}
+	return "https://" + storage.Bucket + ".s3." + Regions[storage.Region] + ".amazonaws.com/" + key
+}
+
+// listObjects returns every object under prefix, following continuation tokens
+func listObjects(ctx context.Context, client *s3.Client, prefix string) ([]types.Object, error) {
+	bucket := bucketName(ctx)
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	ctx, cancel := operationContext(ctx, OpList)
+	defer cancel()
+
+	var objects []types.Object
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Contents...)
+	}
+
+	return objects, nil
+}
+
+// DeleteError lists the keys storage refused to delete, with the reason
+// given for each
+type DeleteError struct {
+	Failed map[string]string
+}
+
+func (e *DeleteError) Error() string {
+	var keys []string
+	for key := range e.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("%d objects not deleted, first %s: %s", len(keys), keys[0], e.Failed[keys[0]])
+}
+
+// deleteObjects removes the given keys from the recording bucket and
+// returns those that were deleted. Keys storage refuses to delete are left
+// out and reported in a *DeleteError once every batch has been sent.
+func deleteObjects(ctx context.Context, client *s3.Client, keys []string) ([]string, error) {
+	bucket := bucketName(ctx)
+
+	var deleted []string
+	failed := map[string]string{}
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var identifiers []types.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			identifiers = append(identifiers, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		batchCtx, cancel := operationContext(ctx, OpDelete)
+		out, err := client.DeleteObjects(batchCtx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{
+				Objects: identifiers,
+				Quiet:   true,
+			},
+		})
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+
+		// in quiet mode only the keys that failed are listed
+		for _, e := range out.Errors {
+			failed[aws.ToString(e.Key)] = aws.ToString(e.Code) + " " + aws.ToString(e.Message)
+		}
+		for _, key := range keys[start:end] {
+			if _, ok := failed[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return deleted, &DeleteError{Failed: failed}
+	}
+	return deleted, nil
+}
+
+// sessionPrefix returns the storage prefix Start uses for a recording session
+func sessionPrefix(channel string, session string) string {
+	return strings.Trim(channel, "/") + "/" + strings.Trim(session, "/") + "/"
+}
+
+// DeleteSession removes every object stored under a recording session and
+// returns the deleted keys, also when some could not be deleted
+func DeleteSession(ctx context.Context, channel string, session string) ([]string, error) {
+	client := newS3Client(ctx)
+
+	objects, err := listObjects(ctx, client, sessionPrefix(channel, session))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+
+	return deleteObjects(ctx, client, keys)
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultTenantID names the tenant configured by the top-level keys
+const DefaultTenantID = "default"
+
+// TenantStorage is the bucket a tenant's recordings are uploaded to
+type TenantStorage struct {
+	Vendor       int    `mapstructure:"vendor" json:"vendor"`
+	Region       int    `mapstructure:"region" json:"region"`
+	Bucket       string `mapstructure:"bucket" json:"bucket"`
+	AccessKey    string `mapstructure:"access_key" json:"-" secret:"true"`
+	AccessSecret string `mapstructure:"access_secret" json:"-" secret:"true"`
+	Endpoint     string `mapstructure:"endpoint" json:"endpoint,omitempty"`
+}
+
+// TenantRecording holds a tenant's recording defaults and quotas. Zero
+// quotas are unlimited.
+type TenantRecording struct {
+	DefaultPreset           string                       `mapstructure:"default_preset" json:"default_preset,omitempty"`
+	Presets                 map[string]TranscodingConfig `mapstructure:"presets" json:"presets,omitempty"`
+	MaxRecordingSeconds     int                          `mapstructure:"max_recording_seconds" json:"max_recording_seconds,omitempty"`
+	MaxConcurrentRecordings int                          `mapstructure:"max_concurrent_recordings" json:"max_concurrent_recordings,omitempty"`
+	MaxMinutesPerDay        int                          `mapstructure:"max_recording_minutes_per_day" json:"max_recording_minutes_per_day,omitempty"`
+}
+
+// Tenant is an Agora project served by this backend, with its own app
+// credentials, storage and recording defaults
+type Tenant struct {
+	ID                  string          `mapstructure:"-" json:"id"`
+	AppID               string          `mapstructure:"app_id" json:"app_id"`
+	AppCertificate      string          `mapstructure:"app_certificate" json:"-" secret:"true"`
+	CustomerID          string          `mapstructure:"customer_id" json:"-" secret:"true"`
+	CustomerCertificate string          `mapstructure:"customer_certificate" json:"-" secret:"true"`
+	AgoraBaseURL        string          `mapstructure:"agora_base_url" json:"agora_base_url,omitempty"`
+	NCSSecret           string          `mapstructure:"ncs_secret" json:"-" secret:"true"`
+	Storage             TenantStorage   `mapstructure:"storage" json:"storage"`
+	Recording           TenantRecording `mapstructure:"recording" json:"recording"`
+}
+
+// defaultTenant builds the default tenant from the top-level keys
+func defaultTenant() Tenant {
+	cfg := CurrentConfig()
+	return Tenant{
+		ID:                  DefaultTenantID,
+		AppID:               cfg.AppID,
+		AppCertificate:      cfg.AppCertificate,
+		CustomerID:          cfg.CustomerID,
+		CustomerCertificate: cfg.CustomerCertificate,
+		AgoraBaseURL:        cfg.AgoraBaseURL,
+		NCSSecret:           cfg.NCSSecret,
+		Storage: TenantStorage{
+			Vendor:       cfg.RecordingVendor,
+			Region:       cfg.RecordingRegion,
+			Bucket:       cfg.BucketName,
+			AccessKey:    cfg.BucketAccessKey,
+			AccessSecret: cfg.BucketAccessSecret,
+			Endpoint:     cfg.S3Endpoint,
+		},
+		Recording: TenantRecording{
+			Presets:                 cfg.TranscodingPresets,
+			MaxRecordingSeconds:     cfg.MaxRecordingSeconds,
+			MaxConcurrentRecordings: cfg.MaxConcurrentRecordings,
+			MaxMinutesPerDay:        cfg.MaxRecordingMinutesPerDay,
+		},
+	}
+}
+
+// TenantID normalizes a tenant ID, mapping the empty ID of records written
+// before tenants existed to the default tenant
+func TenantID(id string) string {
+	if id == "" {
+		return DefaultTenantID
+	}
+	return id
+}
+
+// GetTenant returns the tenant with the given ID. The default tenant always
+// exists; others are read from TENANTS. IDs are not case sensitive, as
+// config keys are not.
+func GetTenant(id string) (Tenant, bool) {
+	id = strings.ToLower(TenantID(id))
+	if id == DefaultTenantID {
+		return defaultTenant(), true
+	}
+
+	tenant, ok := CurrentConfig().Tenants[id]
+	return withDefaults(id, tenant), ok
+}
+
+// withDefaults fills in the settings a tenant profile shares with the
+// top-level config
+func withDefaults(id string, tenant Tenant) Tenant {
+	tenant.ID = id
+	if tenant.AgoraBaseURL == "" {
+		tenant.AgoraBaseURL = CurrentConfig().AgoraBaseURL
+	}
+	return tenant
+}
+
+// Tenants returns every configured tenant, the default one first
+func Tenants() []Tenant {
+	tenants := CurrentConfig().Tenants
+
+	var ids []string
+	for id := range tenants {
+		if id != DefaultTenantID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	all := []Tenant{defaultTenant()}
+	for _, id := range ids {
+		all = append(all, withDefaults(id, tenants[id]))
+	}
+	return all
+}
+
+// copyString returns a copy of s that shares no memory with it, for IDs
+// taken from a request whose buffers are reused once it is served
+func copyString(s string) string {
+	return string([]byte(s))
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose Agora and storage calls are made for
+// tenant
+func WithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant of ctx, or the default tenant
+func TenantFrom(ctx context.Context) Tenant {
+	if tenant, ok := ctx.Value(tenantKey{}).(Tenant); ok {
+		return tenant
+	}
+	return defaultTenant()
+}
+
+// withTenantID returns a context for the tenant a stored session or
+// schedule belongs to. It fails for tenants since removed from config, whose
+// work must not run against another project.
+func withTenantID(ctx context.Context, id string) (context.Context, error) {
+	tenant, ok := GetTenant(id)
+	if !ok {
+		return ctx, fmt.Errorf("tenant %s is no longer configured", id)
+	}
+	return WithTenant(ctx, tenant), nil
+}
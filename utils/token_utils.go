@@ -5,32 +5,39 @@ import (
 	"time"
 
 	"github.com/AgoraIO-Community/Cloud-Recording-Golang/schemas"
-	"github.com/spf13/viper"
 )
 
 // GetRtcToken generates token for Agora RTC SDK
-func GetRtcToken(channel string, uid int) (string, error) {
+func GetRtcToken(tenant Tenant, channel string, uid int) (string, error) {
 	var RtcRole Role = RolePublisher
 
 	currentTimestamp := uint32(time.Now().UTC().Unix())
 	expireTimestamp := currentTimestamp + 86400
 
-	return BuildRTCTokenWithUID(viper.GetString("APP_ID"), viper.GetString("APP_CERTIFICATE"), channel, uint32(uid), RtcRole, expireTimestamp)
+	token, err := BuildRTCTokenWithUID(tenant.AppID, tenant.AppCertificate, channel, uint32(uid), RtcRole, expireTimestamp)
+	if err == nil {
+		observeToken("rtc", "publisher")
+	}
+	return token, err
 }
 
 // GetRtmToken generates a token for Agora RTM SDK
-func GetRtmToken(user string) (string, error) {
+func GetRtmToken(tenant Tenant, user string) (string, error) {
 
 	currentTimestamp := uint32(time.Now().UTC().Unix())
 	expireTimestamp := currentTimestamp + 86400
 
-	return BuildRTMToken(viper.GetString("APP_ID"), viper.GetString("APP_CERTIFICATE"), user, RoleRtmUser, expireTimestamp)
+	token, err := BuildRTMToken(tenant.AppID, tenant.AppCertificate, user, RoleRtmUser, expireTimestamp)
+	if err == nil {
+		observeToken("rtm", "user")
+	}
+	return token, err
 }
 
 // GenerateUserCredentials generates uid, rtc and rtc token
-func GenerateUserCredentials(channel string) (*schemas.UserCredentials, error) {
+func GenerateUserCredentials(tenant Tenant, channel string) (*schemas.UserCredentials, error) {
 	uid := int(rand.Uint32())
-	rtcToken, err := GetRtcToken(channel, uid)
+	rtcToken, err := GetRtcToken(tenant, channel, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"errors"
+
+	"github.com/AgoraIO-Community/Cloud-Recording-Golang/cloudrecording"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName names the tracer of the spans of this service
+const TracerName = "github.com/AgoraIO-Community/Cloud-Recording-Golang"
+
+// serviceName identifies this service in traces
+const serviceName = "cloud-recording"
+
+// StartTracing exports traces to OTLP_ENDPOINT over OTLP/HTTP. Without an
+// endpoint tracing stays a no-op. The returned function flushes the spans
+// not exported yet; call it on shutdown.
+func StartTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	cfg := CurrentConfig()
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span as a child of the span of ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// AnnotateSpan adds the attributes of a recording to the span of ctx
+func AnnotateSpan(ctx context.Context, channel string, mode string, rid string, sid string) {
+	trace.SpanFromContext(ctx).SetAttributes(cloudrecording.SpanAttributes(channel, mode, rid, sid)...)
+}
+
+// storageTracing traces every request an S3 client sends, next to
+// storageMetrics
+func storageTracing(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("StorageTracing", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		operation := awsmiddleware.GetOperationName(ctx)
+		ctx, span := otel.Tracer(TracerName).Start(ctx, "s3."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			semconv.RPCSystemKey.String("aws-api"),
+			semconv.RPCServiceKey.String("S3"),
+			semconv.RPCMethodKey.String(operation),
+		))
+
+		out, metadata, err := next.HandleFinalize(ctx, in)
+
+		var respErr *smithyhttp.ResponseError
+		if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		} else if errors.As(err, &respErr) {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(respErr.HTTPStatusCode()))
+		}
+		endSpan(span, err)
+		return out, metadata, err
+	}), middleware.After)
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Agora Notification Center product and event identifiers
+const (
+	ProductCloudRecording = 3
+
+	// EventSessionExit is sent when the recording service leaves the channel
+	EventSessionExit = 11
+
+	// EventRecordingUploaded is sent once every file of a session is uploaded
+	EventRecordingUploaded = 31
+)
+
+// VerifyNotification checks the Agora-Signature-V2 header of a notification
+// against the NCS secret of tenant. Tenants without a secret accept no
+// notifications, as anyone could otherwise start recordings.
+func VerifyNotification(tenant Tenant, body []byte, signature string) bool {
+	secret := tenant.NCSSecret
+	if secret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
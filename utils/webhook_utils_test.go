@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyNotification(t *testing.T) {
+	body := []byte(`{"noticeId":"1"}`)
+	mac := hmac.New(sha256.New, []byte("ncs-secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if !VerifyNotification(Tenant{NCSSecret: "ncs-secret"}, body, signature) {
+		t.Error("valid signature refused")
+	}
+	if VerifyNotification(Tenant{NCSSecret: "ncs-secret"}, body, "bad") {
+		t.Error("invalid signature accepted")
+	}
+	if VerifyNotification(Tenant{}, body, "") {
+		t.Error("notification accepted without a secret")
+	}
+}